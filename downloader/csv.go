@@ -2,11 +2,11 @@ package downloader
 
 import (
 	"OpenSeaDataDownloader/helpers"
-	"OpenSeaDataDownloader/utils"
 	"fmt"
+	"time"
 )
 
-func ExportOperations(metaverse, source, metric string) {
+func ExportOperations(metaverse, source, metric string, spec *ExportSpec) {
 	loggingPrefix := fmt.Sprintf("EXPORT DATA { %s | %s }", metaverse, source)
 	helpers.Logging(loggingPrefix, "Start...")
 
@@ -23,6 +23,14 @@ func ExportOperations(metaverse, source, metric string) {
 	if err != nil {
 		panic(err)
 	}
+	err = helpers.SetCurrencyPriceMethod(spec.PriceMethod)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.ValidateNumeraires(spec.Numeraires)
+	if err != nil {
+		panic(err)
+	}
 	if metaverse == "decentraland" {
 		err = helpers.GetDclFocalPoints(dbInstance)
 		if err != nil {
@@ -31,22 +39,52 @@ func ExportOperations(metaverse, source, metric string) {
 	}
 	helpers.Logging(loggingPrefix, "Additional data fetched !!!")
 
-	helpers.Logging(loggingPrefix, "Get operations from database...")
+	if spec.Output == "" {
+		spec.Output = spec.DefaultOutput(metaverse, source)
+	}
+	manifestPath := spec.ManifestPath()
+	var manifest *ExportManifest
+	if spec.Incremental {
+		manifest, err = PrepareIncrementalExport(metaverse, source, metric, spec)
+		if err != nil {
+			panic(err)
+		}
+		if spec.incremental != nil {
+			helpers.Logging(loggingPrefix, fmt.Sprintf("Incremental export of operations added or changed since %s", spec.incremental.updatedSince.Format(time.RFC3339)))
+		} else {
+			helpers.Logging(loggingPrefix, "No previous export with the same parameters, full export")
+		}
+	}
+	helpers.Logging(loggingPrefix, "Export operations from database to file...")
 	//longFields := []string{
 	//	"transaction_hash", "order_hash", "order_id", "maker", "taker", "buyer", "seller", "payment_token",
 	//	"asset_contract", "asset_id", "buyer_order_hash", "seller_order_hash", "block_hash",
 	//}
-	result, err := GetOperationsForExport(metaverse, source, metric, nil, dbInstance, loggingPrefix)
+	result, err := WriteOperationsForExport(metaverse, source, metric, spec, nil, dbInstance, loggingPrefix)
 	if err != nil {
 		panic(err)
 	}
-	helpers.Logging(loggingPrefix, "Operations retrieved from database")
+	helpers.Logging(loggingPrefix, fmt.Sprintf("%d operations saved in file %s !!!", result.RowsCount, spec.Output))
+
+	dataPackageResult := result
+	if manifest != nil {
+		manifest.AddRun(spec, result)
+		err = manifest.Save(manifestPath)
+		if err != nil {
+			panic(err)
+		}
+		helpers.Logging(loggingPrefix, fmt.Sprintf("Export manifest saved in file %s !!!", manifestPath))
+		if spec.appendOutput {
+			fileResult := *result
+			fileResult.RowsCount = manifest.OutputRows(spec.Output)
+			dataPackageResult = &fileResult
+		}
+	}
 
-	helpers.Logging(loggingPrefix, "Writing operations in file...")
-	filename := fmt.Sprintf("./files/operations_test_plus_%s_%s.csv", metaverse, source)
-	err = utils.WriteInCsv2(filename, result.Operations, result.ColNames, result.ColTypes)
+	helpers.Logging(loggingPrefix, "Writing data package...")
+	dataPackagePath, err := WriteExportDataPackage(metaverse, source, metric, spec, dataPackageResult)
 	if err != nil {
 		panic(err)
 	}
-	helpers.Logging(loggingPrefix, "Operations saved in file !!!")
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Data package saved in file %s !!!", dataPackagePath))
 }
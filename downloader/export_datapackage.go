@@ -0,0 +1,286 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Frictionless data package describing an export, see
+// https://specs.frictionlessdata.io/data-package/
+type exportDataPackage struct {
+	Profile   string                       `json:"profile"`
+	Name      string                       `json:"name"`
+	Created   string                       `json:"created"`
+	Resources []*exportDataPackageResource `json:"resources"`
+	Export    *exportDataPackageInfo       `json:"export"`
+}
+
+type exportDataPackageResource struct {
+	Profile     string                    `json:"profile"`
+	Name        string                    `json:"name"`
+	Path        any                       `json:"path"`
+	Format      string                    `json:"format"`
+	Mediatype   string                    `json:"mediatype"`
+	Encoding    string                    `json:"encoding,omitempty"`
+	Compression string                    `json:"compression,omitempty"`
+	Bytes       int64                     `json:"bytes"`
+	Hash        string                    `json:"hash,omitempty"`
+	Rows        int                       `json:"rows"`
+	Dialect     *exportDataPackageDialect `json:"dialect,omitempty"`
+	Schema      *exportDataPackageSchema  `json:"schema"`
+}
+
+type exportDataPackageDialect struct {
+	Delimiter      string `json:"delimiter"`
+	QuoteChar      string `json:"quoteChar"`
+	LineTerminator string `json:"lineTerminator"`
+	Header         bool   `json:"header"`
+}
+
+type exportDataPackageSchema struct {
+	Fields        []*exportDataPackageField `json:"fields"`
+	MissingValues []string                  `json:"missingValues,omitempty"`
+}
+
+type exportDataPackageField struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Unit        string   `json:"unit,omitempty"`
+	TrueValues  []string `json:"trueValues,omitempty"`
+	FalseValues []string `json:"falseValues,omitempty"`
+}
+
+type exportDataPackageInfo struct {
+	Metaverse          string         `json:"metaverse"`
+	Source             string         `json:"source"`
+	Metric             string         `json:"metric"`
+	FocalPointsVersion string         `json:"focal_points_version,omitempty"`
+	Filters            map[string]any `json:"filters"`
+	PartitionBy        []string       `json:"partition_by,omitempty"`
+}
+
+var exportFormatsMediatypes = map[string]string{
+	"csv":     "text/csv",
+	"parquet": "application/vnd.apache.parquet",
+	"jsonl":   "application/x-ndjson",
+}
+
+var dataPackageNameRegexp = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// sidecarPath returns the path of a file describing the export, written next
+// to it. Only the compression and format extensions are removed from the
+// output name, e.g. sales.2023.csv.gz gives sales.2023.<suffix>.
+func (s *ExportSpec) sidecarPath(suffix string) string {
+	name := strings.TrimSuffix(filepath.Base(s.Output), ".gz")
+	for _, extension := range exportFormatsExtensions {
+		if trimmed := strings.TrimSuffix(name, "."+extension); trimmed != name && trimmed != "" {
+			name = trimmed
+			break
+		}
+	}
+	return filepath.Join(filepath.Dir(s.Output), name+"."+suffix)
+}
+
+// DataPackagePath returns the path of the data package written next to the
+// export, or at the root of a partitioned export.
+func (s *ExportSpec) DataPackagePath() string {
+	if len(s.PartitionBy) > 0 {
+		return filepath.Join(s.Output, "datapackage.json")
+	}
+	return s.sidecarPath("datapackage.json")
+}
+
+func dataPackageFieldType(fieldType string, spec *ExportSpec) string {
+	switch {
+	case fieldType == "bool":
+		return "boolean"
+	case strings.Contains(fieldType, "int"):
+		return "integer"
+	case strings.Contains(fieldType, "float"):
+		return "number"
+	case fieldType == "struct":
+		if spec.Format == "csv" && spec.csvFormat().DateFormat != "rfc3339" {
+			return "integer"
+		}
+		return "datetime"
+	case fieldType == "interface":
+		return "object"
+	}
+	return "string"
+}
+
+func dataPackageFileHash(filePath string) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// describeColumns returns the description and the unit of every column, as
+// given by the first descriptions holding it.
+func describeColumns(headers []string, columnsDescriptions ...map[string][2]string) (descriptions []string, units []string) {
+	descriptions = make([]string, len(headers))
+	units = make([]string, len(headers))
+	for i, header := range headers {
+		for _, columnDescriptions := range columnsDescriptions {
+			if info, ok := columnDescriptions[header]; ok {
+				descriptions[i], units[i] = info[0], info[1]
+				break
+			}
+		}
+	}
+	return descriptions, units
+}
+
+func (s *ExportSpec) filtersInfo() map[string]any {
+	filters := map[string]any{
+		"operation_types": s.OperationTypes,
+	}
+	if s.DateFrom != "" {
+		filters["date_from"] = s.DateFrom
+	}
+	if s.DateTo != "" {
+		filters["date_to"] = s.DateTo
+	}
+	if len(s.AssetTypes) > 0 {
+		filters["asset_types"] = s.AssetTypes
+	}
+	if len(s.Contracts) > 0 {
+		filters["contracts"] = s.Contracts
+	}
+	if len(s.Sources) > 0 {
+		filters["sources"] = s.Sources
+	}
+	if s.MinAmountUsd != nil {
+		filters["min_amount_usd"] = *s.MinAmountUsd
+	}
+	if s.MaxAmountUsd != nil {
+		filters["max_amount_usd"] = *s.MaxAmountUsd
+	}
+	if s.PriceMethod != "" {
+		filters["price_method"] = s.PriceMethod
+	}
+	if len(s.PriceQualities) > 0 {
+		filters["price_qualities"] = s.PriceQualities
+	}
+	if s.MatchTolerance != nil {
+		filters["match_tolerance"] = *s.MatchTolerance
+	}
+	if len(s.Columns) > 0 {
+		filters["columns"] = s.Columns
+	}
+	if len(s.ExcludeColumns) > 0 {
+		filters["exclude_columns"] = s.ExcludeColumns
+	}
+	return filters
+}
+
+// WriteExportDataPackage writes the data package describing an export file:
+// its columns, the metric and focal points used, the filters and row count.
+func WriteExportDataPackage(metaverse, source, metric string, spec *ExportSpec, result *SecondMarketOperationExport) (string, error) {
+	name := filepath.Base(spec.Output)
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	name = dataPackageNameRegexp.ReplaceAllString(strings.ToLower(name), "-")
+	resource := &exportDataPackageResource{
+		Profile:   "tabular-data-resource",
+		Name:      name,
+		Format:    spec.Format,
+		Mediatype: exportFormatsMediatypes[spec.Format],
+		Rows:      result.RowsCount,
+		Schema:    &exportDataPackageSchema{Fields: make([]*exportDataPackageField, 0)},
+	}
+	if len(spec.PartitionBy) > 0 {
+		// Multipart resource: the partition files, relative to the export root
+		paths := make([]string, 0)
+		for _, partition := range result.Partitions {
+			fileInfo, err := os.Stat(filepath.Join(spec.Output, filepath.FromSlash(partition.Path)))
+			if err != nil {
+				return "", err
+			}
+			resource.Bytes += fileInfo.Size()
+			paths = append(paths, partition.Path)
+		}
+		resource.Path = paths
+	} else {
+		hash, size, err := dataPackageFileHash(spec.Output)
+		if err != nil {
+			return "", err
+		}
+		resource.Path = filepath.Base(spec.Output)
+		resource.Bytes = size
+		resource.Hash = hash
+	}
+	if spec.Format != "parquet" {
+		resource.Encoding = "utf-8"
+	}
+	if spec.Format == "csv" {
+		dialect := spec.csvDialect()
+		resource.Dialect = &exportDataPackageDialect{
+			Delimiter:      string(dialect.Delimiter),
+			QuoteChar:      string(dialect.Quote),
+			LineTerminator: "\n",
+			Header:         true,
+		}
+		if dialect.UseCRLF {
+			resource.Dialect.LineTerminator = "\r\n"
+		}
+		resource.Schema.MissingValues = []string{spec.csvFormat().NullValue}
+	}
+	if spec.Compression != "" && spec.Compression != "uncompressed" {
+		resource.Compression = spec.Compression
+	}
+	for i, header := range result.ColNames {
+		field := &exportDataPackageField{Name: header}
+		field.Type = dataPackageFieldType(result.ColTypes[i], spec)
+		if field.Type == "boolean" && spec.Format == "csv" && spec.csvFormat().BoolFormat == "1_0" {
+			field.TrueValues, field.FalseValues = []string{"1"}, []string{"0"}
+		}
+		if len(result.ColDescriptions) > i {
+			field.Description = result.ColDescriptions[i]
+		}
+		if len(result.ColUnits) > i {
+			field.Unit = result.ColUnits[i]
+		}
+		resource.Schema.Fields = append(resource.Schema.Fields, field)
+	}
+	dataPackage := &exportDataPackage{
+		Profile:   "tabular-data-package",
+		Name:      name,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Resources: []*exportDataPackageResource{resource},
+		Export: &exportDataPackageInfo{
+			Metaverse:   metaverse,
+			Source:      source,
+			Metric:      metric,
+			Filters:     spec.filtersInfo(),
+			PartitionBy: spec.PartitionBy,
+		},
+	}
+	if metaverse == "decentraland" {
+		dataPackage.Export.FocalPointsVersion = helpers.GetDclFocalPointsVersion()
+	}
+	jsonData, err := json.MarshalIndent(dataPackage, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	dataPackagePath := spec.DataPackagePath()
+	return dataPackagePath, os.WriteFile(dataPackagePath, jsonData, 0644)
+}
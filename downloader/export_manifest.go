@@ -0,0 +1,211 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"OpenSeaDataDownloader/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ExportManifest records what an export file holds, so that the next
+// incremental export only emits the operations added or changed since.
+// Re-emitted operations (e.g. a LIST sold since the last run) must be read
+// keeping the last row of every operation_id.
+type ExportManifest struct {
+	ParamsHash        string               `json:"params_hash"`
+	Metaverse         string               `json:"metaverse"`
+	Source            string               `json:"source"`
+	Metric            string               `json:"metric"`
+	Output            string               `json:"output"`
+	Columns           []string             `json:"columns"`
+	LastOperationDate *time.Time           `json:"last_operation_date"`
+	LastOperationIds  []string             `json:"last_operation_ids"`
+	LastUpdatedAt     *time.Time           `json:"last_updated_at"`
+	Runs              []*ExportManifestRun `json:"runs"`
+}
+
+type ExportManifestRun struct {
+	Date         time.Time  `json:"date"`
+	Output       string     `json:"output"`
+	Rows         int        `json:"rows"`
+	Incremental  bool       `json:"incremental"`
+	UpdatedSince *time.Time `json:"updated_since,omitempty"`
+}
+
+// exportIncrementalState restricts an export to the operations added or
+// changed since the export recorded by a manifest.
+type exportIncrementalState struct {
+	updatedSince time.Time
+	lastDate     time.Time
+	lastIds      []string
+}
+
+// ManifestPath returns the path of the manifest written next to the export.
+func (s *ExportSpec) ManifestPath() string {
+	return s.sidecarPath("manifest.json")
+}
+
+// paramsHash identifies the parameters changing the exported rows: an
+// incremental export is only possible if they did not change.
+func (s *ExportSpec) paramsHash(metaverse, source, metric string) string {
+	params := map[string]any{
+		"metaverse":    metaverse,
+		"source":       source,
+		"metric":       metric,
+		"filters":      s.filtersInfo(),
+		"format":       s.Format,
+		"compression":  s.Compression,
+		"include_data": s.IncludeData,
+	}
+	if s.Format == "csv" {
+		// Rows appended in another dialect or format would not parse with the previous ones
+		params["csv_dialect"] = s.csvDialect()
+		params["csv_format"] = s.csvFormat()
+	}
+	if metaverse == "decentraland" {
+		params["focal_points_version"] = helpers.GetDclFocalPointsVersion()
+	}
+	jsonParams, _ := json.Marshal(params)
+	return utils.CreateHash(string(jsonParams))
+}
+
+func LoadExportManifest(filePath string) (*ExportManifest, error) {
+	jsonManifest, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	manifest := &ExportManifest{}
+	err = json.Unmarshal(jsonManifest, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (m *ExportManifest) Save(filePath string) error {
+	jsonManifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, jsonManifest, 0644)
+}
+
+// PrepareIncrementalExport loads the manifest of the spec output. If a
+// previous export was done with the same parameters, the spec is restricted
+// to the operations added or changed since, written in the output or in a new
+// part file. Otherwise a new manifest is returned and a full export is done.
+func PrepareIncrementalExport(metaverse, source, metric string, spec *ExportSpec) (*ExportManifest, error) {
+	paramsHash := spec.paramsHash(metaverse, source, metric)
+	manifest, err := LoadExportManifest(spec.ManifestPath())
+	if err != nil {
+		return nil, err
+	}
+	_, statErr := os.Stat(spec.Output)
+	if manifest == nil || manifest.ParamsHash != paramsHash || len(manifest.Runs) == 0 || statErr != nil {
+		return &ExportManifest{
+			ParamsHash: paramsHash,
+			Metaverse:  metaverse,
+			Source:     source,
+			Metric:     metric,
+			Output:     spec.Output,
+			Runs:       make([]*ExportManifestRun, 0),
+		}, nil
+	}
+	spec.incremental = &exportIncrementalState{lastIds: make([]string, 0)}
+	if manifest.LastOperationIds != nil {
+		spec.incremental.lastIds = manifest.LastOperationIds
+	}
+	if manifest.LastUpdatedAt != nil {
+		spec.incremental.updatedSince = *manifest.LastUpdatedAt
+	}
+	if manifest.LastOperationDate != nil {
+		spec.incremental.lastDate = *manifest.LastOperationDate
+	}
+	spec.expectedColumns = manifest.Columns
+	if spec.IncrementalMode == "partition" {
+		spec.Output = spec.partPath(len(manifest.Runs))
+	} else {
+		spec.appendOutput = true
+	}
+	return manifest, nil
+}
+
+// AddRun records an export run, and what was exported up to now.
+func (m *ExportManifest) AddRun(spec *ExportSpec, result *SecondMarketOperationExport) {
+	run := &ExportManifestRun{
+		Date:        time.Now().UTC(),
+		Output:      spec.Output,
+		Rows:        result.RowsCount,
+		Incremental: spec.incremental != nil,
+	}
+	if spec.incremental != nil {
+		run.UpdatedSince = &spec.incremental.updatedSince
+	}
+	m.Runs = append(m.Runs, run)
+	m.Columns = result.ColNames
+	if result.LastOperationDate != nil && (m.LastOperationDate == nil || !result.LastOperationDate.Before(*m.LastOperationDate)) {
+		if m.LastOperationDate != nil && result.LastOperationDate.Equal(*m.LastOperationDate) {
+			for _, operationId := range result.LastOperationIds {
+				if !slices.Contains(m.LastOperationIds, operationId) {
+					m.LastOperationIds = append(m.LastOperationIds, operationId)
+				}
+			}
+		} else {
+			m.LastOperationIds = result.LastOperationIds
+		}
+		m.LastOperationDate = result.LastOperationDate
+	}
+	if result.LastUpdatedAt != nil && (m.LastUpdatedAt == nil || result.LastUpdatedAt.After(*m.LastUpdatedAt)) {
+		m.LastUpdatedAt = result.LastUpdatedAt
+	}
+}
+
+// OutputRows returns the number of rows written in an output file over all runs.
+func (m *ExportManifest) OutputRows(output string) int {
+	rows := 0
+	for _, run := range m.Runs {
+		if run.Output == output {
+			rows += run.Rows
+		}
+	}
+	return rows
+}
+
+func (s *ExportSpec) partPath(index int) string {
+	dir, name := filepath.Split(s.Output)
+	extension := ""
+	if i := strings.Index(name, "."); i > 0 {
+		name, extension = name[:i], name[i:]
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-part-%04d%s", name, index, extension))
+}
+
+// incrementalFilter selects the operations added or changed since the last
+// export: updated since, or else more recent than the last exported ones.
+func (s *exportIncrementalState) incrementalFilter() bson.D {
+	return bson.D{{"$or", bson.A{
+		bson.D{{"updated_at", bson.D{{"$gt", s.updatedSince}}}},
+		bson.D{{"date", bson.D{{"$gt", s.lastDate}}}},
+		bson.D{{"date", s.lastDate}, {"operation_id", bson.D{{"$nin", s.lastIds}}}},
+	}}}
+}
+
+func (s *exportIncrementalState) changedOperation(op *SecondMarketOperation) bool {
+	if op.UpdatedAt.After(s.updatedSince) {
+		return true
+	}
+	if op.Date == nil {
+		return false
+	}
+	return op.Date.After(s.lastDate) || (op.Date.Equal(s.lastDate) && !slices.Contains(s.lastIds, op.OperationId))
+}
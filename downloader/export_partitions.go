@@ -0,0 +1,265 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+var exportPartitionKeys = []string{"year", "month", "day", "asset_type", "type", "source", "district"}
+
+// exportPartitionColumns are the export columns holding the value of a
+// partition key. They are removed from the partition files, their value
+// being given by the directory names.
+var exportPartitionColumns = map[string]string{
+	"asset_type": "asset_type",
+	"type":       "type",
+	"source":     "source",
+}
+
+// ExportPartition is a file of a partitioned export.
+type ExportPartition struct {
+	Path   string            `json:"path"`
+	Values map[string]string `json:"values"`
+	Rows   int               `json:"rows"`
+}
+
+// ExportPartitionsManifest lists the files of a partitioned export.
+type ExportPartitionsManifest struct {
+	Format      string             `json:"format"`
+	PartitionBy []string           `json:"partition_by"`
+	Columns     []string           `json:"columns"`
+	Rows        int                `json:"rows"`
+	Partitions  []*ExportPartition `json:"partitions"`
+}
+
+// normalizePartitionBy validates the partition keys, and orders them so that
+// a directory tree goes from the year down to the day, then the other keys.
+func normalizePartitionBy(partitionBy []string) ([]string, error) {
+	keys := make([]string, 0)
+	for _, key := range partitionBy {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		if !slices.Contains(exportPartitionKeys, key) {
+			return nil, errors.New(fmt.Sprintf("invalid partition key %s", key))
+		}
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	if slices.Contains(keys, "day") && !slices.Contains(keys, "month") {
+		keys = append(keys, "month")
+	}
+	if slices.Contains(keys, "month") && !slices.Contains(keys, "year") {
+		keys = append(keys, "year")
+	}
+	normalized := make([]string, 0)
+	for _, timeKey := range []string{"year", "month", "day"} {
+		if slices.Contains(keys, timeKey) {
+			normalized = append(normalized, timeKey)
+		}
+	}
+	for _, key := range keys {
+		if !slices.Contains(normalized, key) {
+			normalized = append(normalized, key)
+		}
+	}
+	return normalized, nil
+}
+
+func hivePartitionValue(value string) string {
+	if value == "" {
+		return hiveDefaultPartition
+	}
+	return strings.NewReplacer("/", "_", "\\", "_", "=", "_").Replace(value)
+}
+
+// partitionPath returns the Hive style directory of an operation, e.g.
+// year=2022/month=03/asset_type=land.
+func (s *ExportSpec) partitionPath(op *SecondMarketOperation, row map[string]any) string {
+	if len(s.PartitionBy) == 0 {
+		return ""
+	}
+	dirs := make([]string, len(s.PartitionBy))
+	for i, key := range s.PartitionBy {
+		value := ""
+		switch key {
+		case "year":
+			value = fmt.Sprintf("%04d", op.Date.Year())
+		case "month":
+			value = fmt.Sprintf("%02d", int(op.Date.Month()))
+		case "day":
+			value = fmt.Sprintf("%02d", op.Date.Day())
+		case "asset_type":
+			value = op.AssetType
+		case "type":
+			value = op.Type
+		case "source":
+			value = op.Source
+		case "district":
+			value, _ = row["LOC__DISTRICT"].(string)
+		}
+		dirs[i] = fmt.Sprintf("%s=%s", key, hivePartitionValue(value))
+	}
+	return strings.Join(dirs, "/")
+}
+
+func (m *ExportPartitionsManifest) Save(filePath string) error {
+	jsonManifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, jsonManifest, 0644)
+}
+
+// exportPartitionsWriter writes every row in the file of its partition. Rows
+// come sorted by date, so the files of past time partitions are closed as
+// soon as a row of a later one comes.
+type exportPartitionsWriter struct {
+	spec        *ExportSpec
+	headers     []string
+	types       []string
+	groups      []string
+	keepIndexes []int
+	timeKeys    int
+	timePrefix  string
+	writers     map[string]ExportWriter
+	partitions  map[string]*ExportPartition
+	order       []string
+}
+
+func newExportPartitionsWriter(spec *ExportSpec, headers, types, groups []string) *exportPartitionsWriter {
+	partitionsWriter := &exportPartitionsWriter{
+		spec:        spec,
+		headers:     make([]string, 0),
+		types:       make([]string, 0),
+		groups:      make([]string, 0),
+		keepIndexes: make([]int, 0),
+		writers:     make(map[string]ExportWriter),
+		partitions:  make(map[string]*ExportPartition),
+		order:       make([]string, 0),
+	}
+	for i, header := range headers {
+		isPartitionColumn := false
+		for key, column := range exportPartitionColumns {
+			if column == header && slices.Contains(spec.PartitionBy, key) {
+				isPartitionColumn = true
+			}
+		}
+		if !isPartitionColumn {
+			partitionsWriter.headers = append(partitionsWriter.headers, header)
+			partitionsWriter.types = append(partitionsWriter.types, types[i])
+			partitionsWriter.groups = append(partitionsWriter.groups, groups[i])
+			partitionsWriter.keepIndexes = append(partitionsWriter.keepIndexes, i)
+		}
+	}
+	for _, key := range spec.PartitionBy {
+		if key == "year" || key == "month" || key == "day" {
+			partitionsWriter.timeKeys++
+		}
+	}
+	return partitionsWriter
+}
+
+func (w *exportPartitionsWriter) WriteRow(partition string, values []any) error {
+	if w.timeKeys > 0 {
+		timePrefix := strings.Join(strings.SplitN(partition, "/", w.timeKeys+1)[:w.timeKeys], "/")
+		if timePrefix != w.timePrefix {
+			if err := w.closeWriters(); err != nil {
+				return err
+			}
+			w.timePrefix = timePrefix
+		}
+	}
+	writer, ok := w.writers[partition]
+	if !ok {
+		if _, exists := w.partitions[partition]; exists {
+			return errors.New(fmt.Sprintf("partition %s already written", partition))
+		}
+		extension := exportFormatsExtensions[w.spec.Format]
+		if w.spec.Format == "jsonl" && w.spec.Compression == "gzip" {
+			extension += ".gz"
+		}
+		partitionSpec := *w.spec
+		partitionSpec.Output = filepath.Join(w.spec.Output, filepath.FromSlash(partition), "part-0."+extension)
+		var err error
+		writer, err = newExportWriter(&partitionSpec, w.headers, w.types, w.groups)
+		if err != nil {
+			return err
+		}
+		w.writers[partition] = writer
+		partitionValues := make(map[string]string)
+		for _, dir := range strings.Split(partition, "/") {
+			key, value, _ := strings.Cut(dir, "=")
+			partitionValues[key] = value
+		}
+		w.partitions[partition] = &ExportPartition{
+			Path:   filepath.ToSlash(filepath.Join(partition, "part-0."+extension)),
+			Values: partitionValues,
+		}
+		w.order = append(w.order, partition)
+	}
+	row := make([]any, len(w.keepIndexes))
+	for i, index := range w.keepIndexes {
+		row[i] = values[index]
+	}
+	w.partitions[partition].Rows++
+	return writer.WriteRow(row)
+}
+
+func (w *exportPartitionsWriter) closeWriters() error {
+	var err error
+	for partition, writer := range w.writers {
+		if e0 := writer.Close(); err == nil {
+			err = e0
+		}
+		delete(w.writers, partition)
+	}
+	return err
+}
+
+// Close closes the partition files and writes the manifest listing them.
+func (w *exportPartitionsWriter) Close() error {
+	err := w.closeWriters()
+	if err != nil {
+		return err
+	}
+	manifest := &ExportPartitionsManifest{
+		Format:      w.spec.Format,
+		PartitionBy: w.spec.PartitionBy,
+		Columns:     w.headers,
+		Partitions:  make([]*ExportPartition, 0),
+	}
+	for _, partition := range w.order {
+		manifest.Partitions = append(manifest.Partitions, w.partitions[partition])
+		manifest.Rows += w.partitions[partition].Rows
+	}
+	err = os.MkdirAll(w.spec.Output, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return manifest.Save(w.spec.PartitionsManifestPath())
+}
+
+// Partitions returns the written partitions, in the order they were created.
+func (w *exportPartitionsWriter) Partitions() []*ExportPartition {
+	partitions := make([]*ExportPartition, 0)
+	for _, partition := range w.order {
+		partitions = append(partitions, w.partitions[partition])
+	}
+	return partitions
+}
+
+// PartitionsManifestPath returns the path of the manifest of a partitioned
+// export, at the root of its directory tree.
+func (s *ExportSpec) PartitionsManifestPath() string {
+	return filepath.Join(s.Output, "_manifest.json")
+}
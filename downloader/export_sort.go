@@ -0,0 +1,220 @@
+package downloader
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"time"
+)
+
+const defaultSortBufferRows = 50000
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(map[string]any{})
+	gob.Register([]any{})
+}
+
+type exportRow struct {
+	Date      int64
+	Seq       int64
+	Partition string
+	Values    []any
+}
+
+// exportSorter sorts export rows by date with an external merge sort: rows
+// are buffered, written to disk as sorted runs, and runs are merged at the end.
+type exportSorter struct {
+	dir        string
+	bufferRows int
+	buffer     []*exportRow
+	runs       []string
+	seq        int64
+}
+
+func newExportSorter(bufferRows int) (*exportSorter, error) {
+	if bufferRows <= 0 {
+		bufferRows = defaultSortBufferRows
+	}
+	dir, err := os.MkdirTemp("", "export-sort-*")
+	if err != nil {
+		return nil, err
+	}
+	return &exportSorter{dir: dir, bufferRows: bufferRows, buffer: make([]*exportRow, 0, bufferRows)}, nil
+}
+
+// normalizeExportValue dereferences pointers, so that values can be encoded in runs.
+func normalizeExportValue(value any) any {
+	if value == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		return rv.Elem().Interface()
+	}
+	return value
+}
+
+// Add buffers a row, with the partition it is written in if the export is partitioned.
+func (s *exportSorter) Add(date *time.Time, partition string, values []any) error {
+	row := &exportRow{Seq: s.seq, Partition: partition, Values: make([]any, len(values))}
+	if date != nil {
+		row.Date = date.UnixMilli()
+	}
+	for i, value := range values {
+		row.Values[i] = normalizeExportValue(value)
+	}
+	s.seq++
+	s.buffer = append(s.buffer, row)
+	if len(s.buffer) >= s.bufferRows {
+		return s.flushRun()
+	}
+	return nil
+}
+
+func compareExportRows(a, b *exportRow) int {
+	if a.Date != b.Date {
+		if a.Date < b.Date {
+			return -1
+		}
+		return 1
+	}
+	if a.Seq < b.Seq {
+		return -1
+	} else if a.Seq > b.Seq {
+		return 1
+	}
+	return 0
+}
+
+func (s *exportSorter) flushRun() error {
+	if len(s.buffer) == 0 {
+		return nil
+	}
+	slices.SortFunc(s.buffer, compareExportRows)
+	runPath := filepath.Join(s.dir, fmt.Sprintf("run-%05d.gob", len(s.runs)))
+	file, err := os.Create(runPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	bufWriter := bufio.NewWriter(file)
+	encoder := gob.NewEncoder(bufWriter)
+	for _, row := range s.buffer {
+		if err = encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	if err = bufWriter.Flush(); err != nil {
+		return err
+	}
+	s.runs = append(s.runs, runPath)
+	s.buffer = s.buffer[:0]
+	return nil
+}
+
+type exportRunReader struct {
+	file    *os.File
+	decoder *gob.Decoder
+	current *exportRow
+}
+
+func (r *exportRunReader) next() error {
+	row := &exportRow{}
+	err := r.decoder.Decode(row)
+	if err != nil {
+		r.current = nil
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	r.current = row
+	return nil
+}
+
+type exportRunsHeap []*exportRunReader
+
+func (h exportRunsHeap) Len() int           { return len(h) }
+func (h exportRunsHeap) Less(i, j int) bool { return compareExportRows(h[i].current, h[j].current) < 0 }
+func (h exportRunsHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *exportRunsHeap) Push(x any)        { *h = append(*h, x.(*exportRunReader)) }
+func (h *exportRunsHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// Drain merges the sorted runs and hands every row, by date asc, to write.
+func (s *exportSorter) Drain(write func(partition string, values []any) error) error {
+	if len(s.runs) == 0 {
+		// Everything fits in memory: no need to go through the disk
+		slices.SortFunc(s.buffer, compareExportRows)
+		for _, row := range s.buffer {
+			if err := write(row.Partition, row.Values); err != nil {
+				return err
+			}
+		}
+		s.buffer = s.buffer[:0]
+		return nil
+	}
+	if err := s.flushRun(); err != nil {
+		return err
+	}
+
+	runsHeap := make(exportRunsHeap, 0, len(s.runs))
+	defer func() {
+		for _, reader := range runsHeap {
+			_ = reader.file.Close()
+		}
+	}()
+	for _, runPath := range s.runs {
+		file, err := os.Open(runPath)
+		if err != nil {
+			return err
+		}
+		reader := &exportRunReader{file: file, decoder: gob.NewDecoder(bufio.NewReader(file))}
+		if err = reader.next(); err != nil {
+			_ = file.Close()
+			return err
+		}
+		if reader.current == nil {
+			_ = file.Close()
+			continue
+		}
+		runsHeap = append(runsHeap, reader)
+	}
+	heap.Init(&runsHeap)
+	for runsHeap.Len() > 0 {
+		reader := runsHeap[0]
+		if err := write(reader.current.Partition, reader.current.Values); err != nil {
+			return err
+		}
+		if err := reader.next(); err != nil {
+			return err
+		}
+		if reader.current == nil {
+			_ = reader.file.Close()
+			heap.Pop(&runsHeap)
+		} else {
+			heap.Fix(&runsHeap, 0)
+		}
+	}
+	return nil
+}
+
+func (s *exportSorter) Close() error {
+	return os.RemoveAll(s.dir)
+}
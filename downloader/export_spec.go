@@ -0,0 +1,424 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"OpenSeaDataDownloader/utils"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var exportOperationTypes = []string{"LIST", "SELL", "BID", "TRANSFER"}
+
+var exportFormatsExtensions = map[string]string{
+	"csv":     "csv",
+	"parquet": "parquet",
+	"jsonl":   "jsonl",
+}
+
+// ExportSpec describes which operations and columns are exported, and where
+// and how they are written. It is read from a JSON file keyed by the tags
+// below, e.g. {"output": "./files/sales.parquet", "operation_types": ["SELL"],
+// "format": "parquet", "columns": ["date", "asset_id", "DIS__*"]}.
+type ExportSpec struct {
+	Output string `mapstructure:"output"`
+	// Operations filters
+	DateFrom       string   `mapstructure:"date_from"`
+	DateTo         string   `mapstructure:"date_to"`
+	OperationTypes []string `mapstructure:"operation_types"`
+	AssetTypes     []string `mapstructure:"asset_types"`
+	Contracts      []string `mapstructure:"contracts"`
+	Sources        []string `mapstructure:"sources"`
+	MinAmountUsd   *float64 `mapstructure:"min_amount_usd"`
+	MaxAmountUsd   *float64 `mapstructure:"max_amount_usd"`
+	// Columns kept in the given order, a trailing * matching a prefix
+	Columns        []string `mapstructure:"columns"`
+	ExcludeColumns []string `mapstructure:"exclude_columns"`
+	// Rows held in memory while sorting the export by date
+	SortBufferRows int `mapstructure:"sort_buffer_rows"`
+	// csv (default), parquet or jsonl; only jsonl is gzipped, csv is never compressed
+	Format       string `mapstructure:"format"`
+	Compression  string `mapstructure:"compression"`
+	RowGroupRows int    `mapstructure:"row_group_rows"`
+	// Raw operation payload, jsonl only
+	IncludeData bool `mapstructure:"include_data"`
+	// Only the operations added or changed since the last export, appended or in a new part file
+	Incremental     bool   `mapstructure:"incremental"`
+	IncrementalMode string `mapstructure:"incremental_mode"`
+	// Hive style directories, by year, month, day, asset_type, type, source or district
+	PartitionBy []string `mapstructure:"partition_by"`
+	// Csv dialect, quote policy strings (default), minimal or all
+	CsvDelimiter   string `mapstructure:"csv_delimiter"`
+	CsvQuote       string `mapstructure:"csv_quote"`
+	CsvQuotePolicy string `mapstructure:"csv_quote_policy"`
+	CsvLineEnding  string `mapstructure:"csv_line_ending"`
+	CsvBom         bool   `mapstructure:"csv_bom"`
+	// Csv values: date_format rfc3339, epoch or epoch_ms, bool_format true_false or 1_0
+	DateFormat     string `mapstructure:"date_format"`
+	FloatPrecision *int   `mapstructure:"float_precision"`
+	NullValue      string `mapstructure:"null_value"`
+	BoolFormat     string `mapstructure:"bool_format"`
+	// How USD prices are taken from the candles, and the price qualities kept
+	PriceMethod    string   `mapstructure:"price_method"`
+	PriceQualities []string `mapstructure:"price_qualities"`
+	// Currencies of the payment_amount_in_<currency> columns, each needing prices
+	Numeraires []string `mapstructure:"numeraires"`
+	// Relative amount difference allowed when matching a sale without order hash
+	MatchTolerance  *float64 `mapstructure:"match_tolerance"`
+	dateFrom        *time.Time
+	dateTo          *time.Time
+	incremental     *exportIncrementalState
+	expectedColumns []string
+	appendOutput    bool
+}
+
+func (s *ExportSpec) outputExtension() string {
+	extension, ok := exportFormatsExtensions[s.Format]
+	if !ok {
+		extension = "csv"
+	}
+	if s.Format == "jsonl" && s.Compression == "gzip" {
+		extension += ".gz"
+	}
+	return extension
+}
+
+// DefaultOutput returns the output file used when none is given.
+func (s *ExportSpec) DefaultOutput(metaverse, source string) string {
+	if len(s.PartitionBy) > 0 {
+		return fmt.Sprintf("./files/operations_test_plus_%s_%s", metaverse, source)
+	}
+	return fmt.Sprintf("./files/operations_test_plus_%s_%s.%s", metaverse, source, s.outputExtension())
+}
+
+// DefaultListingsOutput returns the output file of the listings export used
+// when none is given.
+func (s *ExportSpec) DefaultListingsOutput(metaverse, source string) string {
+	return fmt.Sprintf("./files/listings_%s_%s.%s", metaverse, source, s.outputExtension())
+}
+
+// DefaultOrderBookPrefix returns the output prefix of an order book snapshot
+// used when none is given.
+func (s *ExportSpec) DefaultOrderBookPrefix(metaverse, source string, at time.Time) string {
+	return fmt.Sprintf("./files/orderbook_%s_%s_%s", metaverse, source, at.Format("20060102"))
+}
+
+// OrderBookOutputs returns the orders and the collections files of an order
+// book snapshot written under the prefix.
+func (s *ExportSpec) OrderBookOutputs(prefix string) (string, string) {
+	return fmt.Sprintf("%s_orders.%s", prefix, s.outputExtension()), fmt.Sprintf("%s_collections.%s", prefix, s.outputExtension())
+}
+
+// DefaultOrderBookSeriesOutput returns the output file of the order book
+// series used when none is given.
+func (s *ExportSpec) DefaultOrderBookSeriesOutput(metaverse, source string) string {
+	return fmt.Sprintf("./files/orderbook_series_%s_%s.%s", metaverse, source, s.outputExtension())
+}
+
+// withOutput returns a copy of the spec writing to another output.
+func (s *ExportSpec) withOutput(output string) *ExportSpec {
+	spec := *s
+	spec.Output = output
+	return &spec
+}
+
+func NewExportSpec() *ExportSpec {
+	return &ExportSpec{OperationTypes: []string{"LIST", "SELL"}, Format: "csv", IncrementalMode: "append"}
+}
+
+func LoadExportSpec(filePath string) (*ExportSpec, error) {
+	spec := &ExportSpec{}
+	err := utils.ReadJsonFileStrict(filePath, spec)
+	if err != nil {
+		return nil, err
+	}
+	return spec, spec.Validate()
+}
+
+// Validate checks the spec values and parses its dates.
+func (s *ExportSpec) Validate() error {
+	if len(s.OperationTypes) == 0 {
+		s.OperationTypes = []string{"LIST", "SELL"}
+	}
+	for i, opType := range s.OperationTypes {
+		s.OperationTypes[i] = strings.ToUpper(opType)
+		if !slices.Contains(exportOperationTypes, s.OperationTypes[i]) {
+			return errors.New(fmt.Sprintf("invalid operation type %s", opType))
+		}
+	}
+	s.Format = strings.ToLower(s.Format)
+	if s.Format == "" {
+		s.Format = "csv"
+	}
+	if _, ok := exportFormatsExtensions[s.Format]; !ok {
+		return errors.New(fmt.Sprintf("invalid export format %s", s.Format))
+	}
+	s.Compression = strings.ToLower(s.Compression)
+	if s.Format == "csv" {
+		if s.Compression != "" {
+			return errors.New(fmt.Sprintf("compression %s is not available with the csv format", s.Compression))
+		}
+	} else if s.Format == "jsonl" {
+		if s.Compression != "" && s.Compression != "gzip" && s.Compression != "uncompressed" {
+			return errors.New(fmt.Sprintf("invalid jsonl compression %s", s.Compression))
+		}
+	} else if _, ok := utils.ParquetCompressions[s.Compression]; s.Compression != "" && !ok {
+		return errors.New(fmt.Sprintf("invalid parquet compression %s", s.Compression))
+	}
+	s.IncrementalMode = strings.ToLower(s.IncrementalMode)
+	if s.IncrementalMode == "" || s.Format == "parquet" {
+		s.IncrementalMode = "append"
+		if s.Format == "parquet" {
+			s.IncrementalMode = "partition"
+		}
+	}
+	if s.IncrementalMode != "append" && s.IncrementalMode != "partition" {
+		return errors.New(fmt.Sprintf("invalid incremental mode %s", s.IncrementalMode))
+	}
+	err := s.validateCsv()
+	if err != nil {
+		return err
+	}
+	partitionBy, err := normalizePartitionBy(s.PartitionBy)
+	if err != nil {
+		return err
+	}
+	s.PartitionBy = partitionBy
+	if len(s.PartitionBy) > 0 && s.Incremental {
+		return errors.New("partitioned exports cannot be incremental")
+	}
+	if s.IncludeData && s.Format != "jsonl" {
+		return errors.New("include_data is only available with the jsonl format")
+	}
+	for i, contract := range s.Contracts {
+		s.Contracts[i] = strings.ToLower(contract)
+	}
+	s.dateFrom, s.dateTo = nil, nil
+	if s.DateFrom != "" {
+		dateFrom, err := utils.ParseDate(s.DateFrom)
+		if err != nil {
+			return err
+		}
+		s.dateFrom = &dateFrom
+	}
+	if s.DateTo != "" {
+		dateTo, err := utils.ParseDate(s.DateTo)
+		if err != nil {
+			return err
+		}
+		s.dateTo = &dateTo
+	}
+	s.PriceMethod = strings.ToLower(s.PriceMethod)
+	if s.PriceMethod != "" && !slices.Contains(helpers.CurrencyPriceMethods, s.PriceMethod) {
+		return errors.New(fmt.Sprintf("invalid price method %s", s.PriceMethod))
+	}
+	for i, quality := range s.PriceQualities {
+		s.PriceQualities[i] = strings.ToLower(quality)
+		if !slices.Contains(helpers.CurrencyPriceQualities, s.PriceQualities[i]) {
+			return errors.New(fmt.Sprintf("invalid price quality %s", quality))
+		}
+	}
+	numeraires := make([]string, 0)
+	for _, numeraire := range s.Numeraires {
+		numeraire = strings.ToUpper(strings.TrimSpace(numeraire))
+		if numeraire != "" && !slices.Contains(numeraires, numeraire) {
+			numeraires = append(numeraires, numeraire)
+		}
+	}
+	s.Numeraires = numeraires
+	if s.MatchTolerance != nil && *s.MatchTolerance < 0 {
+		return errors.New("match_tolerance is negative")
+	}
+	if s.MinAmountUsd != nil && s.MaxAmountUsd != nil && *s.MinAmountUsd > *s.MaxAmountUsd {
+		return errors.New("min_amount_usd is greater than max_amount_usd")
+	}
+	return nil
+}
+
+// operationsFilter returns the database filter selecting the exported operations.
+func (s *ExportSpec) operationsFilter(metaverse, source string) bson.D {
+	filter := bson.D{
+		{"metaverse", metaverse},
+		{"downloaded_from", source},
+		{"type", bson.D{{"$in", s.OperationTypes}}},
+	}
+	if s.dateFrom != nil || s.dateTo != nil {
+		dateFilter := bson.D{}
+		if s.dateFrom != nil {
+			dateFilter = append(dateFilter, bson.E{"$gte", *s.dateFrom})
+		}
+		if s.dateTo != nil {
+			dateFilter = append(dateFilter, bson.E{"$lt", *s.dateTo})
+		}
+		filter = append(filter, bson.E{"date", dateFilter})
+	}
+	if len(s.AssetTypes) > 0 {
+		filter = append(filter, bson.E{"asset_type", bson.D{{"$in", s.AssetTypes}}})
+	}
+	if len(s.Contracts) > 0 {
+		filter = append(filter, bson.E{"asset_contract", bson.D{{"$in", s.Contracts}}})
+	}
+	if len(s.Sources) > 0 {
+		filter = append(filter, bson.E{"source", bson.D{{"$in", s.Sources}}})
+	}
+	if s.incremental != nil {
+		filter = append(filter, s.incremental.incrementalFilter()...)
+	}
+	return filter
+}
+
+// MatchOperation applies to an operation the same filters as the database
+// filter, except the USD amount range.
+func (s *ExportSpec) MatchOperation(op *SecondMarketOperation) bool {
+	if !slices.Contains(s.OperationTypes, op.Type) {
+		return false
+	}
+	if op.Date == nil || (s.dateFrom != nil && op.Date.Before(*s.dateFrom)) || (s.dateTo != nil && !op.Date.Before(*s.dateTo)) {
+		return false
+	}
+	if len(s.AssetTypes) > 0 && !slices.Contains(s.AssetTypes, op.AssetType) {
+		return false
+	}
+	if len(s.Contracts) > 0 && !slices.Contains(s.Contracts, strings.ToLower(op.AssetContract)) {
+		return false
+	}
+	if len(s.Sources) > 0 && !slices.Contains(s.Sources, op.Source) {
+		return false
+	}
+	return true
+}
+
+// MatchAmountUsd tells whether the USD amount of an operation is in the spec
+// range, and priced with one of the spec price qualities.
+func (s *ExportSpec) MatchAmountUsd(op *SecondMarketOperation) bool {
+	if len(s.PriceQualities) > 0 && !slices.Contains(s.PriceQualities, op.PaymentPriceQuality) {
+		return false
+	}
+	if s.MinAmountUsd != nil && op.PaymentAmountUsd < *s.MinAmountUsd {
+		return false
+	}
+	if s.MaxAmountUsd != nil && op.PaymentAmountUsd > *s.MaxAmountUsd {
+		return false
+	}
+	return true
+}
+
+func matchColumnPattern(pattern, column string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(column, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == column
+}
+
+// SelectColumns orders and filters the export columns headers & types.
+func (s *ExportSpec) SelectColumns(headers, types []string, loggingPrefix string) (h []string, t []string) {
+	h = make([]string, 0)
+	t = make([]string, 0)
+	if len(s.Columns) == 0 {
+		h = append(h, headers...)
+		t = append(t, types...)
+	} else {
+		for _, pattern := range s.Columns {
+			found := false
+			for i, header := range headers {
+				if matchColumnPattern(pattern, header) && !slices.Contains(h, header) {
+					h = append(h, header)
+					t = append(t, types[i])
+					found = true
+				}
+			}
+			if !found {
+				helpers.Logging(loggingPrefix, fmt.Sprintf("Column `%s` not found in export columns", pattern))
+			}
+		}
+	}
+	if len(s.ExcludeColumns) > 0 {
+		fh := make([]string, 0)
+		ft := make([]string, 0)
+		for i, header := range h {
+			excluded := slices.ContainsFunc(s.ExcludeColumns, func(pattern string) bool {
+				return matchColumnPattern(pattern, header)
+			})
+			if !excluded {
+				fh = append(fh, header)
+				ft = append(ft, t[i])
+			}
+		}
+		h, t = fh, ft
+	}
+	return h, t
+}
+
+func (s *ExportSpec) validateCsv() error {
+	if utf8.RuneCountInString(s.CsvDelimiter) > 1 || utf8.RuneCountInString(s.CsvQuote) > 1 {
+		return errors.New("csv_delimiter and csv_quote must be a single character")
+	}
+	if s.CsvDelimiter != "" && s.CsvDelimiter == s.CsvQuote {
+		return errors.New("csv_delimiter and csv_quote must differ")
+	}
+	s.CsvQuotePolicy = strings.ToLower(s.CsvQuotePolicy)
+	if s.CsvQuotePolicy != "" && !slices.Contains(utils.CsvQuotePolicies, s.CsvQuotePolicy) {
+		return errors.New(fmt.Sprintf("invalid csv quote policy %s", s.CsvQuotePolicy))
+	}
+	s.CsvLineEnding = strings.ToLower(s.CsvLineEnding)
+	if s.CsvLineEnding != "" && s.CsvLineEnding != "lf" && s.CsvLineEnding != "crlf" {
+		return errors.New(fmt.Sprintf("invalid csv line ending %s", s.CsvLineEnding))
+	}
+	s.DateFormat = strings.ToLower(s.DateFormat)
+	if s.DateFormat != "" && !slices.Contains(utils.CsvDateFormats, s.DateFormat) {
+		return errors.New(fmt.Sprintf("invalid date format %s", s.DateFormat))
+	}
+	s.BoolFormat = strings.ToLower(s.BoolFormat)
+	if s.BoolFormat != "" && !slices.Contains(utils.CsvBoolFormats, s.BoolFormat) {
+		return errors.New(fmt.Sprintf("invalid bool format %s", s.BoolFormat))
+	}
+	return nil
+}
+
+// csvDialect returns the dialect of csv exports, the spec values overriding the default ones.
+func (s *ExportSpec) csvDialect() utils.CsvDialect {
+	dialect := utils.DefaultCsvDialect()
+	if s.CsvDelimiter != "" {
+		dialect.Delimiter, _ = utf8.DecodeRuneInString(s.CsvDelimiter)
+	}
+	if s.CsvQuote != "" {
+		dialect.Quote, _ = utf8.DecodeRuneInString(s.CsvQuote)
+	}
+	if s.CsvQuotePolicy != "" {
+		dialect.QuotePolicy = s.CsvQuotePolicy
+	}
+	dialect.UseCRLF = s.CsvLineEnding == "crlf"
+	dialect.Bom = s.CsvBom
+	return dialect
+}
+
+// csvFormat returns how values of csv exports are rendered, the spec values
+// overriding the default ones.
+func (s *ExportSpec) csvFormat() utils.CsvFormat {
+	format := utils.DefaultCsvFormat()
+	if s.DateFormat != "" {
+		format.DateFormat = s.DateFormat
+	}
+	if s.FloatPrecision != nil {
+		format.FloatPrecision = *s.FloatPrecision
+	}
+	format.NullValue = s.NullValue
+	if s.BoolFormat != "" {
+		format.BoolFormat = s.BoolFormat
+	}
+	return format
+}
+
+// matchTolerance returns the relative amount difference allowed when matching
+// sales to orders.
+func (s *ExportSpec) matchTolerance() float64 {
+	if s.MatchTolerance != nil {
+		return *s.MatchTolerance
+	}
+	return DefaultMatchTolerance
+}
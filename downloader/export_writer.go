@@ -0,0 +1,34 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/utils"
+	"os"
+	"path/filepath"
+)
+
+// ExportWriter receives the exported rows, sorted by date, with their values
+// in the order of the export columns. groups gives the provider of every
+// column, used by nested formats only.
+type ExportWriter interface {
+	WriteRow(values []any) error
+	Close() error
+}
+
+func newExportWriter(spec *ExportSpec, headers, types, groups []string) (ExportWriter, error) {
+	err := os.MkdirAll(filepath.Dir(spec.Output), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Format == "parquet" {
+		return utils.NewParquetFileWriter(spec.Output, headers, types, spec.Compression, spec.RowGroupRows)
+	} else if spec.Format == "jsonl" {
+		if spec.appendOutput {
+			return utils.AppendJsonLinesFileWriter(spec.Output, headers, groups, spec.Compression == "gzip")
+		}
+		return utils.NewJsonLinesFileWriter(spec.Output, headers, groups, spec.Compression == "gzip")
+	}
+	if spec.appendOutput {
+		return utils.AppendCsvFileWriter(spec.Output, headers, types, spec.csvDialect(), spec.csvFormat())
+	}
+	return utils.NewCsvFileWriter(spec.Output, headers, types, spec.csvDialect(), spec.csvFormat())
+}
@@ -0,0 +1,443 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FeatureProvider adds a set of columns to every exported operation. The
+// values returned by Compute are keyed by the column names given by Columns.
+type FeatureProvider interface {
+	Name() string
+	Columns() (h []string, t []string)
+	Compute(op *SecondMarketOperation) map[string]any
+}
+
+// AssetFeatureProvider is a FeatureProvider which needs all the operations of
+// an asset, sorted by date, before computing the values of any of them.
+type AssetFeatureProvider interface {
+	FeatureProvider
+	PrepareAsset(operations []*SecondMarketOperation)
+}
+
+// DescribedFeatureProvider is a FeatureProvider which documents its columns
+// with a description and a unit, both possibly empty.
+type DescribedFeatureProvider interface {
+	FeatureProvider
+	Describe(column string) (description string, unit string)
+}
+
+type ExportPipeline struct {
+	Providers []FeatureProvider
+	headers   [][]string
+	types     [][]string
+}
+
+func NewExportPipeline(providers ...FeatureProvider) *ExportPipeline {
+	pipeline := &ExportPipeline{
+		Providers: providers,
+		headers:   make([][]string, len(providers)),
+		types:     make([][]string, len(providers)),
+	}
+	for i, provider := range providers {
+		pipeline.headers[i], pipeline.types[i] = provider.Columns()
+	}
+	return pipeline
+}
+
+func (p *ExportPipeline) Columns() (h []string, t []string) {
+	h = make([]string, 0)
+	t = make([]string, 0)
+	for i := range p.Providers {
+		h = append(h, p.headers[i]...)
+		t = append(t, p.types[i]...)
+	}
+	return h, t
+}
+
+// ColumnGroups returns the name of the provider of every given column, or an
+// empty string for the operation fields, so that nested formats can group
+// the related columns.
+func (p *ExportPipeline) ColumnGroups(headers []string) []string {
+	groups := make([]string, len(headers))
+	for i, header := range headers {
+		for j, provider := range p.Providers {
+			if slices.Contains(p.headers[j], header) {
+				if _, ok := provider.(*operationFeatureProvider); !ok {
+					groups[i] = provider.Name()
+				}
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// Describe returns the description and the unit of every given column.
+func (p *ExportPipeline) Describe(headers []string) (descriptions []string, units []string) {
+	descriptions = make([]string, len(headers))
+	units = make([]string, len(headers))
+	for i, header := range headers {
+		for j, provider := range p.Providers {
+			if slices.Contains(p.headers[j], header) {
+				if describedProvider, ok := provider.(DescribedFeatureProvider); ok {
+					descriptions[i], units[i] = describedProvider.Describe(header)
+				}
+				break
+			}
+		}
+	}
+	return descriptions, units
+}
+
+func (p *ExportPipeline) PrepareAsset(operations []*SecondMarketOperation) {
+	for _, provider := range p.Providers {
+		if assetProvider, ok := provider.(AssetFeatureProvider); ok {
+			assetProvider.PrepareAsset(operations)
+		}
+	}
+}
+
+// Row computes the exported values of an operation. Only declared columns
+// are kept, and a declared column without value is set to nil.
+func (p *ExportPipeline) Row(op *SecondMarketOperation) map[string]any {
+	row := make(map[string]any)
+	for i, provider := range p.Providers {
+		values := provider.Compute(op)
+		for _, header := range p.headers[i] {
+			row[header] = values[header]
+		}
+	}
+	return row
+}
+
+func exportFeatureProviders(metaverse, metric string, excludeOpMapHeaders []string, numeraires []string, matchTolerance float64) []FeatureProvider {
+	providers := []FeatureProvider{
+		&operationFeatureProvider{exclude: excludeOpMapHeaders},
+		newRelatedTransactionFeatureProvider(matchTolerance),
+	}
+	if metaverse == "decentraland" {
+		providers = append(providers, &dclDistancesFeatureProvider{metric: metric}, &dclParcelFeatureProvider{})
+	}
+	mtvCurrencies := make([]string, 0)
+	if metaverse == "decentraland" {
+		mtvCurrencies = []string{"MANA", "ETH"}
+	}
+	if len(mtvCurrencies) > 0 {
+		providers = append(providers, &currenciesFeatureProvider{currencies: mtvCurrencies})
+	}
+	if len(numeraires) > 0 {
+		providers = append(providers, &numerairesFeatureProvider{numeraires: numeraires})
+	}
+	return providers
+}
+
+/*
+	Operation fields
+*/
+
+type operationFeatureProvider struct {
+	exclude []string
+}
+
+var operationColumnsDescriptions = map[string][2]string{
+	"operation_id":               {"Identifier of the operation at its source", ""},
+	"downloaded_from":            {"API the operation was downloaded from", ""},
+	"type":                       {"Operation type (LIST, SELL, BID, TRANSFER)", ""},
+	"source":                     {"Marketplace of the operation", ""},
+	"last_updated_at":            {"Last update of the operation at its source", ""},
+	"date":                       {"Date of the operation", ""},
+	"metaverse":                  {"Metaverse of the asset", ""},
+	"blockchain":                 {"Blockchain of the asset", ""},
+	"order_id":                   {"Identifier of the order", ""},
+	"order_hash":                 {"Hash of the order", ""},
+	"transaction_hash":           {"Hash of the transaction", ""},
+	"transaction_type":           {"Type of the transaction", ""},
+	"maker":                      {"Address of the order maker", ""},
+	"taker":                      {"Address of the order taker", ""},
+	"buyer":                      {"Address of the buyer", ""},
+	"seller":                     {"Address of the seller", ""},
+	"asset_contract":             {"Contract of the asset", ""},
+	"asset_type":                 {"Type of the asset (land, estate...)", ""},
+	"asset_id":                   {"Token id of the asset", ""},
+	"asset_location":             {"Location of the asset, as x,y", ""},
+	"asset_loc_x":                {"X coordinate of the asset", "parcel"},
+	"asset_loc_y":                {"Y coordinate of the asset", "parcel"},
+	"asset_value":                {"Number of parcels of the asset", "parcel"},
+	"payment_blockchain":         {"Blockchain of the payment", ""},
+	"payment_type":               {"Type of the payment", ""},
+	"payment_token":              {"Contract of the payment token", ""},
+	"payment_currency":           {"Currency of the payment", ""},
+	"payment_canonical_currency": {"Canonical symbol of the payment currency, e.g. ETH for WETH", ""},
+	"payment_amount":             {"Amount of the payment", "payment_currency"},
+	"payment_quantity":           {"Amount of the payment in token base units, as given by the marketplace", ""},
+	"payment_token_unknown":      {"Whether the payment token is missing from the token registry or its decimals are unknown", ""},
+	"payment_amount_usd":         {"Amount of the payment in USD", "USD"},
+	"payment_amounts":            {"Amount of the payment in every stored numeraire", ""},
+	"payment_ccy_price":          {"Price of the payment currency in USD", "USD"},
+	"payment_price_quality":      {"Whether the currency price is exact, interpolated between candles or extrapolated out of the candles range", ""},
+	"payment_price_method":       {"How the currency price was taken from the candles, or source if given by the marketplace", ""},
+	"payment_price_date":         {"Date of the currency price", ""},
+	"buyer_order_hash":           {"Hash of the buyer order", ""},
+	"seller_order_hash":          {"Hash of the seller order", ""},
+	"block_hash":                 {"Hash of the block", ""},
+	"block_number":               {"Number of the block", ""},
+	"log_index":                  {"Index of the log in the block", ""},
+	"tx_sender":                  {"Sender of the transaction, who paid its gas", ""},
+	"tx_gas_used":                {"Gas used by the transaction", "gas"},
+	"tx_gas_price":               {"Effective gas price of the transaction", "gwei"},
+	"tx_cost":                    {"Gas cost of the transaction", "tx_cost_currency"},
+	"tx_cost_currency":           {"Native currency of the transaction blockchain", ""},
+	"tx_cost_usd":                {"Gas cost of the transaction in USD", "USD"},
+	"marketplace_fee":            {"Fees paid to the marketplace, decoded from the transaction receipt", "payment_currency"},
+	"creator_fee":                {"Fees paid to the creators, decoded from the transaction receipt", "payment_currency"},
+	"seller_proceeds":            {"Amount received by the seller, decoded from the transaction receipt", "payment_currency"},
+	"net_proceeds":               {"Amount received by the seller less the gas cost if the seller sent the transaction", "payment_currency"},
+	"net_proceeds_usd":           {"Net proceeds of the seller in USD", "USD"},
+	"fees_status":                {"Whether the fees were decoded from the receipt, only the gas cost was (gas_only, e.g. native payments outside Seaport), the payments of the order could not be told apart in a multi-order transaction (unattributed) or the receipt is missing", ""},
+	"data":                       {"Raw operation payload from the source", ""},
+}
+
+func (p *operationFeatureProvider) Name() string {
+	return "operation"
+}
+
+func (p *operationFeatureProvider) Columns() (h []string, t []string) {
+	return SecondMarketOperationColumns(p.exclude)
+}
+
+func (p *operationFeatureProvider) Describe(column string) (description string, unit string) {
+	info := operationColumnsDescriptions[column]
+	return info[0], info[1]
+}
+
+func (p *operationFeatureProvider) Compute(op *SecondMarketOperation) map[string]any {
+	return op.ExportRow(p.exclude)
+}
+
+// plainDataValue converts the raw payload of an operation, as decoded from the
+// database, to plain maps, slices and scalars.
+func plainDataValue(data any) any {
+	if data == nil {
+		return nil
+	}
+	jsonData, err := bson.MarshalExtJSON(bson.M{"data": data}, false, false)
+	if err != nil {
+		return nil
+	}
+	plain := map[string]any{}
+	if err = json.Unmarshal(jsonData, &plain); err != nil {
+		return nil
+	}
+	return plain["data"]
+}
+
+/*
+	Related transactions: LISTs & BIDs with the SELL they led to, and reciprocally
+*/
+
+type relatedTransactionFeatureProvider struct {
+	tolerance float64
+	links     map[string]map[string]any
+}
+
+func newRelatedTransactionFeatureProvider(tolerance float64) *relatedTransactionFeatureProvider {
+	return &relatedTransactionFeatureProvider{tolerance: tolerance, links: make(map[string]map[string]any)}
+}
+
+func (p *relatedTransactionFeatureProvider) Name() string {
+	return "related_transaction"
+}
+
+func (p *relatedTransactionFeatureProvider) Columns() (h []string, t []string) {
+	return initializeExportOpAddInfoHT()
+}
+
+func (p *relatedTransactionFeatureProvider) Describe(column string) (description string, unit string) {
+	switch column {
+	case "related_to":
+		return "Type of the related operation: the LIST or BID a SELL filled, or the SELL a LIST or BID led to", ""
+	case "rt_date":
+		return "Date of the related operation", ""
+	case "rt_time_diff":
+		return "Time between the LIST or BID and the SELL", "day"
+	case "rt_operation_id":
+		return "Identifier of the related operation", ""
+	case "rt_match_strategy":
+		return "How the SELL was matched to the order: order_hash, amount (listing of the seller) or bid (bid of the buyer)", ""
+	case "rt_confidence":
+		return "Confidence of the match, from 1 for an order hash down to 0.6", ""
+	case "rt_reason":
+		return "Why the SELL was matched to the order", ""
+	}
+	return "", ""
+}
+
+func (p *relatedTransactionFeatureProvider) PrepareAsset(operations []*SecondMarketOperation) {
+	p.links = make(map[string]map[string]any)
+	matches, _ := MatchAssetSales(operations, p.tolerance)
+	for _, match := range matches {
+		timeDiff := match.Sale.Date.Sub(*match.Order.Date).Hours() / 24
+		sellAddInfo := initializeExportOpAddInfo()
+		populateExportOpAddInfo(&sellAddInfo, match.Order.Type, match.Order.Date, timeDiff, match.Order.OperationId, match)
+		p.links[match.Sale.OperationId] = sellAddInfo
+		orderAddInfo := initializeExportOpAddInfo()
+		populateExportOpAddInfo(&orderAddInfo, "SELL", match.Sale.Date, timeDiff, match.Sale.OperationId, match)
+		p.links[match.Order.OperationId] = orderAddInfo
+	}
+}
+
+func (p *relatedTransactionFeatureProvider) Compute(op *SecondMarketOperation) map[string]any {
+	addInfo, ok := p.links[op.OperationId]
+	if ok {
+		return addInfo
+	}
+	return initializeExportOpAddInfo()
+}
+
+/*
+	Decentraland distances to focal points
+*/
+
+type dclDistancesFeatureProvider struct {
+	metric string
+}
+
+func (p *dclDistancesFeatureProvider) Name() string {
+	return "distances"
+}
+
+func (p *dclDistancesFeatureProvider) Columns() (h []string, t []string) {
+	return helpers.GetDclDistanceToFocalPointsHT()
+}
+
+func (p *dclDistancesFeatureProvider) Describe(column string) (description string, unit string) {
+	return helpers.DescribeDclDistanceColumn(column), fmt.Sprintf("parcel (%s)", p.metric)
+}
+
+func (p *dclDistancesFeatureProvider) Compute(op *SecondMarketOperation) map[string]any {
+	values := make(map[string]any)
+	if op.AssetLocX != nil && op.AssetLocY != nil {
+		for k, v := range helpers.GetDclDistanceToFocalPoints(*op.AssetLocX, *op.AssetLocY, p.metric) {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+/*
+	Decentraland parcel containment & adjacency
+*/
+
+type dclParcelFeatureProvider struct{}
+
+func (p *dclParcelFeatureProvider) Name() string {
+	return "parcel"
+}
+
+func (p *dclParcelFeatureProvider) Columns() (h []string, t []string) {
+	return helpers.GetDclParcelFeaturesHT()
+}
+
+func (p *dclParcelFeatureProvider) Describe(column string) (description string, unit string) {
+	switch column {
+	case "LOC__DISTRICT":
+		return "District containing the parcel", ""
+	case "LOC__ROAD_ADJ":
+		return "Whether the parcel touches a road", ""
+	case "LOC__PLAZA_ADJ":
+		return "Whether the parcel touches a plaza", ""
+	case "LOC__ROAD_SIDES":
+		return "Number of sides of the parcel touching a road", ""
+	case "LOC__CORNER":
+		return "Whether the parcel touches roads on two perpendicular sides", ""
+	case "LOC__BORDER":
+		return "Whether the parcel is on the map border", ""
+	case "LOC__GENESIS_RING":
+		return "Ring of the parcel around Genesis Plaza", "parcel (chebyshev)"
+	}
+	return "", ""
+}
+
+func (p *dclParcelFeatureProvider) Compute(op *SecondMarketOperation) map[string]any {
+	if op.AssetLocX != nil && op.AssetLocY != nil {
+		return helpers.GetDclParcelFeatures(*op.AssetLocX, *op.AssetLocY)
+	}
+	return map[string]any{}
+}
+
+/*
+	Currencies prices & market caps at operation date
+*/
+
+type currenciesFeatureProvider struct {
+	currencies []string
+}
+
+func (p *currenciesFeatureProvider) Name() string {
+	return "currencies"
+}
+
+func (p *currenciesFeatureProvider) Columns() (h []string, t []string) {
+	return helpers.GetCurrenciesTimeDataHeaders(p.currencies)
+}
+
+func (p *currenciesFeatureProvider) Describe(column string) (description string, unit string) {
+	if currency, ok := strings.CutSuffix(column, "_MARKET_CAP"); ok {
+		return fmt.Sprintf("Market capitalization of %s at the operation date", currency), "USD"
+	}
+	if currency, ok := strings.CutSuffix(column, "_PRICE"); ok {
+		return fmt.Sprintf("Price of %s at the operation date", currency), "USD"
+	}
+	return "", ""
+}
+
+func (p *currenciesFeatureProvider) Compute(op *SecondMarketOperation) map[string]any {
+	values := make(map[string]any)
+	for k, v := range helpers.GetCurrenciesTimeData(p.currencies, *op.Date) {
+		values[k] = v
+	}
+	return values
+}
+
+/*
+	Payment amount converted into numeraires at operation date
+*/
+
+type numerairesFeatureProvider struct {
+	numeraires []string
+}
+
+func (p *numerairesFeatureProvider) Name() string {
+	return "numeraires"
+}
+
+func (p *numerairesFeatureProvider) Columns() (h []string, t []string) {
+	return helpers.GetNumerairesHeaders(p.numeraires)
+}
+
+func (p *numerairesFeatureProvider) Describe(column string) (description string, unit string) {
+	if numeraire, ok := strings.CutPrefix(column, helpers.NumeraireHeaderPrefix); ok {
+		numeraire = strings.ToUpper(numeraire)
+		return fmt.Sprintf("Amount of the payment in %s at the operation date", numeraire), numeraire
+	}
+	return "", ""
+}
+
+func (p *numerairesFeatureProvider) Compute(op *SecondMarketOperation) map[string]any {
+	values := make(map[string]any)
+	headers, _ := p.Columns()
+	for i, numeraire := range p.numeraires {
+		if value, ok := operationNumeraireAmount(op, numeraire); ok {
+			values[headers[i]] = value
+		} else {
+			values[headers[i]] = nil
+		}
+	}
+	return values
+}
@@ -0,0 +1,340 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"OpenSeaDataDownloader/utils"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	FeesStatusDecoded = "decoded"
+	FeesStatusGasOnly = "gas_only"
+	// FeesStatusUnattributed marks the sales of a transaction filling several
+	// orders whose payments cannot be told apart from the other orders ones
+	FeesStatusUnattributed = "unattributed"
+	FeesStatusMissing      = "missing"
+
+	rpcBatchSize = 100
+)
+
+// marketplaceFeeRecipients are the addresses collecting the marketplace fees;
+// any other recipient of the payments of the order but the seller and the
+// buyer is taken as a creator.
+var marketplaceFeeRecipients = map[string]string{
+	"0x0000a26b00c1f0df003000390027140000faa719": "OPEN_SEA",
+	"0x5b3256965e7c3cf26e11fcaf296dfc8807c01073": "OPEN_SEA",
+	"0x1cf0df2a5a20cd61d68d4489eebbf85b8d39e18a": "RARIBLE",
+}
+
+// FeesEnrichment counts the sales enriched from their transaction receipt.
+type FeesEnrichment struct {
+	Operations int
+	Skipped    int
+	Statuses   map[string]int
+}
+
+// rpcCacheDir is where the JSON-RPC results are cached, RPC_CACHE_DIR or
+// else rpc_cache.
+func rpcCacheDir() string {
+	if cacheDir := os.Getenv("RPC_CACHE_DIR"); cacheDir != "" {
+		return cacheDir
+	}
+	return "rpc_cache"
+}
+
+// getRpcClient returns the JSON-RPC client of a blockchain, with the url of
+// the <BLOCKCHAIN>_RPC_URL variable (e.g. ETHEREUM_RPC_URL), or nil if unset.
+func getRpcClient(blockchain string, clients map[string]*utils.JsonRpcClient) *utils.JsonRpcClient {
+	blockchain = strings.ToUpper(blockchain)
+	if blockchain == "MATIC" {
+		blockchain = "POLYGON"
+	}
+	client, exists := clients[blockchain]
+	if !exists {
+		if url := os.Getenv(blockchain + "_RPC_URL"); url != "" {
+			client = utils.NewJsonRpcClient(url, rpcBatchSize, rpcCacheDir())
+		}
+		clients[blockchain] = client
+	}
+	return client
+}
+
+func isNativePayment(op *SecondMarketOperation) bool {
+	return op.PaymentToken == "" || op.PaymentToken == helpers.NativeTokenContract
+}
+
+// operationPayments returns the payments of a sale decoded from its receipt,
+// and false when they cannot be attributed to its order. In a transaction
+// filling a single order, they are the Seaport consideration items of the
+// order for a native payment and the ERC20 transfers of the payment token
+// sent by the buyer otherwise. In a transaction filling several orders (e.g.
+// a sweep), they are the Seaport consideration items in the payment token of
+// the order of the sale, found by order hash. Native payments outside Seaport
+// (Wyvern, Rarible) are internal transfers missing from the receipts.
+func operationPayments(op *SecondMarketOperation, receipt *helpers.TransactionReceipt) ([]*helpers.TokenTransfer, bool) {
+	paymentToken := strings.ToLower(op.PaymentToken)
+	if isNativePayment(op) {
+		paymentToken = helpers.NativeTokenContract
+	}
+	seaportPayments := receipt.SeaportPayments()
+	orderHashes := make(map[string]bool)
+	for _, payment := range seaportPayments {
+		orderHashes[payment.OrderHash] = true
+	}
+	payments := make([]*helpers.TokenTransfer, 0)
+	if len(orderHashes) > 1 {
+		for _, payment := range seaportPayments {
+			if payment.Token != paymentToken {
+				continue
+			}
+			for _, hash := range []string{op.OrderHash, op.SellerOrderHash, op.BuyerOrderHash} {
+				if hash != "" && strings.EqualFold(payment.OrderHash, hash) {
+					payments = append(payments, payment)
+					break
+				}
+			}
+		}
+		return payments, len(payments) > 0
+	}
+	if paymentToken == helpers.NativeTokenContract {
+		for _, payment := range seaportPayments {
+			if payment.Token == paymentToken {
+				payments = append(payments, payment)
+			}
+		}
+		return payments, true
+	}
+	for _, transfer := range receipt.Erc20Transfers() {
+		if transfer.Token != paymentToken {
+			continue
+		}
+		if op.Buyer != "" && !strings.EqualFold(transfer.From, op.Buyer) {
+			continue
+		}
+		payments = append(payments, transfer)
+	}
+	return payments, true
+}
+
+// enrichOperationFees sets the gas cost of a sale from its receipt, then its
+// fees and the proceeds of its seller from the payments of its order. It
+// returns the fees status of the sale: gas_only when no payment to the seller
+// is found, as for native payments outside Seaport.
+func enrichOperationFees(op *SecondMarketOperation, receipt *helpers.TransactionReceipt) string {
+	if receipt == nil {
+		return FeesStatusMissing
+	}
+	gasUsed, gasPrice, cost := receipt.GasCost()
+	native, _ := helpers.ResolveToken(op.Blockchain, "")
+	nativeCurrency, nativeDecimals := "", int64(18)
+	if native != nil {
+		nativeCurrency, nativeDecimals = native.Symbols, native.Decimals
+	}
+	op.TxSender = strings.ToLower(receipt.From)
+	op.TxGasUsed = gasUsed
+	op.TxGasPrice = helpers.ScaleTokenBigAmount(gasPrice, 9)
+	op.TxCost = helpers.ScaleTokenBigAmount(cost, nativeDecimals)
+	op.TxCostCurrency = nativeCurrency
+	if op.Date != nil {
+		op.TxCostUsd, _, _ = helpers.ConvertCurrencyAmount(op.TxCost, nativeCurrency, helpers.UsdNumeraire, *op.Date)
+	}
+
+	decimals := nativeDecimals
+	if !isNativePayment(op) {
+		token, ok := helpers.ResolveToken(op.PaymentBlockchain, op.PaymentToken)
+		if !ok || token.Decimals == 0 {
+			return FeesStatusGasOnly
+		}
+		decimals = token.Decimals
+	}
+	payments, attributed := operationPayments(op, receipt)
+	if !attributed {
+		return FeesStatusUnattributed
+	}
+	op.MarketplaceFee, op.CreatorFee, op.SellerProceeds = 0, 0, 0
+	for _, payment := range payments {
+		amount := helpers.ScaleTokenBigAmount(payment.Amount, decimals)
+		recipient := strings.ToLower(payment.To)
+		if strings.EqualFold(recipient, op.Seller) {
+			op.SellerProceeds += amount
+		} else if strings.EqualFold(recipient, op.Buyer) {
+			continue
+		} else if _, isMarketplace := marketplaceFeeRecipients[recipient]; isMarketplace {
+			op.MarketplaceFee += amount
+		} else {
+			op.CreatorFee += amount
+		}
+	}
+	if op.SellerProceeds == 0 {
+		return FeesStatusGasOnly
+	}
+
+	// The seller pays the gas when accepting an offer
+	op.NetProceeds = op.SellerProceeds
+	if strings.EqualFold(op.TxSender, op.Seller) && op.Date != nil {
+		if gasCost, _, ok := helpers.ConvertCurrencyAmount(op.TxCost, nativeCurrency, op.PaymentCanonicalCurrency, *op.Date); ok {
+			op.NetProceeds -= gasCost
+		}
+	}
+	if op.PaymentCcyPrice != 0 {
+		op.NetProceedsUsd = op.NetProceeds * op.PaymentCcyPrice
+	} else if op.Date != nil {
+		op.NetProceedsUsd, _, _ = helpers.ConvertCurrencyAmount(op.NetProceeds, op.PaymentCanonicalCurrency, helpers.UsdNumeraire, *op.Date)
+	}
+	return FeesStatusDecoded
+}
+
+func writeOperationsFees(operations []*SecondMarketOperation, clients map[string]*utils.JsonRpcClient, dbCollection *mgm.Collection, enrichment *FeesEnrichment) error {
+	hashesByChain := make(map[*utils.JsonRpcClient][]string)
+	requested := make(map[string]bool)
+	for _, operation := range operations {
+		client := getRpcClient(operation.Blockchain, clients)
+		if client != nil && !requested[operation.TransactionHash] {
+			requested[operation.TransactionHash] = true
+			hashesByChain[client] = append(hashesByChain[client], operation.TransactionHash)
+		}
+	}
+	receipts := make(map[string]*helpers.TransactionReceipt)
+	for client, hashes := range hashesByChain {
+		chainReceipts, err := helpers.GetTransactionReceipts(client, hashes)
+		if err != nil {
+			return err
+		}
+		for hash, receipt := range chainReceipts {
+			receipts[hash] = receipt
+		}
+	}
+
+	dbRequests := make([]mongo.WriteModel, 0)
+	for _, operation := range operations {
+		if getRpcClient(operation.Blockchain, clients) == nil {
+			enrichment.Skipped++
+			continue
+		}
+		if operation.PaymentCanonicalCurrency == "" {
+			operation.PaymentCanonicalCurrency = helpers.CanonicalCurrency(operation.PaymentBlockchain, operation.PaymentToken, operation.PaymentCurrency)
+		}
+		status := enrichOperationFees(operation, receipts[strings.ToLower(operation.TransactionHash)])
+		enrichment.Statuses[status]++
+		setPayload := bson.D{{"fees_status", status}, {"updated_at", time.Now().UTC()}}
+		if status != FeesStatusMissing {
+			setPayload = append(setPayload,
+				bson.E{"tx_sender", operation.TxSender},
+				bson.E{"tx_gas_used", operation.TxGasUsed},
+				bson.E{"tx_gas_price", operation.TxGasPrice},
+				bson.E{"tx_cost", operation.TxCost},
+				bson.E{"tx_cost_currency", operation.TxCostCurrency},
+				bson.E{"tx_cost_usd", operation.TxCostUsd},
+			)
+		}
+		if status == FeesStatusDecoded {
+			setPayload = append(setPayload,
+				bson.E{"marketplace_fee", operation.MarketplaceFee},
+				bson.E{"creator_fee", operation.CreatorFee},
+				bson.E{"seller_proceeds", operation.SellerProceeds},
+				bson.E{"net_proceeds", operation.NetProceeds},
+				bson.E{"net_proceeds_usd", operation.NetProceedsUsd},
+			)
+		}
+		dbRequests = append(dbRequests, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": operation.ID}).SetUpdate(bson.D{{"$set", setPayload}}))
+	}
+	if len(dbRequests) == 0 {
+		return nil
+	}
+	_, err := dbCollection.BulkWrite(context.Background(), dbRequests)
+	return err
+}
+
+// EnrichOperationsFees enriches the sales with a transaction hash whose fees
+// were never decoded, or whose receipt was missing, by batches of 1000. Sales
+// of a blockchain without RPC url are skipped.
+func EnrichOperationsFees(metaverse, source string, dbInstance *mongo.Database, loggingPrefix string) (*FeesEnrichment, error) {
+	dbCollection := helpers.CollectionInstance(dbInstance, &SecondMarketOperation{})
+	filter := bson.D{
+		{"type", "SELL"},
+		{"transaction_hash", bson.D{{"$nin", bson.A{"", nil}}}},
+		{"fees_status", bson.D{{"$in", bson.A{nil, FeesStatusMissing}}}},
+	}
+	if metaverse != "" {
+		filter = append(filter, bson.E{"metaverse", metaverse})
+	}
+	if source != "" {
+		filter = append(filter, bson.E{"downloaded_from", source})
+	}
+	cursor, err := dbCollection.Find(context.Background(), filter, options.Find().SetBatchSize(1000))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	enrichment := &FeesEnrichment{Statuses: make(map[string]int)}
+	clients := make(map[string]*utils.JsonRpcClient)
+	operations := make([]*SecondMarketOperation, 0)
+	for cursor.Next(context.Background()) {
+		operation := &SecondMarketOperation{}
+		if err = cursor.Decode(operation); err != nil {
+			return nil, err
+		}
+		enrichment.Operations++
+		operations = append(operations, operation)
+		if len(operations) == 1000 {
+			if err = writeOperationsFees(operations, clients, dbCollection, enrichment); err != nil {
+				return nil, err
+			}
+			operations = make([]*SecondMarketOperation, 0)
+			helpers.Logging(loggingPrefix, fmt.Sprintf("%d sales read, %d decoded...", enrichment.Operations, enrichment.Statuses[FeesStatusDecoded]))
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	if len(operations) > 0 {
+		if err = writeOperationsFees(operations, clients, dbCollection, enrichment); err != nil {
+			return nil, err
+		}
+	}
+	return enrichment, nil
+}
+
+func EnrichFees(metaverse, source string) {
+	loggingPrefix := fmt.Sprintf("FEES ENRICHMENT { %s | %s }", metaverse, source)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read tokens & currency prices...")
+	err = helpers.LoadTokenRegistry(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.ReadCurrencyPrices(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Tokens & currency prices read !!!")
+
+	helpers.Logging(loggingPrefix, "Decode sales receipts...")
+	enrichment, err := EnrichOperationsFees(metaverse, source, dbInstance, loggingPrefix)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Sales receipts decoded [Sales = %d | Decoded = %d | Gas only = %d | Unattributed = %d | Missing = %d | Without RPC = %d] !!!", enrichment.Operations, enrichment.Statuses[FeesStatusDecoded], enrichment.Statuses[FeesStatusGasOnly], enrichment.Statuses[FeesStatusUnattributed], enrichment.Statuses[FeesStatusMissing], enrichment.Skipped))
+	helpers.Logging(loggingPrefix, "Native payments outside Seaport (Wyvern, Rarible) are not in the receipts: their sales only get the gas cost (gas_only)")
+
+	helpers.Logging(loggingPrefix, "END...")
+}
@@ -0,0 +1,81 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+func ImportFocalPoints(inputPath, fpType string) {
+	loggingPrefix := fmt.Sprintf("FOCAL POINTS IMPORT { %s | %s }", inputPath, fpType)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read parcels data...")
+	err = helpers.LoadDecentralandParcels(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Read parcels data OK !!!")
+
+	helpers.Logging(loggingPrefix, "Import focal points...")
+	count, err := helpers.ImportDclFocalPoints(inputPath, fpType, dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("%d focal points imported !!!", count))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
+
+func ListFocalPoints(fpType string) {
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+
+	focalPoints, err := helpers.ListDclFocalPoints(fpType, dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "TYPE\tDCL ID\tNAME\tCATEGORY\tPARCELS")
+	for _, focalPoint := range focalPoints {
+		_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\n", focalPoint.FocalPointType, focalPoint.DclId, focalPoint.Name, focalPoint.Category, focalPoint.ParcelsCount)
+	}
+	_ = writer.Flush()
+}
+
+func ValidateFocalPoints() {
+	loggingPrefix := "FOCAL POINTS VALIDATION"
+	helpers.Logging(loggingPrefix, "Start...")
+
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	focalPoints, err := helpers.ListDclFocalPoints("", dbInstance)
+	helpers.CloseDatabaseConnection(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	issues := helpers.ValidateDclFocalPoints(focalPoints)
+	for _, issue := range issues {
+		helpers.Logging(loggingPrefix, fmt.Sprintf("[%s %s] %s", issue.FocalPointType, issue.FocalPointId, issue.Message))
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("%d focal points checked, %d issues found", len(focalPoints), len(issues)))
+
+	helpers.Logging(loggingPrefix, "END...")
+	if len(issues) > 0 {
+		os.Exit(1)
+	}
+}
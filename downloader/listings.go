@@ -0,0 +1,420 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ListingStatusActive    = "active"
+	ListingStatusFilled    = "filled"
+	ListingStatusExpired   = "expired"
+	ListingStatusCancelled = "cancelled"
+	ListingStatusRepriced  = "repriced"
+)
+
+var ListingStatuses = []string{ListingStatusActive, ListingStatusFilled, ListingStatusExpired, ListingStatusCancelled, ListingStatusRepriced}
+
+// Listing is the lifecycle of a LIST operation, as known at AsOf: filled by a
+// sale, expired, cancelled by a newer listing of the maker at the same price
+// or by a change of owner of the asset, repriced by a newer listing at another price, or
+// still active. TimeOnMarket is in days, from the start of the listing to its
+// end (or to AsOf when active). PriceChangePct is the change from the listed
+// amount to the amount it ended at: the new listing of a repricing or the
+// sale that filled it.
+type Listing struct {
+	mgm.DefaultModel `bson:",inline"`
+	OperationId      string     `bson:"operation_id" json:"operation_id"`
+	DownloadedFrom   string     `bson:"downloaded_from" json:"downloaded_from"`
+	Metaverse        string     `bson:"metaverse,omitempty" json:"metaverse"`
+	AssetContract    string     `bson:"asset_contract,omitempty" json:"asset_contract"`
+	AssetType        string     `bson:"asset_type,omitempty" json:"asset_type"`
+	AssetId          string     `bson:"asset_id,omitempty" json:"asset_id"`
+	AssetLocation    string     `bson:"asset_location,omitempty" json:"asset_location"`
+	Maker            string     `bson:"maker,omitempty" json:"maker"`
+	PaymentCurrency  string     `bson:"payment_currency,omitempty" json:"payment_currency"`
+	PaymentAmount    float64    `bson:"payment_amount,omitempty" json:"payment_amount"`
+	PaymentAmountUsd float64    `bson:"payment_amount_usd,omitempty" json:"payment_amount_usd"`
+	ListedAt         *time.Time `bson:"listed_at" json:"listed_at"`
+	StartDate        *time.Time `bson:"start_date,omitempty" json:"start_date"`
+	ExpirationDate   *time.Time `bson:"expiration_date,omitempty" json:"expiration_date"`
+	Status           string     `bson:"status" json:"status"`
+	EndedAt          *time.Time `bson:"ended_at,omitempty" json:"ended_at"`
+	EndOperationId   string     `bson:"end_operation_id,omitempty" json:"end_operation_id"`
+	TimeOnMarket     float64    `bson:"time_on_market" json:"time_on_market"`
+	PriceChangePct   *float64   `bson:"price_change_pct,omitempty" json:"price_change_pct"`
+	MatchStrategy    string     `bson:"match_strategy,omitempty" json:"match_strategy"`
+	MatchConfidence  float64    `bson:"match_confidence,omitempty" json:"match_confidence"`
+	AsOf             time.Time  `bson:"as_of" json:"as_of"`
+	operation        *SecondMarketOperation
+}
+
+func (l Listing) CollectionName() string {
+	return "listings"
+}
+
+// ListingsBuild counts the listings built in every status.
+type ListingsBuild struct {
+	Assets   int
+	Listings int
+	Statuses map[string]int
+}
+
+// listingEnd is the first operation ending a listing.
+type listingEnd struct {
+	status    string
+	date      time.Time
+	operation *SecondMarketOperation
+}
+
+func newListing(op *SecondMarketOperation, asOf time.Time) *Listing {
+	listing := &Listing{
+		OperationId:      op.OperationId,
+		DownloadedFrom:   op.DownloadedFrom,
+		Metaverse:        op.Metaverse,
+		AssetContract:    op.AssetContract,
+		AssetType:        op.AssetType,
+		AssetId:          op.AssetId,
+		AssetLocation:    op.AssetLocation,
+		Maker:            op.Maker,
+		PaymentCurrency:  operationCurrency(op),
+		PaymentAmount:    op.PaymentAmount,
+		PaymentAmountUsd: op.PaymentAmountUsd,
+		ListedAt:         op.Date,
+		StartDate:        OperationStartDate(op),
+		ExpirationDate:   OperationExpirationDate(op),
+		AsOf:             asOf,
+		operation:        op,
+	}
+	return listing
+}
+
+// end sets the status of the listing, ended by an operation (none when it
+// expired or is still active), and computes its time on market.
+func (l *Listing) end(status string, endedAt *time.Time, operation *SecondMarketOperation, endAmount *float64) {
+	l.Status = status
+	l.EndedAt = endedAt
+	if operation != nil {
+		l.EndOperationId = operation.OperationId
+	}
+	start := *l.ListedAt
+	if l.StartDate != nil && l.StartDate.After(start) {
+		start = *l.StartDate
+	}
+	end := l.AsOf
+	if endedAt != nil {
+		end = *endedAt
+	}
+	if end.After(start) {
+		l.TimeOnMarket = end.Sub(start).Hours() / 24
+	}
+	if endAmount != nil && l.PaymentAmount != 0 {
+		priceChangePct := (*endAmount - l.PaymentAmount) / l.PaymentAmount * 100
+		l.PriceChangePct = &priceChangePct
+	}
+}
+
+// nextListingEnd returns the first operation after the listing ending it: a
+// newer listing of the maker, repricing it if its amount differs beyond the
+// tolerance or is in another currency, or a change of owner of the asset.
+func nextListingEnd(listing *SecondMarketOperation, operations []*SecondMarketOperation, tolerance float64) *listingEnd {
+	if listing.Maker == "" {
+		return nil
+	}
+	for _, op := range operations {
+		if op == listing || op.Date == nil || op.Date.Before(*listing.Date) {
+			continue
+		}
+		if op.Type == "LIST" && strings.EqualFold(op.Maker, listing.Maker) && op.Date.After(*listing.Date) {
+			status := ListingStatusCancelled
+			if operationCurrency(op) != operationCurrency(listing) || amountsDifference(listing.PaymentAmount, op.PaymentAmount) > tolerance {
+				status = ListingStatusRepriced
+			}
+			return &listingEnd{status: status, date: *op.Date, operation: op}
+		}
+		if changesOwner(op, listing.Maker) {
+			return &listingEnd{status: ListingStatusCancelled, date: *op.Date, operation: op}
+		}
+	}
+	return nil
+}
+
+// changesOwner tells whether an operation takes the asset away from the
+// maker: a sale by the maker, or a sale or a transfer to another account.
+func changesOwner(op *SecondMarketOperation, maker string) bool {
+	if op.Type != "SELL" && op.Type != "TRANSFER" {
+		return false
+	}
+	if op.Type == "SELL" && strings.EqualFold(op.Seller, maker) {
+		return true
+	}
+	return op.Buyer != "" && !strings.EqualFold(op.Buyer, maker)
+}
+
+// knownOperations returns the operations dated at asOf at the latest.
+func knownOperations(operations []*SecondMarketOperation, asOf time.Time) []*SecondMarketOperation {
+	known := make([]*SecondMarketOperation, 0, len(operations))
+	for _, op := range operations {
+		if op.Date != nil && !op.Date.After(asOf) {
+			known = append(known, op)
+		}
+	}
+	return known
+}
+
+// assetFills returns the sales filling the orders of an asset, by order.
+func assetFills(operations []*SecondMarketOperation, tolerance float64) map[*SecondMarketOperation]*OperationMatch {
+	matches, _ := MatchAssetSales(operations, tolerance)
+	filledBy := make(map[*SecondMarketOperation]*OperationMatch)
+	for _, match := range matches {
+		filledBy[match.Order] = match
+	}
+	return filledBy
+}
+
+// BuildAssetListings reconstructs the lifecycle of the listings of an asset
+// from its operations sorted by date, ignoring the operations after asOf.
+func BuildAssetListings(operations []*SecondMarketOperation, tolerance float64, asOf time.Time) []*Listing {
+	known := knownOperations(operations, asOf)
+	return buildListings(known, assetFills(known, tolerance), tolerance, asOf)
+}
+
+func buildListings(known []*SecondMarketOperation, filledBy map[*SecondMarketOperation]*OperationMatch, tolerance float64, asOf time.Time) []*Listing {
+	listings := make([]*Listing, 0)
+	for _, op := range known {
+		if op.Type != "LIST" {
+			continue
+		}
+		listing := newListing(op, asOf)
+		listings = append(listings, listing)
+
+		if match, ok := filledBy[op]; ok {
+			listing.MatchStrategy = match.Strategy
+			listing.MatchConfidence = match.Confidence
+			listing.end(ListingStatusFilled, match.Sale.Date, match.Sale, &match.Sale.PaymentAmount)
+			continue
+		}
+		end := nextListingEnd(op, known, tolerance)
+		if listing.ExpirationDate != nil && !listing.ExpirationDate.After(asOf) && (end == nil || listing.ExpirationDate.Before(end.date)) {
+			end = &listingEnd{status: ListingStatusExpired, date: *listing.ExpirationDate}
+		}
+		if end == nil {
+			listing.end(ListingStatusActive, nil, nil, nil)
+		} else if end.status == ListingStatusRepriced {
+			listing.end(end.status, &end.date, end.operation, &end.operation.PaymentAmount)
+		} else {
+			listing.end(end.status, &end.date, end.operation, nil)
+		}
+	}
+	return listings
+}
+
+func saveListings(listings []*Listing, dbInstance *mongo.Database) error {
+	if len(listings) == 0 {
+		return nil
+	}
+	dbCollection := helpers.CollectionInstance(dbInstance, &Listing{})
+	dbRequests := make([]mongo.WriteModel, len(listings))
+	updatedAt := time.Now().UTC()
+	for i, listing := range listings {
+		// Updates skip mgm hooks: a rebuild keeps the creation date of the listing
+		filterPayload := bson.M{"operation_id": listing.OperationId, "downloaded_from": listing.DownloadedFrom}
+		dbRequests[i] = mongo.NewUpdateOneModel().SetFilter(filterPayload).SetUpdate(bson.D{
+			{"$set", bson.D{
+				{"metaverse", listing.Metaverse}, {"asset_contract", listing.AssetContract}, {"asset_type", listing.AssetType}, {"asset_id", listing.AssetId},
+				{"asset_location", listing.AssetLocation}, {"maker", listing.Maker}, {"payment_currency", listing.PaymentCurrency}, {"payment_amount", listing.PaymentAmount},
+				{"payment_amount_usd", listing.PaymentAmountUsd}, {"listed_at", listing.ListedAt}, {"start_date", listing.StartDate}, {"expiration_date", listing.ExpirationDate},
+				{"status", listing.Status}, {"ended_at", listing.EndedAt}, {"end_operation_id", listing.EndOperationId}, {"time_on_market", listing.TimeOnMarket},
+				{"price_change_pct", listing.PriceChangePct}, {"match_strategy", listing.MatchStrategy}, {"match_confidence", listing.MatchConfidence},
+				{"as_of", listing.AsOf}, {"updated_at", updatedAt},
+			}},
+			{"$setOnInsert", bson.D{{"created_at", updatedAt}}},
+		}).SetUpsert(true)
+	}
+	_, err := dbCollection.BulkWrite(context.Background(), dbRequests)
+	return err
+}
+
+// WriteListings builds the listings asset by asset and saves them by batches
+// of 1000.
+func WriteListings(metaverse, source string, tolerance float64, asOf time.Time, dbInstance *mongo.Database, loggingPrefix string) (*ListingsBuild, error) {
+	build := &ListingsBuild{Statuses: make(map[string]int)}
+	batch := make([]*Listing, 0, 1000)
+	buildAsset := func(operations []*SecondMarketOperation) error {
+		build.Assets++
+		for _, listing := range BuildAssetListings(operations, tolerance, asOf) {
+			build.Listings++
+			build.Statuses[listing.Status]++
+			batch = append(batch, listing)
+			if len(batch) == 1000 {
+				if err := saveListings(batch, dbInstance); err != nil {
+					return err
+				}
+				batch = batch[:0]
+				helpers.Logging(loggingPrefix, fmt.Sprintf("%d listings of %d assets saved...", build.Listings, build.Assets))
+			}
+		}
+		return nil
+	}
+	err := forEachAssetOperations(metaverse, source, []string{"LIST", "BID", "SELL", "TRANSFER"}, dbInstance, buildAsset)
+	if err == nil {
+		err = saveListings(batch, dbInstance)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+func BuildListings(metaverse, source string, tolerance float64, asOf time.Time) {
+	loggingPrefix := fmt.Sprintf("LISTINGS BUILD { %s | %s | %s }", metaverse, source, asOf.Format(time.RFC3339))
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read currencies...")
+	err = helpers.LoadCurrencyAliases(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Currencies read !!!")
+
+	helpers.Logging(loggingPrefix, "Build listings lifecycles...")
+	build, err := WriteListings(metaverse, source, tolerance, asOf, dbInstance, loggingPrefix)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Listings built [Assets = %d | Listings = %d] !!!", build.Assets, build.Listings))
+	for _, status := range ListingStatuses {
+		helpers.Logging(loggingPrefix, fmt.Sprintf("%d listings %s", build.Statuses[status], status))
+	}
+
+	helpers.Logging(loggingPrefix, "END...")
+}
+
+var listingsColumnsDescriptions = map[string][2]string{
+	"operation_id":       {"Identifier of the LIST operation at its source", ""},
+	"listed_at":          {"Date of the LIST operation", ""},
+	"start_date":         {"Date the listing starts, when given by the marketplace", ""},
+	"expiration_date":    {"Date the listing expires, when given by the marketplace", ""},
+	"source":             {"API the listing was downloaded from", ""},
+	"maker":              {"Address of the listing maker", ""},
+	"payment_amount":     {"Listed amount", "payment_currency"},
+	"payment_amount_usd": {"Listed amount in USD", "USD"},
+	"status":             {"Status of the listing at as_of (active, filled, expired, cancelled, repriced)", ""},
+	"ended_at":           {"Date the listing ended", ""},
+	"end_operation_id":   {"Identifier of the operation which ended the listing", ""},
+	"time_on_market":     {"Time from the start of the listing to its end, or to as_of when active", "day"},
+	"price_change_pct":   {"Change from the listed amount to the amount of the sale or of the new listing which ended it", "%"},
+	"match_strategy":     {"How the sale filling the listing was matched to it", ""},
+	"match_confidence":   {"Confidence of the match of the sale filling the listing", ""},
+	"as_of":              {"Date the listing lifecycle was built at", ""},
+}
+
+func listingsExportHT() (h []string, t []string) {
+	h = []string{"operation_id", "listed_at", "start_date", "expiration_date", "source", "metaverse", "asset_contract", "asset_type", "asset_id", "asset_location", "maker",
+		"payment_currency", "payment_amount", "payment_amount_usd", "status", "ended_at", "end_operation_id", "time_on_market", "price_change_pct", "match_strategy", "match_confidence", "as_of"}
+	t = []string{"string", "struct", "struct", "struct", "string", "string", "string", "string", "string", "string", "string",
+		"string", "float64", "float64", "string", "struct", "string", "float64", "float64", "string", "float64", "struct"}
+	return h, t
+}
+
+func (l *Listing) exportValues() []any {
+	var matchConfidence any
+	if l.MatchStrategy != "" {
+		matchConfidence = l.MatchConfidence
+	}
+	values := []any{l.OperationId, l.ListedAt, l.StartDate, l.ExpirationDate, l.DownloadedFrom, l.Metaverse, l.AssetContract, l.AssetType, l.AssetId, l.AssetLocation, l.Maker,
+		l.PaymentCurrency, l.PaymentAmount, l.PaymentAmountUsd, l.Status, l.EndedAt, l.EndOperationId, l.TimeOnMarket, l.PriceChangePct, l.MatchStrategy, matchConfidence, l.AsOf}
+	for i, value := range values {
+		values[i] = normalizeExportValue(value)
+	}
+	return values
+}
+
+// WriteListingsForExport writes the listings sorted by listing date to the
+// output of the spec, in its format.
+func WriteListingsForExport(metaverse, source string, spec *ExportSpec, dbInstance *mongo.Database) (*SecondMarketOperationExport, error) {
+	dbCollection := helpers.CollectionInstance(dbInstance, &Listing{})
+	filter := bson.D{}
+	if metaverse != "" {
+		filter = append(filter, bson.E{"metaverse", metaverse})
+	}
+	if source != "" {
+		filter = append(filter, bson.E{"downloaded_from", source})
+	}
+	opts := options.Find().SetSort(bson.D{{"listed_at", 1}, {"operation_id", 1}}).SetAllowDiskUse(true).SetBatchSize(1000)
+	cursor, err := dbCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	headers, types := listingsExportHT()
+	result := &SecondMarketOperationExport{ColNames: headers, ColTypes: types}
+	result.ColDescriptions, result.ColUnits = describeColumns(headers, listingsColumnsDescriptions, operationColumnsDescriptions)
+	writer, err := newExportWriter(spec, headers, types, nil)
+	if err != nil {
+		return nil, err
+	}
+	for cursor.Next(context.Background()) {
+		listing := &Listing{}
+		if err = cursor.Decode(listing); err != nil {
+			_ = writer.Close()
+			return nil, err
+		}
+		if err = writer.WriteRow(listing.exportValues()); err != nil {
+			_ = writer.Close()
+			return nil, err
+		}
+		result.RowsCount++
+	}
+	if err = cursor.Err(); err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	return result, writer.Close()
+}
+
+func ExportListings(metaverse, source string, spec *ExportSpec) {
+	loggingPrefix := fmt.Sprintf("LISTINGS EXPORT { %s | %s }", metaverse, source)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Export listings from database to file...")
+	result, err := WriteListingsForExport(metaverse, source, spec, dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("%d listings saved in file %s !!!", result.RowsCount, spec.Output))
+
+	helpers.Logging(loggingPrefix, "Writing data package...")
+	dataPackagePath, err := WriteExportDataPackage(metaverse, source, "", spec, result)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Data package saved in file %s !!!", dataPackagePath))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
@@ -0,0 +1,375 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"OpenSeaDataDownloader/utils"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MatchStrategyOrderHash = "order_hash"
+	MatchStrategyAmount    = "amount"
+	MatchStrategyBid       = "bid"
+
+	// DefaultMatchTolerance is the relative difference allowed between the
+	// amounts of a sale and of the order it filled
+	DefaultMatchTolerance = 0.001
+)
+
+var MatchStrategies = []string{MatchStrategyOrderHash, MatchStrategyAmount, MatchStrategyBid}
+
+// OperationMatch links a SELL to the LIST or BID it filled. Confidence goes
+// from 1 for an order hash match down to 0.6 for a bid at the tolerance
+// limit.
+type OperationMatch struct {
+	Sale       *SecondMarketOperation
+	Order      *SecondMarketOperation
+	Strategy   string
+	Confidence float64
+	Reason     string
+}
+
+// UnmatchedSale is a SELL matched to no order, with the reason why.
+type UnmatchedSale struct {
+	Sale   *SecondMarketOperation
+	Reason string
+}
+
+func operationCurrency(op *SecondMarketOperation) string {
+	if op.PaymentCanonicalCurrency != "" {
+		return op.PaymentCanonicalCurrency
+	}
+	return helpers.CanonicalCurrency(op.PaymentBlockchain, op.PaymentToken, op.PaymentCurrency)
+}
+
+// amountsDifference returns the difference between two amounts relative to
+// the first one.
+func amountsDifference(amount, other float64) float64 {
+	if amount == 0 {
+		if other == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return math.Abs(amount-other) / math.Abs(amount)
+}
+
+// operationDataField returns a field of the raw payload of an operation,
+// following a path of keys through the documents decoded from the database.
+func operationDataField(data any, path ...string) any {
+	value := data
+	for _, key := range path {
+		switch document := value.(type) {
+		case bson.D:
+			value = nil
+			for _, element := range document {
+				if element.Key == key {
+					value = element.Value
+					break
+				}
+			}
+		case bson.M:
+			value = document[key]
+		case map[string]any:
+			value = document[key]
+		case *Operation:
+			if key == "start_date" {
+				value = document.StartDate
+			} else if key == "expiration_date" {
+				value = document.ExpirationDate
+			} else {
+				value = nil
+			}
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+func operationDataDate(data any, path ...string) *time.Time {
+	switch value := operationDataField(data, path...).(type) {
+	case time.Time:
+		return &value
+	case *time.Time:
+		return value
+	case primitive.DateTime:
+		date := value.Time().UTC()
+		return &date
+	}
+	return nil
+}
+
+// OperationExpirationDate returns the expiration date of a LIST or a BID,
+// given in the legacy OpenSea data only.
+func OperationExpirationDate(op *SecondMarketOperation) *time.Time {
+	return operationDataDate(op.Data, "opensea", "expiration_date")
+}
+
+// OperationStartDate returns the date a LIST or a BID becomes valid, given in
+// the legacy OpenSea data only.
+func OperationStartDate(op *SecondMarketOperation) *time.Time {
+	return operationDataDate(op.Data, "opensea", "start_date")
+}
+
+// orderLiveAt tells whether an order was placed before a date and had not
+// expired at it.
+func orderLiveAt(order *SecondMarketOperation, date time.Time) bool {
+	if order.Date == nil || order.Date.After(date) {
+		return false
+	}
+	expirationDate := OperationExpirationDate(order)
+	return expirationDate == nil || !expirationDate.Before(date)
+}
+
+type saleMatcher struct {
+	operations []*SecondMarketOperation
+	tolerance  float64
+	matched    map[*SecondMarketOperation]bool
+}
+
+func (m *saleMatcher) matchOrderHash(sale *SecondMarketOperation) *OperationMatch {
+	for _, order := range m.operations {
+		if m.matched[order] || order.OrderHash == "" || (order.Type != "LIST" && order.Type != "BID") {
+			continue
+		}
+		hashes := []string{sale.OrderHash, sale.SellerOrderHash}
+		if order.Type == "BID" {
+			hashes = []string{sale.OrderHash, sale.BuyerOrderHash}
+		}
+		for _, hash := range hashes {
+			if hash != "" && strings.EqualFold(hash, order.OrderHash) {
+				return &OperationMatch{Sale: sale, Order: order, Strategy: MatchStrategyOrderHash, Confidence: 1,
+					Reason: fmt.Sprintf("%s order hash %s", strings.ToLower(order.Type), utils.ShortenString(order.OrderHash))}
+			}
+		}
+	}
+	return nil
+}
+
+// matchAmount returns the latest live order of the type, made by the maker
+// in the currency of the sale, whose amount is within the tolerance.
+func (m *saleMatcher) matchAmount(sale *SecondMarketOperation, orderType, makerRole, maker, strategy string, maxConfidence float64) *OperationMatch {
+	if maker == "" {
+		return nil
+	}
+	currency := operationCurrency(sale)
+	for i := len(m.operations) - 1; i >= 0; i-- {
+		order := m.operations[i]
+		if m.matched[order] || order.Type != orderType || !orderLiveAt(order, *sale.Date) {
+			continue
+		}
+		if !strings.EqualFold(order.Maker, maker) || operationCurrency(order) != currency {
+			continue
+		}
+		difference := amountsDifference(sale.PaymentAmount, order.PaymentAmount)
+		if difference > m.tolerance {
+			continue
+		}
+		confidence := maxConfidence
+		if m.tolerance > 0 {
+			confidence -= 0.2 * difference / m.tolerance
+		}
+		return &OperationMatch{Sale: sale, Order: order, Strategy: strategy, Confidence: confidence,
+			Reason: fmt.Sprintf("%s by the %s at %g %s (%.2f%% difference)", strings.ToLower(orderType), makerRole, order.PaymentAmount, currency, difference*100)}
+	}
+	return nil
+}
+
+// unmatchedReason explains why a sale matched no order.
+func (m *saleMatcher) unmatchedReason(sale *SecondMarketOperation) string {
+	priorOrders, makerOrders, liveOrders := 0, 0, 0
+	closest := math.Inf(1)
+	for _, order := range m.operations {
+		if (order.Type != "LIST" && order.Type != "BID") || order.Date == nil || order.Date.After(*sale.Date) {
+			continue
+		}
+		priorOrders++
+		if !(order.Type == "LIST" && strings.EqualFold(order.Maker, sale.Seller)) && !(order.Type == "BID" && strings.EqualFold(order.Maker, sale.Buyer)) {
+			continue
+		}
+		makerOrders++
+		if m.matched[order] || !orderLiveAt(order, *sale.Date) {
+			continue
+		}
+		liveOrders++
+		if operationCurrency(order) == operationCurrency(sale) {
+			closest = math.Min(closest, amountsDifference(sale.PaymentAmount, order.PaymentAmount))
+		}
+	}
+	if priorOrders == 0 {
+		return "no prior listing or bid"
+	} else if makerOrders == 0 {
+		return "no listing by the seller nor bid by the buyer"
+	} else if liveOrders == 0 {
+		return "orders of the seller and the buyer already matched or expired"
+	} else if math.IsInf(closest, 1) {
+		return "orders of the seller and the buyer in another currency"
+	}
+	return fmt.Sprintf("closest order amount differs by %.2f%%", closest*100)
+}
+
+// MatchAssetSales matches the sales of an asset, sorted by date, to the LIST
+// or BID they filled: by order hash first, then by amount among the listings
+// of the seller, then by amount among the bids of the buyer. An order fills
+// one sale at most.
+func MatchAssetSales(operations []*SecondMarketOperation, tolerance float64) ([]*OperationMatch, []*UnmatchedSale) {
+	matcher := &saleMatcher{operations: operations, tolerance: tolerance, matched: make(map[*SecondMarketOperation]bool)}
+	matches := make([]*OperationMatch, 0)
+	unmatched := make([]*UnmatchedSale, 0)
+	for _, sale := range operations {
+		if sale.Type != "SELL" || sale.Date == nil {
+			continue
+		}
+		match := matcher.matchOrderHash(sale)
+		if match == nil {
+			match = matcher.matchAmount(sale, "LIST", "seller", sale.Seller, MatchStrategyAmount, 0.9)
+		}
+		if match == nil {
+			match = matcher.matchAmount(sale, "BID", "buyer", sale.Buyer, MatchStrategyBid, 0.8)
+		}
+		if match == nil {
+			unmatched = append(unmatched, &UnmatchedSale{Sale: sale, Reason: matcher.unmatchedReason(sale)})
+			continue
+		}
+		matcher.matched[match.Order] = true
+		matches = append(matches, match)
+	}
+	return matches, unmatched
+}
+
+// MatchingReport counts the sales matched by every strategy.
+type MatchingReport struct {
+	Assets     int
+	Sales      int
+	Strategies map[string]int
+	Unmatched  int
+}
+
+func unmatchedSalesHT() (h []string, t []string) {
+	h = []string{"operation_id", "date", "asset_type", "asset_id", "payment_amount", "payment_currency", "seller", "buyer", "order_hash", "reason"}
+	t = []string{"string", "struct", "string", "string", "float64", "string", "string", "string", "string", "string"}
+	return h, t
+}
+
+// forEachAssetOperations reads the operations of the types sorted by asset
+// contract, asset id then date, and calls fn with the operations of every
+// asset. Token ids are only unique within a contract. Only the operations of
+// one asset are kept in memory.
+func forEachAssetOperations(metaverse, source string, types []string, dbInstance *mongo.Database, fn func(operations []*SecondMarketOperation) error) error {
+	dbCollection := helpers.CollectionInstance(dbInstance, &SecondMarketOperation{})
+	filter := bson.D{{"type", bson.D{{"$in", types}}}}
+	if metaverse != "" {
+		filter = append(filter, bson.E{"metaverse", metaverse})
+	}
+	if source != "" {
+		filter = append(filter, bson.E{"downloaded_from", source})
+	}
+	opts := options.Find().SetSort(bson.D{{"asset_contract", 1}, {"asset_id", 1}, {"date", 1}}).SetAllowDiskUse(true).SetBatchSize(1000)
+	cursor, err := dbCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	assetOperations := make([]*SecondMarketOperation, 0)
+	for cursor.Next(context.Background()) {
+		operation := &SecondMarketOperation{}
+		if err = cursor.Decode(operation); err != nil {
+			return err
+		}
+		if len(assetOperations) > 0 && (assetOperations[0].AssetContract != operation.AssetContract || assetOperations[0].AssetId != operation.AssetId) {
+			if err = fn(assetOperations); err != nil {
+				return err
+			}
+			assetOperations = make([]*SecondMarketOperation, 0)
+		}
+		assetOperations = append(assetOperations, operation)
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	if len(assetOperations) > 0 {
+		return fn(assetOperations)
+	}
+	return nil
+}
+
+// WriteUnmatchedSales matches the sales asset by asset, reading the
+// operations sorted by asset, and writes the unmatched sales to a CSV file.
+func WriteUnmatchedSales(metaverse, source string, tolerance float64, output string, dbInstance *mongo.Database, loggingPrefix string) (*MatchingReport, error) {
+	headers, types := unmatchedSalesHT()
+	writer, err := utils.NewCsvFileWriter(output, headers, types, utils.DefaultCsvDialect(), utils.DefaultCsvFormat())
+	if err != nil {
+		return nil, err
+	}
+	report := &MatchingReport{Strategies: make(map[string]int)}
+	matchAsset := func(operations []*SecondMarketOperation) error {
+		report.Assets++
+		matches, unmatched := MatchAssetSales(operations, tolerance)
+		report.Sales += len(matches) + len(unmatched)
+		report.Unmatched += len(unmatched)
+		for _, match := range matches {
+			report.Strategies[match.Strategy]++
+		}
+		for _, unmatchedSale := range unmatched {
+			sale := unmatchedSale.Sale
+			values := []any{sale.OperationId, *sale.Date, sale.AssetType, sale.AssetId, sale.PaymentAmount, sale.PaymentCurrency, sale.Seller, sale.Buyer, sale.OrderHash, unmatchedSale.Reason}
+			if e := writer.WriteRow(values); e != nil {
+				return e
+			}
+		}
+		if report.Assets%1000 == 0 {
+			helpers.Logging(loggingPrefix, fmt.Sprintf("%d assets matched, %d unmatched sales...", report.Assets, report.Unmatched))
+		}
+		return nil
+	}
+	err = forEachAssetOperations(metaverse, source, []string{"LIST", "BID", "SELL"}, dbInstance, matchAsset)
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	return report, writer.Close()
+}
+
+func ReportMatching(metaverse, source string, tolerance float64, output string) {
+	loggingPrefix := fmt.Sprintf("SALES MATCHING { %s | %s | %g }", metaverse, source, tolerance)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read currencies...")
+	err = helpers.LoadCurrencyAliases(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Currencies read !!!")
+
+	helpers.Logging(loggingPrefix, "Match sales to listings & bids...")
+	report, err := WriteUnmatchedSales(metaverse, source, tolerance, output, dbInstance, loggingPrefix)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Sales matched [Assets = %d | Sales = %d | Unmatched = %d] !!!", report.Assets, report.Sales, report.Unmatched))
+	for _, strategy := range MatchStrategies {
+		helpers.Logging(loggingPrefix, fmt.Sprintf("%d sales matched by %s", report.Strategies[strategy], strategy))
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Unmatched sales written to %s", output))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
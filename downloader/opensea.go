@@ -6,7 +6,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/big"
 	"os"
 	"slices"
 	"strconv"
@@ -117,18 +116,6 @@ func (o Operation) CollectionName() string {
 	return "opensea_operations"
 }
 
-var decimals = map[int]string{
-	2:  "100",
-	4:  "10000",
-	6:  "1000000",
-	8:  "100000000",
-	10: "10000000000",
-	12: "1000000000000",
-	14: "100000000000000",
-	16: "10000000000000000",
-	18: "1000000000000000000",
-}
-
 func getOpenseaTimestampStart(metaverse string, eventTypes []string, dbInstance *mongo.Database) (int64, error) {
 	lastOperation, err := FindLastRecordedOperation("opensea", metaverse, "", "", eventTypes, dbInstance)
 	if err != nil {
@@ -177,7 +164,7 @@ func formatType(rawType string) string {
 	return ""
 }
 
-func parseOpenseaEvent(event *Event, metaverse, blockchain string, parcelList map[string]*helpers.DecentralandParcel) *SecondMarketOperation {
+func parseOpenseaEvent(event *Event, metaverse, blockchain string) *SecondMarketOperation {
 	operationType := ""
 	if event.EventType == "order" {
 		operationType = event.OrderType
@@ -185,16 +172,31 @@ func parseOpenseaEvent(event *Event, metaverse, blockchain string, parcelList ma
 		operationType = event.EventType
 	}
 	operationType = formatType(event.OrderType)
-	paymentAmount, paymentCurrency, paymentToken, paymentType := 0.0, "", "", ""
+	eventTime := time.UnixMilli(event.EventTimestamp * 1000)
+	paymentAmount, paymentCurrency, paymentToken, paymentType, paymentQuantity := 0.0, "", "", "", ""
+	paymentTokenUnknown := false
 	if event.Payment != nil {
-		bigAmount := new(big.Float)
-		bigAmount, _ = bigAmount.SetString(event.Payment.Quantity)
-		bigDecimalsStr := decimals[event.Payment.Decimals]
-		bigDecimals, _ := new(big.Float).SetString(bigDecimalsStr)
-		bigPayAmount := new(big.Float).Quo(bigAmount, bigDecimals)
-		paymentAmount, _ = bigPayAmount.Float64()
 		paymentCurrency = event.Payment.Symbol
 		paymentToken = event.Payment.TokenAddress
+		paymentQuantity = event.Payment.Quantity
+		// The registry gives the symbol and the decimals, else the ones given
+		// by OpenSea are used, and without decimals the amount is left to the
+		// tokens resolution. Only the tokens missing from the registry are
+		// queued for registration.
+		tokenDecimals := int64(event.Payment.Decimals)
+		token, registered := helpers.ResolveToken(event.Chain, paymentToken)
+		if registered {
+			paymentCurrency = token.Symbols
+			if token.Decimals > 0 {
+				tokenDecimals = token.Decimals
+			}
+		} else {
+			helpers.FlagUnknownToken(event.Chain, paymentToken, event.Payment.Symbol, tokenDecimals, "opensea", eventTime)
+		}
+		paymentTokenUnknown = !registered || tokenDecimals <= 0
+		if tokenDecimals > 0 {
+			paymentAmount, _ = helpers.ScaleTokenAmount(paymentQuantity, tokenDecimals)
+		}
 		if slices.Contains([]string{"ETH", "POL", "MATIC"}, paymentCurrency) {
 			paymentType = paymentCurrency
 		} else {
@@ -253,7 +255,7 @@ func parseOpenseaEvent(event *Event, metaverse, blockchain string, parcelList ma
 	var assetLocX, assetLocY *int
 	var assetUpdatedAt *time.Time
 	if asset.Identifier != "" {
-		parcel, ok := parcelList[asset.Identifier]
+		parcel, ok := helpers.GetDclParcelAt(asset.Identifier, eventTime)
 		if ok {
 			assetLocation = parcel.Id
 			assetLocX = &parcel.X
@@ -264,7 +266,6 @@ func parseOpenseaEvent(event *Event, metaverse, blockchain string, parcelList ma
 			assetUpdatedAt = &tmp
 		}
 	}
-	eventTime := time.UnixMilli(event.EventTimestamp * 1000)
 	assetType := GetAssetType(metaverse, asset.Contract)
 	hashPayload := fmt.Sprintf("%s:%s:%s:%s:%s:%s", metaverse, operationType, eventTime.Format(time.RFC3339Nano), event.OrderHash, from, asset.Identifier)
 	operationId := utils.CreateHash(hashPayload)
@@ -307,43 +308,46 @@ func parseOpenseaEvent(event *Event, metaverse, blockchain string, parcelList ma
 		IsPrivateListing: event.IsPrivateListing,
 	}
 	operation := &SecondMarketOperation{
-		OperationId:       operationId,
-		DownloadedFrom:    "opensea",
-		Type:              operationType,
-		Source:            "OPEN_SEA",
-		Date:              &eventTime,
-		LastUpdatedAt:     &eventTime,
-		Cursor:            strconv.FormatInt(eventTime.UnixMilli(), 10),
-		Reverted:          false,
-		OrderId:           "",
-		OrderHash:         event.OrderHash,
-		TransactionHash:   event.Transaction,
-		TransactionType:   "",
-		Maker:             maker,
-		Taker:             taker,
-		Buyer:             buyer,
-		Seller:            seller,
-		Metaverse:         metaverse,
-		Blockchain:        blockchain,
-		AssetContract:     asset.Contract,
-		AssetType:         assetType,
-		AssetId:           asset.Identifier,
-		AssetLocation:     assetLocation,
-		AssetLocX:         assetLocX,
-		AssetLocY:         assetLocY,
-		AssetValue:        event.Quantity,
-		PaymentBlockchain: event.Chain,
-		PaymentType:       paymentType,
-		PaymentToken:      paymentToken,
-		PaymentCurrency:   paymentCurrency,
-		PaymentAmount:     paymentAmount,
-		PaymentAmountUsd:  0,
-		PaymentCcyPrice:   0,
-		BuyerOrderHash:    "",
-		SellerOrderHash:   "",
-		BlockHash:         "",
-		BlockNumber:       0,
-		LogIndex:          0,
+		OperationId:              operationId,
+		DownloadedFrom:           "opensea",
+		Type:                     operationType,
+		Source:                   "OPEN_SEA",
+		Date:                     &eventTime,
+		LastUpdatedAt:            &eventTime,
+		Cursor:                   strconv.FormatInt(eventTime.UnixMilli(), 10),
+		Reverted:                 false,
+		OrderId:                  "",
+		OrderHash:                event.OrderHash,
+		TransactionHash:          event.Transaction,
+		TransactionType:          "",
+		Maker:                    maker,
+		Taker:                    taker,
+		Buyer:                    buyer,
+		Seller:                   seller,
+		Metaverse:                metaverse,
+		Blockchain:               blockchain,
+		AssetContract:            asset.Contract,
+		AssetType:                assetType,
+		AssetId:                  asset.Identifier,
+		AssetLocation:            assetLocation,
+		AssetLocX:                assetLocX,
+		AssetLocY:                assetLocY,
+		AssetValue:               event.Quantity,
+		PaymentBlockchain:        event.Chain,
+		PaymentType:              paymentType,
+		PaymentToken:             paymentToken,
+		PaymentCurrency:          paymentCurrency,
+		PaymentCanonicalCurrency: helpers.CanonicalCurrency(event.Chain, paymentToken, paymentCurrency),
+		PaymentAmount:            paymentAmount,
+		PaymentQuantity:          paymentQuantity,
+		PaymentTokenUnknown:      paymentTokenUnknown,
+		PaymentAmountUsd:         0,
+		PaymentCcyPrice:          0,
+		BuyerOrderHash:           "",
+		SellerOrderHash:          "",
+		BlockHash:                "",
+		BlockNumber:              0,
+		LogIndex:                 0,
 		Data: map[string]any{
 			"opensea": openseaOp,
 			"rawData": event,
@@ -358,10 +362,6 @@ func OpenseaLaunch(blockchain, metaverse string, eventTypes []string) {
 
 	//maxTimestamp, minTimestamp := 1672531200, 1609459200
 
-	helpers.Logging(loggingPrefix, "Read parcels data...")
-	parcelsList := helpers.ReadDecentralandParcels()
-	helpers.Logging(loggingPrefix, "Read parcels data OK !!!")
-
 	helpers.Logging(loggingPrefix, "Connection to database...")
 	dbInstance, err := helpers.NewDatabaseConnection()
 	if err != nil {
@@ -370,6 +370,21 @@ func OpenseaLaunch(blockchain, metaverse string, eventTypes []string) {
 	defer helpers.CloseDatabaseConnection(dbInstance)
 	helpers.Logging(loggingPrefix, "Connected to database !!!")
 
+	helpers.Logging(loggingPrefix, "Read currencies & parcels data...")
+	err = helpers.LoadDecentralandParcels(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.LoadCurrencyAliases(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.LoadTokenRegistry(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Read currencies & parcels data OK !!!")
+
 	helpers.Logging(loggingPrefix, "Getting first request `before` timestamp...")
 	startTimestamp, err := getOpenseaTimestampStart(metaverse, eventTypes, dbInstance)
 	//if startTimestamp == 0 {
@@ -399,9 +414,12 @@ func OpenseaLaunch(blockchain, metaverse string, eventTypes []string) {
 		} else {
 			operations := make([]*SecondMarketOperation, len(eventsList.AssetEvents))
 			for i, event := range eventsList.AssetEvents {
-				operations[i] = parseOpenseaEvent(event, metaverse, blockchain, parcelsList)
+				operations[i] = parseOpenseaEvent(event, metaverse, blockchain)
 			}
 			err = Save2ndMarketOperations(operations, dbInstance)
+			if err == nil {
+				err = helpers.SaveTokenRegistrations(dbInstance)
+			}
 			if err != nil {
 				loopErr = err
 				helpers.Logging(loggingPrefix, fmt.Sprintf("Error occurred when saving data for request #%d ...", requestCount))
@@ -439,6 +457,10 @@ func OpenseaConvert(blockchain, metaverse string, eventTypes []string) {
 	if err != nil {
 		panic(err)
 	}
+	err = helpers.LoadCurrencyAliases(dbInstance)
+	if err != nil {
+		panic(err)
+	}
 	dbCollection := helpers.CollectionInstance(dbInstance, &Operation{})
 
 	cursor, err := dbCollection.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"date": 1}).SetAllowDiskUse(true))
@@ -478,43 +500,44 @@ func OpenseaConvert(blockchain, metaverse string, eventTypes []string) {
 			buyer = op.ToAddress
 		}
 		cOperations[i] = &SecondMarketOperation{
-			OperationId:       operationId,
-			DownloadedFrom:    "opensea",
-			Type:              formatType(op.Type),
-			Source:            "OPEN_SEA",
-			Date:              &op.Date,
-			LastUpdatedAt:     &op.Date,
-			Cursor:            strconv.FormatInt(op.Date.UnixMilli(), 10),
-			Reverted:          false,
-			OrderId:           "",
-			OrderHash:         op.OrderHash,
-			TransactionHash:   op.TransactionHash,
-			TransactionType:   "",
-			Maker:             op.Maker,
-			Taker:             op.Taker,
-			Buyer:             buyer,
-			Seller:            seller,
-			Metaverse:         metaverse,
-			Blockchain:        blockchain,
-			AssetContract:     op.AssetContract,
-			AssetType:         op.AssetType,
-			AssetId:           op.AssetId,
-			AssetLocation:     op.AssetLocation,
-			AssetLocX:         op.AssetLocX,
-			AssetLocY:         op.AssetLocY,
-			AssetValue:        op.Quantity,
-			PaymentBlockchain: op.Blockchain,
-			PaymentType:       paymentType,
-			PaymentToken:      op.PaymentToken,
-			PaymentCurrency:   op.PaymentCurrency,
-			PaymentAmount:     op.PaymentAmount,
-			PaymentAmountUsd:  0,
-			PaymentCcyPrice:   0,
-			BuyerOrderHash:    "",
-			SellerOrderHash:   "",
-			BlockHash:         "",
-			BlockNumber:       0,
-			LogIndex:          0,
+			OperationId:              operationId,
+			DownloadedFrom:           "opensea",
+			Type:                     formatType(op.Type),
+			Source:                   "OPEN_SEA",
+			Date:                     &op.Date,
+			LastUpdatedAt:            &op.Date,
+			Cursor:                   strconv.FormatInt(op.Date.UnixMilli(), 10),
+			Reverted:                 false,
+			OrderId:                  "",
+			OrderHash:                op.OrderHash,
+			TransactionHash:          op.TransactionHash,
+			TransactionType:          "",
+			Maker:                    op.Maker,
+			Taker:                    op.Taker,
+			Buyer:                    buyer,
+			Seller:                   seller,
+			Metaverse:                metaverse,
+			Blockchain:               blockchain,
+			AssetContract:            op.AssetContract,
+			AssetType:                op.AssetType,
+			AssetId:                  op.AssetId,
+			AssetLocation:            op.AssetLocation,
+			AssetLocX:                op.AssetLocX,
+			AssetLocY:                op.AssetLocY,
+			AssetValue:               op.Quantity,
+			PaymentBlockchain:        op.Blockchain,
+			PaymentType:              paymentType,
+			PaymentToken:             op.PaymentToken,
+			PaymentCurrency:          op.PaymentCurrency,
+			PaymentCanonicalCurrency: helpers.CanonicalCurrency(op.Blockchain, op.PaymentToken, op.PaymentCurrency),
+			PaymentAmount:            op.PaymentAmount,
+			PaymentAmountUsd:         0,
+			PaymentCcyPrice:          0,
+			BuyerOrderHash:           "",
+			SellerOrderHash:          "",
+			BlockHash:                "",
+			BlockNumber:              0,
+			LogIndex:                 0,
 			Data: map[string]any{
 				"opensea": op,
 			},
@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/utils"
+	"slices"
+	"time"
+)
+
+// SecondMarketOperationColumns returns the exported operation columns and
+// their types; dates are typed "struct".
+func SecondMarketOperationColumns(exclude []string) (h []string, t []string) {
+	return utils.GetStructToMapHT(&SecondMarketOperation{}, exclude)
+}
+
+func timeRowValue(value *time.Time) any {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
+
+func intRowValue(value *int) any {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
+
+// ExportRow returns the exported values of the operation, keyed by column.
+// Pointer fields are dereferenced, and nil pointers give nil values.
+func (o *SecondMarketOperation) ExportRow(exclude []string) map[string]any {
+	row := map[string]any{
+		"operation_id":               o.OperationId,
+		"downloaded_from":            o.DownloadedFrom,
+		"type":                       o.Type,
+		"source":                     o.Source,
+		"last_updated_at":            timeRowValue(o.LastUpdatedAt),
+		"date":                       timeRowValue(o.Date),
+		"metaverse":                  o.Metaverse,
+		"blockchain":                 o.Blockchain,
+		"cursor":                     o.Cursor,
+		"reverted":                   o.Reverted,
+		"order_id":                   o.OrderId,
+		"order_hash":                 o.OrderHash,
+		"transaction_hash":           o.TransactionHash,
+		"transaction_type":           o.TransactionType,
+		"maker":                      o.Maker,
+		"taker":                      o.Taker,
+		"buyer":                      o.Buyer,
+		"seller":                     o.Seller,
+		"asset_contract":             o.AssetContract,
+		"asset_type":                 o.AssetType,
+		"asset_id":                   o.AssetId,
+		"asset_location":             o.AssetLocation,
+		"asset_loc_x":                intRowValue(o.AssetLocX),
+		"asset_loc_y":                intRowValue(o.AssetLocY),
+		"asset_value":                o.AssetValue,
+		"payment_blockchain":         o.PaymentBlockchain,
+		"payment_type":               o.PaymentType,
+		"payment_token":              o.PaymentToken,
+		"payment_currency":           o.PaymentCurrency,
+		"payment_canonical_currency": o.PaymentCanonicalCurrency,
+		"payment_amount":             o.PaymentAmount,
+		"payment_quantity":           o.PaymentQuantity,
+		"payment_token_unknown":      o.PaymentTokenUnknown,
+		"payment_amount_usd":         o.PaymentAmountUsd,
+		"payment_amounts":            o.PaymentAmounts,
+		"payment_ccy_price":          o.PaymentCcyPrice,
+		"payment_price_quality":      o.PaymentPriceQuality,
+		"payment_price_method":       o.PaymentPriceMethod,
+		"payment_price_date":         timeRowValue(o.PaymentPriceDate),
+		"buyer_order_hash":           o.BuyerOrderHash,
+		"seller_order_hash":          o.SellerOrderHash,
+		"block_hash":                 o.BlockHash,
+		"block_number":               o.BlockNumber,
+		"log_index":                  o.LogIndex,
+		"tx_sender":                  o.TxSender,
+		"tx_gas_used":                o.TxGasUsed,
+		"tx_gas_price":               o.TxGasPrice,
+		"tx_cost":                    o.TxCost,
+		"tx_cost_currency":           o.TxCostCurrency,
+		"tx_cost_usd":                o.TxCostUsd,
+		"marketplace_fee":            o.MarketplaceFee,
+		"creator_fee":                o.CreatorFee,
+		"seller_proceeds":            o.SellerProceeds,
+		"net_proceeds":               o.NetProceeds,
+		"net_proceeds_usd":           o.NetProceedsUsd,
+		"fees_status":                o.FeesStatus,
+	}
+	if !slices.Contains(exclude, "data") {
+		row["data"] = plainDataValue(o.Data)
+	}
+	for _, column := range exclude {
+		delete(row, column)
+	}
+	return row
+}
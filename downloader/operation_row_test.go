@@ -0,0 +1,189 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/utils"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+func goldenOperations() []*SecondMarketOperation {
+	date := time.Date(2022, 3, 14, 15, 9, 26, 0, time.UTC)
+	lastUpdatedAt := time.Date(2022, 3, 15, 8, 0, 0, 0, time.UTC)
+	priceDate := time.Date(2022, 3, 14, 0, 0, 0, 0, time.UTC)
+	locX, locY := -12, 0
+	return []*SecondMarketOperation{
+		{
+			OperationId:              "0xabc:1",
+			DownloadedFrom:           "OPEN_SEA",
+			Type:                     "SELL",
+			Source:                   "OPEN_SEA",
+			LastUpdatedAt:            &lastUpdatedAt,
+			Date:                     &date,
+			Metaverse:                "decentraland",
+			Blockchain:               "ETHEREUM",
+			Cursor:                   "cursor-1",
+			Reverted:                 true,
+			OrderId:                  "order-1",
+			OrderHash:                "0xorder",
+			TransactionHash:          "0xtx",
+			TransactionType:          "SALE",
+			Maker:                    "0xmaker",
+			Taker:                    "0xtaker",
+			Buyer:                    "0xbuyer",
+			Seller:                   "0xseller",
+			AssetContract:            "0xf87e31492faf9a91b02ee0deaad50d51d56d5d4d",
+			AssetType:                "land",
+			AssetId:                  "115792089237316195423570985008687907840",
+			AssetLocation:            "-12,0",
+			AssetLocX:                &locX,
+			AssetLocY:                &locY,
+			AssetValue:               1,
+			PaymentBlockchain:        "ETHEREUM",
+			PaymentType:              "ERC20",
+			PaymentToken:             "0x0f5d2fb29fb7d3cfee444a200298f468908cc942",
+			PaymentCurrency:          "MANA",
+			PaymentCanonicalCurrency: "MANA",
+			PaymentAmount:            12500.5,
+			PaymentQuantity:          "12500500000000000000000",
+			PaymentAmountUsd:         31251.25,
+			PaymentAmounts:           map[string]float64{"ETH": 12.5},
+			PaymentCcyPrice:          2.5,
+			PaymentPriceQuality:      "exact",
+			PaymentPriceMethod:       "typical",
+			PaymentPriceDate:         &priceDate,
+			BuyerOrderHash:           "0xbuyerorder",
+			SellerOrderHash:          "0xsellerorder",
+			BlockHash:                "0xblock",
+			BlockNumber:              14380000,
+			LogIndex:                 42,
+			TxSender:                 "0xbuyer",
+			TxGasUsed:                200000,
+			TxGasPrice:               20,
+			TxCost:                   0.004,
+			TxCostCurrency:           "ETH",
+			TxCostUsd:                10.4,
+			MarketplaceFee:           312.5125,
+			CreatorFee:               312.5125,
+			SellerProceeds:           11875.475,
+			NetProceeds:              11875.475,
+			NetProceedsUsd:           29688.6875,
+			FeesStatus:               "decoded",
+			Data:                     bson.D{{"price", "12500500000000000000000"}, {"fees", bson.A{int32(250), nil}}},
+		},
+		{
+			OperationId:    "list-2",
+			DownloadedFrom: "RARIBLE",
+			Type:           "LIST",
+			Source:         "RARIBLE",
+			Date:           &date,
+			Metaverse:      "decentraland",
+			AssetType:      "estate",
+			AssetId:        "42",
+		},
+	}
+}
+
+func writeGoldenRows(t *testing.T, writer ExportWriter, headers []string, operations []*SecondMarketOperation, exclude []string) {
+	t.Helper()
+	for _, operation := range operations {
+		row := operation.ExportRow(exclude)
+		values := make([]any, len(headers))
+		for i, header := range headers {
+			values[i] = row[header]
+		}
+		if err := writer.WriteRow(values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func compareGolden(t *testing.T, outputPath, goldenPath string) {
+	t.Helper()
+	output, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *updateGolden {
+		if err = os.WriteFile(goldenPath, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != string(golden) {
+		t.Errorf("%s differs from %s:\n%s", outputPath, goldenPath, output)
+	}
+}
+
+func TestExportRowCoversEveryColumn(t *testing.T) {
+	headers, _ := SecondMarketOperationColumns(nil)
+	for _, operation := range goldenOperations() {
+		row := operation.ExportRow(nil)
+		if len(row) != len(headers) {
+			t.Errorf("row has %d values for %d columns", len(row), len(headers))
+		}
+		for _, header := range headers {
+			if _, ok := row[header]; !ok {
+				t.Errorf("column %s is missing from the row", header)
+			}
+		}
+	}
+}
+
+func TestExportRowNilPointers(t *testing.T) {
+	row := goldenOperations()[1].ExportRow(nil)
+	for _, column := range []string{"last_updated_at", "asset_loc_x", "asset_loc_y", "payment_price_date", "data"} {
+		if row[column] != nil {
+			t.Errorf("column %s is %v instead of nil", column, row[column])
+		}
+	}
+	if _, ok := row["date"].(time.Time); !ok {
+		t.Errorf("column date is %T instead of time.Time", row["date"])
+	}
+}
+
+func TestExportRowExclude(t *testing.T) {
+	exclude := []string{"cursor", "reverted", "data"}
+	row := goldenOperations()[0].ExportRow(exclude)
+	for column := range row {
+		if slices.Contains(exclude, column) {
+			t.Errorf("excluded column %s is in the row", column)
+		}
+	}
+}
+
+func TestExportRowCsvGolden(t *testing.T) {
+	exclude := []string{"cursor", "reverted", "payment_amounts", "data"}
+	headers, types := SecondMarketOperationColumns(exclude)
+	outputPath := filepath.Join(t.TempDir(), "operations.csv")
+	writer, err := utils.NewCsvFileWriter(outputPath, headers, types, utils.DefaultCsvDialect(), utils.DefaultCsvFormat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeGoldenRows(t, writer, headers, goldenOperations(), exclude)
+	compareGolden(t, outputPath, filepath.Join("testdata", "operation_rows.golden.csv"))
+}
+
+func TestExportRowJsonLinesGolden(t *testing.T) {
+	headers, _ := SecondMarketOperationColumns(nil)
+	outputPath := filepath.Join(t.TempDir(), "operations.jsonl")
+	writer, err := utils.NewJsonLinesFileWriter(outputPath, headers, make([]string, len(headers)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeGoldenRows(t, writer, headers, goldenOperations(), nil)
+	compareGolden(t, outputPath, filepath.Join("testdata", "operation_rows.golden.jsonl"))
+}
@@ -17,57 +17,91 @@ import (
 )
 
 type SecondMarketOperation struct {
-	mgm.DefaultModel  `bson:",inline"`
-	OperationId       string     `bson:"operation_id" json:"operation_id" mapstructure:"operation_id"`
-	DownloadedFrom    string     `bson:"downloaded_from" json:"downloaded_from" mapstructure:"downloaded_from"`
-	Type              string     `bson:"type" json:"type" mapstructure:"type"`
-	Source            string     `bson:"source" json:"source" mapstructure:"source"`
-	LastUpdatedAt     *time.Time `bson:"last_updated_at,omitempty" json:"last_updated_at" mapstructure:"last_updated_at"`
-	Date              *time.Time `bson:"date" json:"date" mapstructure:"date"`
-	Metaverse         string     `bson:"metaverse,omitempty" json:"metaverse" mapstructure:"metaverse"`
-	Blockchain        string     `bson:"blockchain,omitempty" json:"blockchain" mapstructure:"blockchain"`
-	Cursor            string     `bson:"cursor,omitempty" json:"cursor" mapstructure:"cursor"`
-	Reverted          bool       `bson:"reverted,omitempty" json:"reverted" mapstructure:"reverted"`
-	OrderId           string     `bson:"order_id,omitempty" json:"order_id" mapstructure:"order_id"`
-	OrderHash         string     `bson:"order_hash,omitempty" json:"order_hash" mapstructure:"order_hash"`
-	TransactionHash   string     `bson:"transaction_hash,omitempty" json:"transaction_hash" mapstructure:"transaction_hash"`
-	TransactionType   string     `bson:"transaction_type,omitempty" json:"transaction_type" mapstructure:"transaction_type"`
-	Maker             string     `bson:"maker,omitempty" json:"maker" mapstructure:"maker"`
-	Taker             string     `bson:"taker,omitempty" json:"taker" mapstructure:"taker"`
-	Buyer             string     `bson:"buyer,omitempty" json:"buyer" mapstructure:"buyer"`
-	Seller            string     `bson:"seller,omitempty" json:"seller" mapstructure:"seller"`
-	AssetContract     string     `bson:"asset_contract,omitempty" json:"asset_contract" mapstructure:"asset_contract"`
-	AssetType         string     `bson:"asset_type,omitempty" json:"asset_type" mapstructure:"asset_type"`
-	AssetId           string     `bson:"asset_id,omitempty" json:"asset_id" mapstructure:"asset_id"`
-	AssetLocation     string     `bson:"asset_location,omitempty" json:"asset_location" mapstructure:"asset_location"`
-	AssetLocX         *int       `bson:"asset_loc_x" json:"asset_loc_x" mapstructure:"asset_loc_x"`
-	AssetLocY         *int       `bson:"asset_loc_y" json:"asset_loc_y" mapstructure:"asset_loc_y"`
-	AssetValue        int        `bson:"asset_value,omitempty" json:"asset_value" mapstructure:"asset_value"`
-	PaymentBlockchain string     `bson:"payment_blockchain,omitempty" json:"payment_blockchain" mapstructure:"payment_blockchain"`
-	PaymentType       string     `bson:"payment_type,omitempty" json:"payment_type" mapstructure:"payment_type"`
-	PaymentToken      string     `bson:"payment_token,omitempty" json:"payment_token" mapstructure:"payment_token"`
-	PaymentCurrency   string     `bson:"payment_currency,omitempty" json:"payment_currency" mapstructure:"payment_currency"`
-	PaymentAmount     float64    `bson:"payment_amount,omitempty" json:"payment_amount" mapstructure:"operation_id"`
-	PaymentAmountUsd  float64    `bson:"payment_amount_usd,omitempty" json:"payment_amount_usd" mapstructure:"payment_amount_usd"`
-	PaymentCcyPrice   float64    `bson:"payment_ccy_price,omitempty" json:"payment_ccy_price" mapstructure:"payment_ccy_price"`
-	BuyerOrderHash    string     `bson:"buyer_order_hash,omitempty" json:"buyer_order_hash" mapstructure:"buyer_order_hash"`
-	SellerOrderHash   string     `bson:"seller_order_hash,omitempty" json:"seller_order_hash" mapstructure:"seller_order_hash"`
-	BlockHash         string     `bson:"block_hash,omitempty" json:"block_hash" mapstructure:"block_hash"`
-	BlockNumber       int64      `bson:"block_number,omitempty" json:"block_number" mapstructure:"block_number"`
-	LogIndex          int64      `bson:"log_index,omitempty" json:"log_index" mapstructure:"log_index"`
-	Data              any        `bson:"data" json:"data" mapstructure:"data"`
+	mgm.DefaultModel         `bson:",inline"`
+	OperationId              string             `bson:"operation_id" json:"operation_id" mapstructure:"operation_id"`
+	DownloadedFrom           string             `bson:"downloaded_from" json:"downloaded_from" mapstructure:"downloaded_from"`
+	Type                     string             `bson:"type" json:"type" mapstructure:"type"`
+	Source                   string             `bson:"source" json:"source" mapstructure:"source"`
+	LastUpdatedAt            *time.Time         `bson:"last_updated_at,omitempty" json:"last_updated_at" mapstructure:"last_updated_at"`
+	Date                     *time.Time         `bson:"date" json:"date" mapstructure:"date"`
+	Metaverse                string             `bson:"metaverse,omitempty" json:"metaverse" mapstructure:"metaverse"`
+	Blockchain               string             `bson:"blockchain,omitempty" json:"blockchain" mapstructure:"blockchain"`
+	Cursor                   string             `bson:"cursor,omitempty" json:"cursor" mapstructure:"cursor"`
+	Reverted                 bool               `bson:"reverted,omitempty" json:"reverted" mapstructure:"reverted"`
+	OrderId                  string             `bson:"order_id,omitempty" json:"order_id" mapstructure:"order_id"`
+	OrderHash                string             `bson:"order_hash,omitempty" json:"order_hash" mapstructure:"order_hash"`
+	TransactionHash          string             `bson:"transaction_hash,omitempty" json:"transaction_hash" mapstructure:"transaction_hash"`
+	TransactionType          string             `bson:"transaction_type,omitempty" json:"transaction_type" mapstructure:"transaction_type"`
+	Maker                    string             `bson:"maker,omitempty" json:"maker" mapstructure:"maker"`
+	Taker                    string             `bson:"taker,omitempty" json:"taker" mapstructure:"taker"`
+	Buyer                    string             `bson:"buyer,omitempty" json:"buyer" mapstructure:"buyer"`
+	Seller                   string             `bson:"seller,omitempty" json:"seller" mapstructure:"seller"`
+	AssetContract            string             `bson:"asset_contract,omitempty" json:"asset_contract" mapstructure:"asset_contract"`
+	AssetType                string             `bson:"asset_type,omitempty" json:"asset_type" mapstructure:"asset_type"`
+	AssetId                  string             `bson:"asset_id,omitempty" json:"asset_id" mapstructure:"asset_id"`
+	AssetLocation            string             `bson:"asset_location,omitempty" json:"asset_location" mapstructure:"asset_location"`
+	AssetLocX                *int               `bson:"asset_loc_x" json:"asset_loc_x" mapstructure:"asset_loc_x"`
+	AssetLocY                *int               `bson:"asset_loc_y" json:"asset_loc_y" mapstructure:"asset_loc_y"`
+	AssetValue               int                `bson:"asset_value,omitempty" json:"asset_value" mapstructure:"asset_value"`
+	PaymentBlockchain        string             `bson:"payment_blockchain,omitempty" json:"payment_blockchain" mapstructure:"payment_blockchain"`
+	PaymentType              string             `bson:"payment_type,omitempty" json:"payment_type" mapstructure:"payment_type"`
+	PaymentToken             string             `bson:"payment_token,omitempty" json:"payment_token" mapstructure:"payment_token"`
+	PaymentCurrency          string             `bson:"payment_currency,omitempty" json:"payment_currency" mapstructure:"payment_currency"`
+	PaymentCanonicalCurrency string             `bson:"payment_canonical_currency,omitempty" json:"payment_canonical_currency" mapstructure:"payment_canonical_currency"`
+	PaymentAmount            float64            `bson:"payment_amount,omitempty" json:"payment_amount" mapstructure:"operation_id"`
+	PaymentQuantity          string             `bson:"payment_quantity,omitempty" json:"payment_quantity" mapstructure:"payment_quantity"`
+	PaymentTokenUnknown      bool               `bson:"payment_token_unknown,omitempty" json:"payment_token_unknown" mapstructure:"payment_token_unknown"`
+	PaymentAmountUsd         float64            `bson:"payment_amount_usd,omitempty" json:"payment_amount_usd" mapstructure:"payment_amount_usd"`
+	PaymentAmounts           map[string]float64 `bson:"payment_amounts,omitempty" json:"payment_amounts" mapstructure:"payment_amounts"`
+	PaymentCcyPrice          float64            `bson:"payment_ccy_price,omitempty" json:"payment_ccy_price" mapstructure:"payment_ccy_price"`
+	PaymentPriceQuality      string             `bson:"payment_price_quality,omitempty" json:"payment_price_quality" mapstructure:"payment_price_quality"`
+	PaymentPriceMethod       string             `bson:"payment_price_method,omitempty" json:"payment_price_method" mapstructure:"payment_price_method"`
+	PaymentPriceDate         *time.Time         `bson:"payment_price_date,omitempty" json:"payment_price_date" mapstructure:"payment_price_date"`
+	BuyerOrderHash           string             `bson:"buyer_order_hash,omitempty" json:"buyer_order_hash" mapstructure:"buyer_order_hash"`
+	SellerOrderHash          string             `bson:"seller_order_hash,omitempty" json:"seller_order_hash" mapstructure:"seller_order_hash"`
+	BlockHash                string             `bson:"block_hash,omitempty" json:"block_hash" mapstructure:"block_hash"`
+	BlockNumber              int64              `bson:"block_number,omitempty" json:"block_number" mapstructure:"block_number"`
+	LogIndex                 int64              `bson:"log_index,omitempty" json:"log_index" mapstructure:"log_index"`
+	TxSender                 string             `bson:"tx_sender,omitempty" json:"tx_sender" mapstructure:"tx_sender"`
+	TxGasUsed                int64              `bson:"tx_gas_used,omitempty" json:"tx_gas_used" mapstructure:"tx_gas_used"`
+	TxGasPrice               float64            `bson:"tx_gas_price,omitempty" json:"tx_gas_price" mapstructure:"tx_gas_price"`
+	TxCost                   float64            `bson:"tx_cost,omitempty" json:"tx_cost" mapstructure:"tx_cost"`
+	TxCostCurrency           string             `bson:"tx_cost_currency,omitempty" json:"tx_cost_currency" mapstructure:"tx_cost_currency"`
+	TxCostUsd                float64            `bson:"tx_cost_usd,omitempty" json:"tx_cost_usd" mapstructure:"tx_cost_usd"`
+	MarketplaceFee           float64            `bson:"marketplace_fee,omitempty" json:"marketplace_fee" mapstructure:"marketplace_fee"`
+	CreatorFee               float64            `bson:"creator_fee,omitempty" json:"creator_fee" mapstructure:"creator_fee"`
+	SellerProceeds           float64            `bson:"seller_proceeds,omitempty" json:"seller_proceeds" mapstructure:"seller_proceeds"`
+	NetProceeds              float64            `bson:"net_proceeds,omitempty" json:"net_proceeds" mapstructure:"net_proceeds"`
+	NetProceedsUsd           float64            `bson:"net_proceeds_usd,omitempty" json:"net_proceeds_usd" mapstructure:"net_proceeds_usd"`
+	FeesStatus               string             `bson:"fees_status,omitempty" json:"fees_status" mapstructure:"fees_status"`
+	Data                     any                `bson:"data" json:"data" mapstructure:"data"`
+}
+
+// SecondMarketAsset identifies an asset: token ids are only unique within a
+// contract, and the same sale is downloaded once per metaverse and source.
+type SecondMarketAsset struct {
+	AssetContract  string `bson:"asset_contract" json:"asset_contract"`
+	AssetId        string `bson:"asset_id" json:"asset_id"`
+	Metaverse      string `bson:"metaverse" json:"metaverse"`
+	DownloadedFrom string `bson:"downloaded_from" json:"downloaded_from"`
 }
 
 type SecondMarketOperationPerAsset struct {
-	Asset      string                   `bson:"_id" json:"_id"`
+	Asset      SecondMarketAsset        `bson:"_id" json:"_id"`
 	Count      int64                    `bson:"count" json:"count"`
 	Operations []*SecondMarketOperation `bson:"operations" json:"operations"`
 }
 
 type SecondMarketOperationExport struct {
-	Operations []map[string]any
-	ColNames   []string
-	ColTypes   []string
+	ColNames          []string
+	ColTypes          []string
+	ColDescriptions   []string
+	ColUnits          []string
+	RowsCount         int
+	LastOperationDate *time.Time
+	LastOperationIds  []string
+	LastUpdatedAt     *time.Time
+	Partitions        []*ExportPartition
 }
 
 func (o SecondMarketOperation) CollectionName() string {
@@ -103,7 +137,10 @@ func Save2ndMarketOperations(operations []*SecondMarketOperation, dbInstance *mo
 		dbCollection := helpers.CollectionInstance(dbInstance, &SecondMarketOperation{})
 
 		dbRequests := make([]mongo.WriteModel, len(operations))
+		updatedAt := time.Now().UTC()
 		for i, operation := range operations {
+			// Replacements skip mgm hooks: updated_at is what incremental exports rely on
+			operation.UpdatedAt = updatedAt
 			var filterPayload = bson.M{"operation_id": operation.OperationId, "type": operation.Type, "source": operation.Source, "date": operation.Date}
 			dbRequests[i] = mongo.NewReplaceOneModel().SetFilter(filterPayload).SetReplacement(operation).SetUpsert(true)
 		}
@@ -113,6 +150,52 @@ func Save2ndMarketOperations(operations []*SecondMarketOperation, dbInstance *mo
 	return nil
 }
 
+// priceOperation sets the USD amount of an operation from the prices of its
+// canonical currency, with the current price method. It returns false if the
+// currency has no price.
+func priceOperation(op *SecondMarketOperation) bool {
+	if op.Date == nil {
+		return false
+	}
+	if op.PaymentCanonicalCurrency == "" {
+		op.PaymentCanonicalCurrency = helpers.CanonicalCurrency(op.PaymentBlockchain, op.PaymentToken, op.PaymentCurrency)
+	}
+	quote, ok := helpers.LookupCurrencyPrice(op.PaymentCanonicalCurrency, *op.Date)
+	if !ok {
+		return false
+	}
+	op.PaymentCcyPrice = quote.Price
+	bfAmtUsd := new(big.Float).Mul(new(big.Float).SetFloat64(quote.Price), new(big.Float).SetFloat64(op.PaymentAmount))
+	op.PaymentAmountUsd, _ = bfAmtUsd.Float64()
+	op.PaymentPriceQuality = quote.Quality
+	op.PaymentPriceMethod = quote.Method
+	op.PaymentPriceDate = &quote.Date
+	return true
+}
+
+// operationNumeraireAmount converts the payment amount of an operation into a
+// numeraire. An operation paid in the numeraire (or in an alias of it) keeps
+// its amount, a priced one is converted from its USD amount, and otherwise
+// from its canonical currency.
+func operationNumeraireAmount(op *SecondMarketOperation, numeraire string) (float64, bool) {
+	if op.Date == nil || op.PaymentAmount == 0 {
+		return 0, false
+	}
+	currency := op.PaymentCanonicalCurrency
+	if currency == "" {
+		currency = helpers.CanonicalCurrency(op.PaymentBlockchain, op.PaymentToken, op.PaymentCurrency)
+	}
+	if helpers.CanonicalCurrency("", "", numeraire) == currency {
+		return op.PaymentAmount, true
+	}
+	if op.PaymentAmountUsd != 0 {
+		value, _, ok := helpers.ConvertCurrencyAmount(op.PaymentAmountUsd, helpers.UsdNumeraire, numeraire, *op.Date)
+		return value, ok
+	}
+	value, _, ok := helpers.ConvertCurrencyAmount(op.PaymentAmount, currency, numeraire, *op.Date)
+	return value, ok
+}
+
 func GetAssetType(metaverse string, contractId string) string {
 	assetType := ""
 	if metaverse == "decentraland" {
@@ -138,17 +221,6 @@ func GetOperations(metaverse, source string, dbInstance *mongo.Database) ([]*Sec
 	return operations, err
 }
 
-func sortOperationFunc(a, b map[string]any) int {
-	aDate, _ := a["date"].(time.Time)
-	bDate, _ := b["date"].(time.Time)
-	if aDate.UnixMilli() < bDate.UnixMilli() {
-		return -1
-	} else if aDate.UnixMilli() > bDate.UnixMilli() {
-		return 1
-	}
-	return 0
-}
-
 func sort2MOperationFunc(a, b *SecondMarketOperation) int {
 	if a.Date.UnixMilli() < b.Date.UnixMilli() {
 		return -1
@@ -158,298 +230,301 @@ func sort2MOperationFunc(a, b *SecondMarketOperation) int {
 	return 0
 }
 
-func filterGetPreviousListingOrBid(prevType string, o *SecondMarketOperation, opList []*SecondMarketOperation) int {
-	for i := len(opList) - 1; i >= 0; i-- {
-		diff := new(big.Float).Sub(new(big.Float).SetFloat64(o.PaymentAmount), new(big.Float).SetFloat64(opList[i].PaymentAmount))
-		diff = new(big.Float).Abs(diff)
-		diffCmp := diff.Cmp(new(big.Float).SetFloat64(0.0))
-		sameAsset := opList[i].AssetId == o.AssetId
-		sameAmount := diffCmp == 0
-		goodCcy := opList[i].PaymentCurrency == o.PaymentCurrency
-		sameMaker := false
-		if prevType == "LIST" {
-			sameMaker = opList[i].Maker == o.Seller
-		} else if prevType == "BID" {
-			sameMaker = opList[i].Maker == o.Buyer
-		}
-		if sameAsset && sameMaker && goodCcy && sameAmount {
-			return i
-		}
-	}
-	return -1
-}
-
-func findExportedOpIndex(target map[string]any, toFind string) bool {
-	targetId, _ := target["operation_id"].(string)
-	return targetId == toFind
-}
-
 func initializeExportOpAddInfo() (m map[string]interface{}) {
 	m = map[string]interface{}{
-		"related_to":      "",
-		"rt_date":         "",
-		"rt_time_diff":    nil,
-		"rt_operation_id": "",
+		"related_to":        "",
+		"rt_date":           "",
+		"rt_time_diff":      nil,
+		"rt_operation_id":   "",
+		"rt_match_strategy": "",
+		"rt_confidence":     nil,
+		"rt_reason":         "",
 	}
 	return m
 }
 
 func initializeExportOpAddInfoHT() (h []string, t []string) {
-	h = []string{"related_to", "rt_date", "rt_time_diff", "rt_operation_id"}
-	t = []string{"string", "string", "float64", "string"}
+	h = []string{"related_to", "rt_date", "rt_time_diff", "rt_operation_id", "rt_match_strategy", "rt_confidence", "rt_reason"}
+	t = []string{"string", "struct", "float64", "string", "string", "float64", "string"}
 	return h, t
 }
 
-func populateExportOpAddInfo(m *map[string]interface{}, relatedTo string, rtDate *time.Time, rtTimeDiff float64, rtOperationId string) {
+func populateExportOpAddInfo(m *map[string]interface{}, relatedTo string, rtDate *time.Time, rtTimeDiff float64, rtOperationId string, match *OperationMatch) {
 	(*m)["related_to"] = relatedTo
 	(*m)["rt_date"] = rtDate
 	(*m)["rt_time_diff"] = rtTimeDiff
 	(*m)["rt_operation_id"] = rtOperationId
+	(*m)["rt_match_strategy"] = match.Strategy
+	(*m)["rt_confidence"] = match.Confidence
+	(*m)["rt_reason"] = match.Reason
 }
 
-func GetOperationsForExport(metaverse, source, metric string, longFields []string, dbInstance *mongo.Database, loggingPrefix string) (*SecondMarketOperationExport, error) {
-	validTypes := []string{"LIST", "SELL"}
+// WriteOperationsForExport computes the exported rows asset by asset while
+// reading them from the database, and writes them sorted by date asc. Only
+// the operations of one asset and a bounded sort buffer are kept in memory.
+func WriteOperationsForExport(metaverse, source, metric string, spec *ExportSpec, longFields []string, dbInstance *mongo.Database, loggingPrefix string) (*SecondMarketOperationExport, error) {
 	/*
 		Step 1 : Pipeline to get data from database
 	*/
-	dbLoggingPrefix := loggingPrefix + " [" + "GetOperationsForExport" + "]"
+	dbLoggingPrefix := loggingPrefix + " [" + "WriteOperationsForExport" + "]"
 	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Fetch data from database..."))
 	dbCollection := helpers.CollectionInstance(dbInstance, &SecondMarketOperation{})
 	filter1Stage := bson.D{
-		{"$match", bson.D{{"metaverse", metaverse}, {"downloaded_from", source}}},
-	}
-	filter2Stage := bson.D{
-		{"$match", bson.D{{"type", bson.D{{"$in", validTypes}}}}},
+		{"$match", spec.operationsFilter(metaverse, source)},
 	}
 	distinctAssetsStage := bson.D{
 		{"$group", bson.D{
-			{"_id", "$asset_id"},
+			{"_id", bson.D{
+				{"asset_contract", "$asset_contract"}, {"asset_id", "$asset_id"},
+				{"metaverse", "$metaverse"}, {"downloaded_from", "$downloaded_from"},
+			}},
 			{"count", bson.D{{"$sum", 1}}},
 		}},
 	}
 	joinOperationsStage := bson.D{
 		{"$lookup", bson.D{
-			{"from", "second_market_operations"}, {"localField", "_id"},
-			{"foreignField", "asset_id"}, {"as", "operations"},
-		}},
-	}
-	_ = bson.D{
-		{"$unwind", bson.D{
-			{"path", "$operations"}, {"preserveNullAndEmptyArrays", true},
-		}},
-	}
-	_ = bson.D{
-		{"$match", bson.D{{"operations.type", bson.D{{"$nin", []string{"BID"}}}}}},
-	}
-	_ = bson.D{
-		{"$group", bson.D{
-			{"_id", "$asset_id"},
-			{"count", bson.D{{"$sum", 1}}},
-			{"operations", bson.D{{"$push", "$operations"}}},
+			{"from", "second_market_operations"},
+			{"let", bson.D{
+				{"asset_contract", "$_id.asset_contract"}, {"asset_id", "$_id.asset_id"},
+				{"metaverse", "$_id.metaverse"}, {"downloaded_from", "$_id.downloaded_from"},
+			}},
+			{"pipeline", mongo.Pipeline{
+				{{"$match", bson.D{{"$expr", bson.D{{"$and", bson.A{
+					bson.D{{"$eq", bson.A{"$asset_id", "$$asset_id"}}},
+					bson.D{{"$eq", bson.A{"$asset_contract", "$$asset_contract"}}},
+					bson.D{{"$eq", bson.A{"$metaverse", "$$metaverse"}}},
+					bson.D{{"$eq", bson.A{"$downloaded_from", "$$downloaded_from"}}},
+				}}}}}}},
+			}},
+			{"as", "operations"},
 		}},
 	}
 	sortStage := bson.D{
 		{"$sort", bson.D{
-			{"count", -1},
+			{"count", -1}, {"_id", 1},
 		}},
 	}
-	limitStage := bson.D{
-		{"$limit", 50000},
+	countStage := bson.D{
+		{"$count", "count"},
 	}
-	pipeline := mongo.Pipeline{filter1Stage, filter2Stage, distinctAssetsStage, joinOperationsStage, sortStage, limitStage}
 	opts := options.Aggregate().SetAllowDiskUse(true)
-	cursor, err := dbCollection.Aggregate(context.Background(), pipeline, opts)
+	countCursor, err := dbCollection.Aggregate(context.Background(), mongo.Pipeline{filter1Stage, distinctAssetsStage, countStage}, opts)
 	if err != nil {
 		return nil, err
 	}
-	operationsPerSoldAssets := make([]*SecondMarketOperationPerAsset, 0)
-	err = cursor.All(context.Background(), &operationsPerSoldAssets)
+	assetsCount := make([]bson.M, 0)
+	err = countCursor.All(context.Background(), &assetsCount)
 	if err != nil {
 		return nil, err
 	}
+	aCount := 0
+	if len(assetsCount) > 0 {
+		switch count := assetsCount[0]["count"].(type) {
+		case int32:
+			aCount = int(count)
+		case int64:
+			aCount = int(count)
+		}
+	}
 
-	mtvCurrencies := make([]string, 0)
-	if metaverse == "decentraland" {
-		mtvCurrencies = []string{"MANA", "ETH"}
+	// Assets are sorted before their operations are joined, to sort small documents
+	pipeline := mongo.Pipeline{filter1Stage, distinctAssetsStage, sortStage, joinOperationsStage}
+	cursor, err := dbCollection.Aggregate(context.Background(), pipeline, opts.SetBatchSize(100))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Data cursor opened !!!"))
+
+	/*
+		Step 2 : Build Headers & Data Types
+	*/
+	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Build columns headers & types..."))
+	// Stored numeraire amounts are exported by the numeraires provider, with the export price method
+	excludeOpMapHeaders := []string{"cursor", "reverted", "payment_amounts"}
+	if !spec.IncludeData {
+		excludeOpMapHeaders = append(excludeOpMapHeaders, "data")
+	}
+	exportPipeline := NewExportPipeline(exportFeatureProviders(metaverse, metric, excludeOpMapHeaders, spec.Numeraires, spec.matchTolerance())...)
+	h, t := exportPipeline.Columns()
+	headers, types := spec.SelectColumns(h, t, dbLoggingPrefix)
+	groups := exportPipeline.ColumnGroups(headers)
+	descriptions, units := exportPipeline.Describe(headers)
+	if spec.expectedColumns != nil && !slices.Equal(spec.expectedColumns, headers) {
+		return nil, errors.New("export columns changed since the last export, a full export is needed")
 	}
-	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Data fetched from database !!!"))
+	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Columns headers & types built !!!"))
 
 	/*
-		Step 2 : Loop to parse data and convert to map[string]any
+		Step 3 : Loop over assets read from the cursor and compute rows
 	*/
-	excludeOpMapHeaders := []string{"cursor", "reverted", "data"}
+	sorter, err := newExportSorter(spec.SortBufferRows)
+	if err != nil {
+		return nil, err
+	}
+	defer sorter.Close()
 	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Loop over assets..."))
-	aCount := len(operationsPerSoldAssets)
 	aIndex := 0
-	operations := make([]map[string]any, 0)
-	for _, ropsaItem := range operationsPerSoldAssets {
+	rowsCount := 0
+	result := &SecondMarketOperationExport{LastOperationIds: make([]string, 0)}
+	for cursor.Next(context.Background()) {
+		ropsaItem := &SecondMarketOperationPerAsset{}
+		err = cursor.Decode(ropsaItem)
+		if err != nil {
+			return nil, err
+		}
 		aIndex++
-		helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processing asset %s [%d/%d] ...", utils.ShortenString(ropsaItem.Asset), aIndex, aCount))
+		helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processing asset %s [%d/%d] ...", utils.ShortenString(ropsaItem.Asset.AssetId), aIndex, aCount))
 
 		/*
-			Step 2.1 : Sort asset operations
+			Step 3.1 : Sort asset operations and prepare asset level features
 		*/
 		slices.SortFunc(ropsaItem.Operations, sort2MOperationFunc)
+		exportPipeline.PrepareAsset(ropsaItem.Operations)
+		changedOps := make(map[string]bool)
+		if spec.incremental != nil {
+			for _, assetOp := range ropsaItem.Operations {
+				if spec.incremental.changedOperation(assetOp) {
+					changedOps[assetOp.OperationId] = true
+				}
+			}
+		}
 
-		windowStart := 0
-		helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processing asset %s [%d/%d]! Loop over asset operations...", utils.ShortenString(ropsaItem.Asset), aIndex, aCount))
+		helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processing asset %s [%d/%d]! Loop over asset operations...", utils.ShortenString(ropsaItem.Asset.AssetId), aIndex, aCount))
 		oCount := len(ropsaItem.Operations)
 		oIndex := 0
-		for i, assetOp := range ropsaItem.Operations {
+		for _, assetOp := range ropsaItem.Operations {
 			oIndex++
-			helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processing operation %s [%d/%d] of asset %s [%d/%d]...", utils.ShortenString(assetOp.OperationId), oIndex, oCount, utils.ShortenString(ropsaItem.Asset), aIndex, aCount))
+			helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processing operation %s [%d/%d] of asset %s [%d/%d]...", utils.ShortenString(assetOp.OperationId), oIndex, oCount, utils.ShortenString(ropsaItem.Asset.AssetId), aIndex, aCount))
 
-			if !slices.Contains(validTypes, assetOp.Type) {
-				helpers.Logging(dbLoggingPrefix, "Operation type is not in allowed types.")
-				helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed operation %s [%d/%d] of asset %s [%d/%d]. !!!", utils.ShortenString(assetOp.OperationId), oIndex, oCount, utils.ShortenString(ropsaItem.Asset), aIndex, aCount))
+			if !spec.MatchOperation(assetOp) {
+				helpers.Logging(dbLoggingPrefix, "Operation does not match export filters.")
+				helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed operation %s [%d/%d] of asset %s [%d/%d]. !!!", utils.ShortenString(assetOp.OperationId), oIndex, oCount, utils.ShortenString(ropsaItem.Asset.AssetId), aIndex, aCount))
 				continue
 			}
 
 			/*
-				Step 2.2 : Correct Currency Price & Amount USD if necessary and possible
+				Step 3.2 : Correct Currency Price & Amount USD if necessary and possible
 			*/
-			if assetOp.PaymentAmountUsd == 0 {
-				price, ok := helpers.GetCurrencyPrice(assetOp.PaymentCurrency, *assetOp.Date)
-				if ok {
-					assetOp.PaymentCcyPrice = price
-					bfAmtUsd := new(big.Float).Mul(new(big.Float).SetFloat64(price), new(big.Float).SetFloat64(assetOp.PaymentAmount))
-					fAmtUsd, _ := bfAmtUsd.Float64()
-					assetOp.PaymentAmountUsd = fAmtUsd
-				}
+			if assetOp.PaymentAmountUsd == 0 || (spec.PriceMethod != "" && assetOp.PaymentPriceMethod != "" &&
+				assetOp.PaymentPriceMethod != helpers.CurrencyPriceMethodSource && assetOp.PaymentPriceMethod != spec.PriceMethod) {
+				priceOperation(assetOp)
+			} else if assetOp.PaymentPriceQuality == "" {
+				// USD amount given by the marketplace
+				assetOp.PaymentPriceQuality = helpers.CurrencyPriceExact
+				assetOp.PaymentPriceMethod = helpers.CurrencyPriceMethodSource
 			}
-
-			/*
-				Step 2.3 : Add related transactions for LISTs & BIDs, and reciprocally for SELLs
-			*/
-			astOpAddInfo := initializeExportOpAddInfo()
-			if assetOp.Type == "SELL" {
-				if i > 0 {
-					var rtOperation *SecondMarketOperation
-					listingIndex := filterGetPreviousListingOrBid("LIST", assetOp, ropsaItem.Operations[windowStart:i])
-					if listingIndex >= 0 {
-						listingOp := ropsaItem.Operations[windowStart+listingIndex]
-						populateExportOpAddInfo(&astOpAddInfo, "LIST", listingOp.Date, assetOp.Date.Sub(*listingOp.Date).Hours()/24, listingOp.OperationId)
-						windowStart += listingIndex + 1
-						rtOperation = listingOp
-					}
-					//else {
-					//	bidIndex := filterGetPreviousListingOrBid("BID", assetOp, ropsaItem.Operations[windowStart:i])
-					//	if bidIndex >= 0 {
-					//		bidOp := ropsaItem.Operations[windowStart+bidIndex]
-					//		populateExportOpAddInfo(&astOpAddInfo, "BID", bidOp.Date, assetOp.Date.Sub(*bidOp.Date).Hours()/24, bidOp.OperationId)
-					//		windowStart += listingIndex + 1
-					//		rtOperation = bidOp
-					//	}
-					//}
-					if rtOperation != nil {
-						rtIndex := slices.IndexFunc(operations, func(m map[string]any) bool {
-							return findExportedOpIndex(m, rtOperation.OperationId)
-						})
-						if rtIndex >= 0 {
-							rtOperationMap := operations[rtIndex]
-							populateExportOpAddInfo(&rtOperationMap, "SELL", assetOp.Date, assetOp.Date.Sub(*rtOperation.Date).Hours()/24, assetOp.OperationId)
-						}
-					}
-				}
-			}
-
-			/*
-				Step 2.4. Convert to Map
-			*/
-			assetOpMap := map[string]any{}
-			_ = utils.ConvertStructToMap(assetOp, excludeOpMapHeaders, &assetOpMap)
-			for k, v := range astOpAddInfo {
-				assetOpMap[k] = v
+			if !spec.MatchAmountUsd(assetOp) {
+				helpers.Logging(dbLoggingPrefix, "Operation amount USD is out of export range.")
+				helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed operation %s [%d/%d] of asset %s [%d/%d]. !!!", utils.ShortenString(assetOp.OperationId), oIndex, oCount, utils.ShortenString(ropsaItem.Asset.AssetId), aIndex, aCount))
+				continue
 			}
 
-			/*
-				Step 2.5. Add Metaverse specific data
-			*/
-			if metaverse == "decentraland" {
-				distances := helpers.GetDclDistanceToFocalPoints(*assetOp.AssetLocX, *assetOp.AssetLocY, metric)
-				for k, v := range distances {
-					assetOpMap[k] = v
-				}
-			}
+			result.trackOperation(assetOp)
 
 			/*
-				Step 2.6. Add Currencies info
+				Step 3.3. Compute features of all providers
 			*/
-			if len(mtvCurrencies) > 0 {
-				currInfo := helpers.GetCurrenciesTimeData(mtvCurrencies, *assetOp.Date)
-				for k, v := range currInfo {
-					assetOpMap[k] = v
+			assetOpMap := exportPipeline.Row(assetOp)
+			if spec.incremental != nil && !changedOps[assetOp.OperationId] {
+				// An operation already exported is emitted again if its related operation is new
+				rtOperationId, _ := assetOpMap["rt_operation_id"].(string)
+				if rtOperationId == "" || !changedOps[rtOperationId] {
+					helpers.Logging(dbLoggingPrefix, "Operation already exported.")
+					helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed operation %s [%d/%d] of asset %s [%d/%d]. !!!", utils.ShortenString(assetOp.OperationId), oIndex, oCount, utils.ShortenString(ropsaItem.Asset.AssetId), aIndex, aCount))
+					continue
 				}
 			}
 
 			/*
-				Step 2.7. Shorten long string fields if necessary
+				Step 3.4. Shorten long string fields if necessary
 			*/
 			if longFields != nil && len(longFields) > 0 {
 				utils.ShortenLongFields(assetOpMap, longFields)
 			}
 
 			/*
-				Step 2.8. Operation treatment ended. All to list
+				Step 3.5. Operation treatment ended. Row to sort buffer
 			*/
-			operations = append(operations, assetOpMap)
-			helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed operation %s [%d/%d] of asset %s [%d/%d] !!!", utils.ShortenString(assetOp.OperationId), oIndex, oCount, utils.ShortenString(ropsaItem.Asset), aIndex, aCount))
+			values := make([]any, len(headers))
+			for i, header := range headers {
+				values[i] = assetOpMap[header]
+			}
+			err = sorter.Add(assetOp.Date, spec.partitionPath(assetOp, assetOpMap), values)
+			if err != nil {
+				return nil, err
+			}
+			rowsCount++
+			helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed operation %s [%d/%d] of asset %s [%d/%d] !!!", utils.ShortenString(assetOp.OperationId), oIndex, oCount, utils.ShortenString(ropsaItem.Asset.AssetId), aIndex, aCount))
 		}
 
-		helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed asset %s [%d/%d] !!!", utils.ShortenString(ropsaItem.Asset), aIndex, aCount))
+		helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed asset %s [%d/%d] !!!", utils.ShortenString(ropsaItem.Asset.AssetId), aIndex, aCount))
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
 	}
-
 	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Processed all assets !!!"))
 
 	/*
-		Step 3. Build Headers & Data Types
+		Step 4. Write operations sorted by date asc
 	*/
-	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Build columns headers & types..."))
-	headers := make([]string, 0)
-	types := make([]string, 0)
-	if len(operations) > 0 {
-		// Struct based headers & types
-		h1, t1 := utils.GetStructToMapHT(operationsPerSoldAssets[0].Operations[0], excludeOpMapHeaders)
-
-		// Related transaction headers & types
-		h2, t2 := initializeExportOpAddInfoHT()
-
-		// Metavers specific data headers & types
-		h3, t3 := make([]string, 0), make([]string, 0)
-		if metaverse == "decentraland" {
-			h3, t3 = helpers.GetDclDistanceToFocalPointsHT()
+	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Sort & write operations..."))
+	if len(spec.PartitionBy) > 0 {
+		partitionsWriter := newExportPartitionsWriter(spec, headers, types, groups)
+		err = sorter.Drain(partitionsWriter.WriteRow)
+		if e0 := partitionsWriter.Close(); err == nil {
+			err = e0
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Partitions = partitionsWriter.Partitions()
+		// Partition columns are not in the files, their values are in the directories names
+		fileDescriptions := make([]string, 0)
+		fileUnits := make([]string, 0)
+		for _, index := range partitionsWriter.keepIndexes {
+			fileDescriptions = append(fileDescriptions, descriptions[index])
+			fileUnits = append(fileUnits, units[index])
+		}
+		headers, types, descriptions, units = partitionsWriter.headers, partitionsWriter.types, fileDescriptions, fileUnits
+	} else {
+		writer, err := newExportWriter(spec, headers, types, groups)
+		if err != nil {
+			return nil, err
+		}
+		err = sorter.Drain(func(_ string, values []any) error {
+			return writer.WriteRow(values)
+		})
+		if e0 := writer.Close(); err == nil {
+			err = e0
 		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Operations sorted & written !!!"))
 
-		// Currencies info headers & types
-		h4, t4 := helpers.GetCurrenciesTimeDataHeaders(mtvCurrencies)
+	result.ColNames = headers
+	result.ColTypes = types
+	result.ColDescriptions = descriptions
+	result.ColUnits = units
+	result.RowsCount = rowsCount
+	return result, nil
+}
 
-		headers = append(headers, h1...)
-		headers = append(headers, h2...)
-		headers = append(headers, h3...)
-		headers = append(headers, h4...)
-		types = append(types, t1...)
-		types = append(types, t2...)
-		types = append(types, t3...)
-		types = append(types, t4...)
+// trackOperation records the most recent exported operations and update date.
+func (e *SecondMarketOperationExport) trackOperation(op *SecondMarketOperation) {
+	if op.Date != nil {
+		if e.LastOperationDate == nil || op.Date.After(*e.LastOperationDate) {
+			lastDate := *op.Date
+			e.LastOperationDate = &lastDate
+			e.LastOperationIds = []string{op.OperationId}
+		} else if op.Date.Equal(*e.LastOperationDate) && !slices.Contains(e.LastOperationIds, op.OperationId) {
+			e.LastOperationIds = append(e.LastOperationIds, op.OperationId)
+		}
 	}
-	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Columns headers & types built !!!"))
-
-	/*
-		Step 3. Sort operations by date asc
-	*/
-	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Sort operations..."))
-	ffOps := utils.ArrayFilter(operations, func(m map[string]any) bool {
-		dd, _ := m["date"].(*time.Time)
-		return dd == nil
-	})
-	println(len(ffOps))
-	slices.SortFunc(operations, sortOperationFunc)
-	helpers.Logging(dbLoggingPrefix, fmt.Sprintf("Operations sorted !!!"))
-
-	result := &SecondMarketOperationExport{
-		Operations: operations,
-		ColNames:   headers,
-		ColTypes:   types,
+	if !op.UpdatedAt.IsZero() && (e.LastUpdatedAt == nil || op.UpdatedAt.After(*e.LastUpdatedAt)) {
+		updatedAt := op.UpdatedAt
+		e.LastUpdatedAt = &updatedAt
 	}
-	return result, nil
 }
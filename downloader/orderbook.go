@@ -0,0 +1,521 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	OrderSideAsk = "ask"
+	OrderSideBid = "bid"
+
+	// DefaultMaxOrderAge is the time an order without expiration date stays
+	// in the book when nothing ends it
+	DefaultMaxOrderAge = 30 * 24 * time.Hour
+)
+
+// BookOrder is a LIST (ask) or a BID of an asset, live from Start until End,
+// End being nil while the order is still live.
+type BookOrder struct {
+	Order *SecondMarketOperation
+	Side  string
+	Start time.Time
+	End   *time.Time
+}
+
+func (o *BookOrder) liveAt(date time.Time) bool {
+	return !o.Start.After(date) && (o.End == nil || o.End.After(date))
+}
+
+// nextBidEnd returns the date of the first operation after the bid ending it:
+// a newer bid of the maker or a purchase of the asset by the maker.
+func nextBidEnd(bid *SecondMarketOperation, operations []*SecondMarketOperation) *time.Time {
+	if bid.Maker == "" {
+		return nil
+	}
+	for _, op := range operations {
+		if op == bid || op.Date == nil || op.Date.Before(*bid.Date) {
+			continue
+		}
+		if op.Type == "BID" && strings.EqualFold(op.Maker, bid.Maker) && op.Date.After(*bid.Date) {
+			return op.Date
+		}
+		if op.Type == "SELL" && strings.EqualFold(op.Buyer, bid.Maker) {
+			return op.Date
+		}
+	}
+	return nil
+}
+
+// expireOpenOrder ends an order without expiration date maxAge after its
+// start, when nothing ended it before and that end is known at asOf.
+func expireOpenOrder(order *BookOrder, maxAge time.Duration, asOf time.Time) {
+	if OperationExpirationDate(order.Order) != nil {
+		return
+	}
+	end := order.Start.Add(maxAge)
+	if !end.After(asOf) && (order.End == nil || end.Before(*order.End)) {
+		order.End = &end
+	}
+}
+
+// AssetBookOrders returns the asks and the bids of an asset with the period
+// they were live, as known at asOf. Asks follow the listings lifecycle; bids
+// end when filled, expired, replaced by a newer bid of the maker or when the
+// maker bought the asset. Orders without expiration date end after maxAge.
+func AssetBookOrders(operations []*SecondMarketOperation, tolerance float64, asOf time.Time, maxAge time.Duration) []*BookOrder {
+	known := knownOperations(operations, asOf)
+	filledBy := assetFills(known, tolerance)
+	orders := make([]*BookOrder, 0)
+	for _, listing := range buildListings(known, filledBy, tolerance, asOf) {
+		start := *listing.ListedAt
+		if listing.StartDate != nil && listing.StartDate.After(start) {
+			start = *listing.StartDate
+		}
+		order := &BookOrder{Order: listing.operation, Side: OrderSideAsk, Start: start, End: listing.EndedAt}
+		expireOpenOrder(order, maxAge, asOf)
+		orders = append(orders, order)
+	}
+	for _, op := range known {
+		if op.Type != "BID" {
+			continue
+		}
+		order := &BookOrder{Order: op, Side: OrderSideBid, Start: *op.Date}
+		if startDate := OperationStartDate(op); startDate != nil && startDate.After(order.Start) {
+			order.Start = *startDate
+		}
+		if match, ok := filledBy[op]; ok {
+			order.End = match.Sale.Date
+		} else {
+			order.End = nextBidEnd(op, known)
+		}
+		if expirationDate := OperationExpirationDate(op); expirationDate != nil && !expirationDate.After(asOf) && (order.End == nil || expirationDate.Before(*order.End)) {
+			order.End = expirationDate
+		}
+		expireOpenOrder(order, maxAge, asOf)
+		orders = append(orders, order)
+	}
+	return orders
+}
+
+// bookOrderValue converts the amount of an order into the numeraire at a
+// date, an order in the numeraire (or in an alias of it) keeping its amount.
+func bookOrderValue(op *SecondMarketOperation, numeraire string, date time.Time) (float64, bool) {
+	if op.PaymentAmount == 0 {
+		return 0, false
+	}
+	currency := operationCurrency(op)
+	if helpers.CanonicalCurrency("", "", numeraire) == currency {
+		return op.PaymentAmount, true
+	}
+	value, _, ok := helpers.ConvertCurrencyAmount(op.PaymentAmount, currency, numeraire, date)
+	return value, ok
+}
+
+// BookLevel is the best ask and the best bid of a book, valued in a
+// numeraire. Asks and Bids count the live orders, valued or not.
+type BookLevel struct {
+	Asks         int
+	Bids         int
+	BestAsk      *float64
+	BestAskAsset string
+	BestBid      *float64
+	BestBidAsset string
+}
+
+func (l *BookLevel) add(order *BookOrder, value float64, valued bool) {
+	if order.Side == OrderSideAsk {
+		l.Asks++
+		if valued && (l.BestAsk == nil || value < *l.BestAsk) {
+			l.BestAsk = &value
+			l.BestAskAsset = order.Order.AssetId
+		}
+	} else {
+		l.Bids++
+		if valued && (l.BestBid == nil || value > *l.BestBid) {
+			l.BestBid = &value
+			l.BestBidAsset = order.Order.AssetId
+		}
+	}
+}
+
+// Spread returns the difference between the best ask and the best bid, and
+// its percentage of the best ask.
+func (l *BookLevel) Spread() (*float64, *float64) {
+	if l.BestAsk == nil || l.BestBid == nil {
+		return nil, nil
+	}
+	spread := *l.BestAsk - *l.BestBid
+	if *l.BestAsk == 0 {
+		return &spread, nil
+	}
+	spreadPct := spread / *l.BestAsk * 100
+	return &spread, &spreadPct
+}
+
+// OrderBookSnapshot counts the live orders of a snapshot and gives the book
+// of every collection, keyed by asset contract.
+type OrderBookSnapshot struct {
+	Assets      int
+	Orders      int
+	Unvalued    int
+	Collections map[string]*BookLevel
+	AssetTypes  map[string]string
+}
+
+var orderBookColumnsDescriptions = map[string][2]string{
+	"date":              {"Date of the book, the close of the day for the series", ""},
+	"side":              {"Side of the order (ask for a LIST, bid for a BID)", ""},
+	"operation_id":      {"Identifier of the LIST or BID operation at its source", ""},
+	"maker":             {"Address of the order maker", ""},
+	"placed_at":         {"Date of the LIST or BID operation", ""},
+	"start_date":        {"Date the order starts, when given by the marketplace", ""},
+	"expiration_date":   {"Date the order expires, when given by the marketplace", ""},
+	"payment_amount":    {"Amount of the order", "payment_currency"},
+	"numeraire":         {"Currency the orders are valued in", ""},
+	"value":             {"Amount of the order in the numeraire", "numeraire"},
+	"asset_best_ask":    {"Lowest ask of the asset in the numeraire", "numeraire"},
+	"asset_best_bid":    {"Highest bid of the asset in the numeraire", "numeraire"},
+	"asset_spread":      {"Best ask less best bid of the asset", "numeraire"},
+	"asks":              {"Number of live asks of the collection", ""},
+	"bids":              {"Number of live bids of the collection", ""},
+	"best_ask":          {"Lowest ask of the collection in the numeraire", "numeraire"},
+	"best_ask_asset_id": {"Token id of the asset of the best ask", ""},
+	"best_bid":          {"Highest bid of the collection in the numeraire", "numeraire"},
+	"best_bid_asset_id": {"Token id of the asset of the best bid", ""},
+	"floor_price":       {"Lowest ask of the collection in the numeraire at the close of the day", "numeraire"},
+	"spread":            {"Best ask less best bid of the collection", "numeraire"},
+	"spread_pct":        {"Spread as a percentage of the best ask", "%"},
+}
+
+// orderBookExport describes an order book file for its data package.
+func orderBookExport(headers, types []string, rowsCount int) *SecondMarketOperationExport {
+	result := &SecondMarketOperationExport{ColNames: headers, ColTypes: types, RowsCount: rowsCount}
+	result.ColDescriptions, result.ColUnits = describeColumns(headers, orderBookColumnsDescriptions, operationColumnsDescriptions)
+	return result
+}
+
+func orderBookOrdersHT() (h []string, t []string) {
+	h = []string{"asset_contract", "asset_type", "asset_id", "asset_location", "side", "operation_id", "maker", "placed_at", "start_date", "expiration_date",
+		"payment_currency", "payment_amount", "numeraire", "value", "asset_best_ask", "asset_best_bid", "asset_spread"}
+	t = []string{"string", "string", "string", "string", "string", "string", "string", "struct", "struct", "struct",
+		"string", "float64", "string", "float64", "float64", "float64", "float64"}
+	return h, t
+}
+
+func orderBookCollectionsHT() (h []string, t []string) {
+	h = []string{"date", "asset_contract", "asset_type", "numeraire", "asks", "bids", "best_ask", "best_ask_asset_id", "best_bid", "best_bid_asset_id", "spread", "spread_pct"}
+	t = []string{"struct", "string", "string", "string", "int", "int", "float64", "string", "float64", "string", "float64", "float64"}
+	return h, t
+}
+
+func orderBookSeriesHT() (h []string, t []string) {
+	h = []string{"date", "asset_contract", "asset_type", "numeraire", "asks", "bids", "floor_price", "best_bid", "spread", "spread_pct"}
+	t = []string{"struct", "string", "string", "string", "int", "int", "float64", "float64", "float64", "float64"}
+	return h, t
+}
+
+func sortedCollections(collections map[string]*BookLevel) []string {
+	contracts := make([]string, 0, len(collections))
+	for contract := range collections {
+		contracts = append(contracts, contract)
+	}
+	sort.Strings(contracts)
+	return contracts
+}
+
+// WriteOrderBookSnapshot writes the orders live at a date, asset by asset,
+// to the orders file, and the best ask, best bid and spread of every
+// collection to the collections file, in the format of their specs. Orders
+// are valued in the numeraire at the date.
+func WriteOrderBookSnapshot(metaverse, source string, at time.Time, numeraire string, tolerance float64, maxAge time.Duration, ordersSpec, collectionsSpec *ExportSpec, dbInstance *mongo.Database, loggingPrefix string) (*OrderBookSnapshot, error) {
+	headers, types := orderBookOrdersHT()
+	writer, err := newExportWriter(ordersSpec, headers, types, nil)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &OrderBookSnapshot{Collections: make(map[string]*BookLevel), AssetTypes: make(map[string]string)}
+	writeAsset := func(operations []*SecondMarketOperation) error {
+		snapshot.Assets++
+		assetLevel := &BookLevel{}
+		liveOrders := make([]*BookOrder, 0)
+		values := make([]*float64, 0)
+		for _, order := range AssetBookOrders(operations, tolerance, at, maxAge) {
+			if !order.liveAt(at) {
+				continue
+			}
+			value, valued := bookOrderValue(order.Order, numeraire, at)
+			assetLevel.add(order, value, valued)
+			liveOrders = append(liveOrders, order)
+			if valued {
+				values = append(values, &value)
+			} else {
+				values = append(values, nil)
+				snapshot.Unvalued++
+			}
+			collection, exists := snapshot.Collections[order.Order.AssetContract]
+			if !exists {
+				collection = &BookLevel{}
+				snapshot.Collections[order.Order.AssetContract] = collection
+				snapshot.AssetTypes[order.Order.AssetContract] = order.Order.AssetType
+			}
+			collection.add(order, value, valued)
+		}
+		spread, _ := assetLevel.Spread()
+		for i, order := range liveOrders {
+			op := order.Order
+			row := []any{op.AssetContract, op.AssetType, op.AssetId, op.AssetLocation, order.Side, op.OperationId, op.Maker, op.Date, OperationStartDate(op), OperationExpirationDate(op),
+				operationCurrency(op), op.PaymentAmount, numeraire, values[i], assetLevel.BestAsk, assetLevel.BestBid, spread}
+			for j, value := range row {
+				row[j] = normalizeExportValue(value)
+			}
+			if e := writer.WriteRow(row); e != nil {
+				return e
+			}
+		}
+		snapshot.Orders += len(liveOrders)
+		if snapshot.Assets%1000 == 0 {
+			helpers.Logging(loggingPrefix, fmt.Sprintf("%d assets read, %d live orders...", snapshot.Assets, snapshot.Orders))
+		}
+		return nil
+	}
+	err = forEachAssetOperations(metaverse, source, []string{"LIST", "BID", "SELL", "TRANSFER"}, dbInstance, writeAsset)
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	headers, types = orderBookCollectionsHT()
+	writer, err = newExportWriter(collectionsSpec, headers, types, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, contract := range sortedCollections(snapshot.Collections) {
+		level := snapshot.Collections[contract]
+		spread, spreadPct := level.Spread()
+		row := []any{at, contract, snapshot.AssetTypes[contract], numeraire, level.Asks, level.Bids, level.BestAsk, level.BestAskAsset, level.BestBid, level.BestBidAsset, spread, spreadPct}
+		for j, value := range row {
+			row[j] = normalizeExportValue(value)
+		}
+		if err = writer.WriteRow(row); err != nil {
+			_ = writer.Close()
+			return nil, err
+		}
+	}
+	return snapshot, writer.Close()
+}
+
+// OrderBookSeries is the book of every collection at the close of every day,
+// keyed by asset contract then by day.
+type OrderBookSeries struct {
+	Assets     int
+	Orders     int
+	Days       map[string]map[time.Time]*BookLevel
+	AssetTypes map[string]string
+}
+
+// addOrder adds an order to the book of the collection at the close of every
+// day it was live, until the close of the last day before `to`. Orders
+// without expiration date are live maxAge at most, which bounds the days.
+func (s *OrderBookSeries) addOrder(order *BookOrder, numeraire string, to time.Time) {
+	contract := order.Order.AssetContract
+	days, exists := s.Days[contract]
+	if !exists {
+		days = make(map[time.Time]*BookLevel)
+		s.Days[contract] = days
+		s.AssetTypes[contract] = order.Order.AssetType
+	}
+	for day := order.Start.Truncate(24 * time.Hour); ; day = day.Add(24 * time.Hour) {
+		dayClose := day.Add(24 * time.Hour)
+		if dayClose.After(to) || (order.End != nil && !order.End.After(dayClose)) {
+			break
+		}
+		level, ok := days[day]
+		if !ok {
+			level = &BookLevel{}
+			days[day] = level
+		}
+		value, valued := bookOrderValue(order.Order, numeraire, dayClose)
+		level.add(order, value, valued)
+	}
+}
+
+// WriteOrderBookSeries computes the floor price (best ask) and the best bid
+// of every collection at the close of every day until `to`, valued in the
+// numeraire at the close, and writes them sorted by collection then day to
+// the output of the spec, in its format.
+func WriteOrderBookSeries(metaverse, source string, to time.Time, numeraire string, tolerance float64, maxAge time.Duration, spec *ExportSpec, dbInstance *mongo.Database, loggingPrefix string) (*OrderBookSeries, error) {
+	series := &OrderBookSeries{Days: make(map[string]map[time.Time]*BookLevel), AssetTypes: make(map[string]string)}
+	addAsset := func(operations []*SecondMarketOperation) error {
+		series.Assets++
+		for _, order := range AssetBookOrders(operations, tolerance, to, maxAge) {
+			series.Orders++
+			series.addOrder(order, numeraire, to)
+		}
+		if series.Assets%1000 == 0 {
+			helpers.Logging(loggingPrefix, fmt.Sprintf("%d assets read, %d orders...", series.Assets, series.Orders))
+		}
+		return nil
+	}
+	err := forEachAssetOperations(metaverse, source, []string{"LIST", "BID", "SELL", "TRANSFER"}, dbInstance, addAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, types := orderBookSeriesHT()
+	writer, err := newExportWriter(spec, headers, types, nil)
+	if err != nil {
+		return nil, err
+	}
+	contracts := make([]string, 0, len(series.Days))
+	for contract := range series.Days {
+		contracts = append(contracts, contract)
+	}
+	sort.Strings(contracts)
+	for _, contract := range contracts {
+		days := make([]time.Time, 0, len(series.Days[contract]))
+		for day := range series.Days[contract] {
+			days = append(days, day)
+		}
+		sort.Slice(days, func(i, j int) bool {
+			return days[i].Before(days[j])
+		})
+		for _, day := range days {
+			level := series.Days[contract][day]
+			spread, spreadPct := level.Spread()
+			row := []any{day, contract, series.AssetTypes[contract], numeraire, level.Asks, level.Bids, level.BestAsk, level.BestBid, spread, spreadPct}
+			for j, value := range row {
+				row[j] = normalizeExportValue(value)
+			}
+			if err = writer.WriteRow(row); err != nil {
+				_ = writer.Close()
+				return nil, err
+			}
+		}
+	}
+	return series, writer.Close()
+}
+
+func formatBookValue(value *float64) string {
+	if value == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%g", *value)
+}
+
+func SnapshotOrderBook(metaverse, source string, at time.Time, numeraire, method string, tolerance float64, maxAge time.Duration, spec *ExportSpec, outputPrefix string) {
+	loggingPrefix := fmt.Sprintf("ORDER BOOK { %s | %s | %s | %s }", metaverse, source, at.Format(time.RFC3339), numeraire)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read currency prices...")
+	err = helpers.ReadCurrencyPrices(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.SetCurrencyPriceMethod(method)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.ValidateNumeraires([]string{numeraire})
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Currency prices read !!!")
+
+	helpers.Logging(loggingPrefix, "Rebuild live orders...")
+	ordersOutput, collectionsOutput := spec.OrderBookOutputs(outputPrefix)
+	ordersSpec, collectionsSpec := spec.withOutput(ordersOutput), spec.withOutput(collectionsOutput)
+	snapshot, err := WriteOrderBookSnapshot(metaverse, source, at, numeraire, tolerance, maxAge, ordersSpec, collectionsSpec, dbInstance, loggingPrefix)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Live orders rebuilt [Assets = %d | Orders = %d | Unvalued = %d] !!!", snapshot.Assets, snapshot.Orders, snapshot.Unvalued))
+	for _, contract := range sortedCollections(snapshot.Collections) {
+		level := snapshot.Collections[contract]
+		spread, _ := level.Spread()
+		helpers.Logging(loggingPrefix, fmt.Sprintf("%s [Asks = %d | Bids = %d | Best ask = %s | Best bid = %s | Spread = %s]",
+			contract, level.Asks, level.Bids, formatBookValue(level.BestAsk), formatBookValue(level.BestBid), formatBookValue(spread)))
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Live orders written to %s, collections books to %s", ordersOutput, collectionsOutput))
+
+	helpers.Logging(loggingPrefix, "Writing data packages...")
+	headers, types := orderBookOrdersHT()
+	ordersDataPackagePath, err := WriteExportDataPackage(metaverse, source, "", ordersSpec, orderBookExport(headers, types, snapshot.Orders))
+	if err != nil {
+		panic(err)
+	}
+	headers, types = orderBookCollectionsHT()
+	collectionsDataPackagePath, err := WriteExportDataPackage(metaverse, source, "", collectionsSpec, orderBookExport(headers, types, len(snapshot.Collections)))
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Data packages saved in files %s and %s !!!", ordersDataPackagePath, collectionsDataPackagePath))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
+
+func OrderBookSeriesReport(metaverse, source string, to time.Time, numeraire, method string, tolerance float64, maxAge time.Duration, spec *ExportSpec) {
+	loggingPrefix := fmt.Sprintf("ORDER BOOK SERIES { %s | %s | %s | %s }", metaverse, source, to.Format(time.RFC3339), numeraire)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read currency prices...")
+	err = helpers.ReadCurrencyPrices(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.SetCurrencyPriceMethod(method)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.ValidateNumeraires([]string{numeraire})
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Currency prices read !!!")
+
+	helpers.Logging(loggingPrefix, "Compute daily floor prices & best bids...")
+	series, err := WriteOrderBookSeries(metaverse, source, to, numeraire, tolerance, maxAge, spec, dbInstance, loggingPrefix)
+	if err != nil {
+		panic(err)
+	}
+	days := 0
+	for _, contractDays := range series.Days {
+		days += len(contractDays)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Daily series computed [Assets = %d | Orders = %d | Collection days = %d] !!!", series.Assets, series.Orders, days))
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Daily series written to %s", spec.Output))
+
+	helpers.Logging(loggingPrefix, "Writing data package...")
+	headers, types := orderBookSeriesHT()
+	dataPackagePath, err := WriteExportDataPackage(metaverse, source, "", spec, orderBookExport(headers, types, days))
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Data package saved in file %s !!!", dataPackagePath))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
@@ -0,0 +1,32 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"fmt"
+	"time"
+)
+
+func ImportParcels(source string, snapshotDate time.Time) {
+	if source == "" {
+		source = helpers.DecentralandTilesApiUrl
+	}
+	loggingPrefix := fmt.Sprintf("PARCELS IMPORT { %s | %s }", source, snapshotDate.Format(time.RFC3339))
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Import parcels snapshot...")
+	snapshot, err := helpers.ImportDecentralandParcels(source, snapshotDate, dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Parcels snapshot imported [Parcels = %d | New versions = %d] !!!", snapshot.ParcelsCount, snapshot.ChangedCount))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
@@ -0,0 +1,276 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PricesEnrichment counts the operations priced by an enrichment run.
+type PricesEnrichment struct {
+	Operations int
+	Unpriced   int
+	Updated    int
+	Qualities  map[string]int
+}
+
+func ImportPrices(inputPath, format, currency string, interval time.Duration) {
+	loggingPrefix := fmt.Sprintf("PRICES IMPORT { %s | %s }", inputPath, currency)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Import prices...")
+	coverage, err := helpers.ImportCurrencyPrices(inputPath, format, currency, interval, dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("%s prices imported [Candles = %d | Overlapping candles dropped = %d] !!!", coverage.Currency, coverage.Imported, coverage.Duplicates))
+	helpers.Logging(loggingPrefix, fmt.Sprintf("%s prices cover %s to %s [Candles = %d | Gaps = %d]", coverage.Currency, coverage.From.Format(time.RFC3339), coverage.To.Format(time.RFC3339), coverage.Candles, len(coverage.Gaps)))
+	for _, gap := range coverage.Gaps {
+		helpers.Logging(loggingPrefix, fmt.Sprintf("%s prices gap from %s to %s (%s)", coverage.Currency, gap.Start.Format(time.RFC3339), gap.End.Format(time.RFC3339), gap.End.Sub(gap.Start)))
+	}
+
+	helpers.Logging(loggingPrefix, "END...")
+}
+
+// enrichPricesFilter selects the stored operations having a payment to
+// price, except the ones whose USD amount was given by the marketplace.
+func enrichPricesFilter(metaverse, source string) bson.D {
+	filter := bson.D{
+		{"payment_amount", bson.D{{"$gt", 0}}},
+		{"payment_currency", bson.D{{"$nin", bson.A{"", nil}}}},
+		{"$or", bson.A{
+			bson.D{{"payment_price_method", bson.D{{"$in", helpers.CurrencyPriceMethods}}}},
+			bson.D{{"payment_amount_usd", bson.D{{"$in", bson.A{0, nil}}}}},
+		}},
+	}
+	if metaverse != "" {
+		filter = append(filter, bson.E{"metaverse", metaverse})
+	}
+	if source != "" {
+		filter = append(filter, bson.E{"downloaded_from", source})
+	}
+	return filter
+}
+
+// EnrichOperationsPrices prices the stored operations with the loaded
+// currency prices and the current price method, and writes back the ones
+// whose USD amount changed. Running it again after new candles are imported
+// only updates the operations priced differently.
+func EnrichOperationsPrices(metaverse, source string, dbInstance *mongo.Database, loggingPrefix string) (*PricesEnrichment, error) {
+	dbCollection := helpers.CollectionInstance(dbInstance, &SecondMarketOperation{})
+	cursor, err := dbCollection.Find(context.Background(), enrichPricesFilter(metaverse, source), options.Find().SetBatchSize(1000))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	enrichment := &PricesEnrichment{Qualities: make(map[string]int)}
+	dbRequests := make([]mongo.WriteModel, 0)
+	for cursor.Next(context.Background()) {
+		operation := &SecondMarketOperation{}
+		if err = cursor.Decode(operation); err != nil {
+			return nil, err
+		}
+		enrichment.Operations++
+		previous := *operation
+		var updatePayload bson.D
+		if !priceOperation(operation) {
+			enrichment.Unpriced++
+			if previous.PaymentCanonicalCurrency == operation.PaymentCanonicalCurrency {
+				continue
+			}
+			// The canonical currency is stored even without price
+			updatePayload = bson.D{{"$set", bson.D{
+				{"payment_canonical_currency", operation.PaymentCanonicalCurrency},
+				{"updated_at", time.Now().UTC()},
+			}}}
+		} else {
+			enrichment.Qualities[operation.PaymentPriceQuality]++
+			if previous.PaymentCanonicalCurrency == operation.PaymentCanonicalCurrency && previous.PaymentAmountUsd == operation.PaymentAmountUsd && previous.PaymentCcyPrice == operation.PaymentCcyPrice &&
+				previous.PaymentPriceQuality == operation.PaymentPriceQuality && previous.PaymentPriceMethod == operation.PaymentPriceMethod &&
+				previous.PaymentPriceDate != nil && previous.PaymentPriceDate.Equal(*operation.PaymentPriceDate) {
+				continue
+			}
+			// updated_at is set so that incremental exports emit the operation again
+			updatePayload = bson.D{{"$set", bson.D{
+				{"payment_canonical_currency", operation.PaymentCanonicalCurrency},
+				{"payment_amount_usd", operation.PaymentAmountUsd},
+				{"payment_ccy_price", operation.PaymentCcyPrice},
+				{"payment_price_quality", operation.PaymentPriceQuality},
+				{"payment_price_method", operation.PaymentPriceMethod},
+				{"payment_price_date", operation.PaymentPriceDate},
+				{"updated_at", time.Now().UTC()},
+			}}}
+			enrichment.Updated++
+		}
+		dbRequests = append(dbRequests, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": operation.ID}).SetUpdate(updatePayload))
+		if len(dbRequests) >= 1000 {
+			if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+				return nil, err
+			}
+			dbRequests = make([]mongo.WriteModel, 0)
+			helpers.Logging(loggingPrefix, fmt.Sprintf("%d operations read, %d updated...", enrichment.Operations, enrichment.Updated))
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	if len(dbRequests) > 0 {
+		if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+			return nil, err
+		}
+	}
+	return enrichment, nil
+}
+
+func EnrichPrices(metaverse, source, method string) {
+	loggingPrefix := fmt.Sprintf("PRICES ENRICHMENT { %s | %s | %s }", metaverse, source, method)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read currency prices...")
+	err = helpers.ReadCurrencyPrices(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.SetCurrencyPriceMethod(method)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Currency prices read !!!")
+
+	helpers.Logging(loggingPrefix, "Price operations...")
+	enrichment, err := EnrichOperationsPrices(metaverse, source, dbInstance, loggingPrefix)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Operations priced [Operations = %d | Updated = %d | Without price = %d] !!!", enrichment.Operations, enrichment.Updated, enrichment.Unpriced))
+	for _, quality := range helpers.CurrencyPriceQualities {
+		helpers.Logging(loggingPrefix, fmt.Sprintf("%d operations priced %s", enrichment.Qualities[quality], quality))
+	}
+
+	helpers.Logging(loggingPrefix, "END...")
+}
+
+// EnrichOperationsNumeraires stores in the operations their payment amount
+// converted into every numeraire, keeping the other stored numeraires. Only
+// the operations whose amounts changed are written.
+func EnrichOperationsNumeraires(metaverse, source string, numeraires []string, dbInstance *mongo.Database, loggingPrefix string) (*PricesEnrichment, error) {
+	dbCollection := helpers.CollectionInstance(dbInstance, &SecondMarketOperation{})
+	filter := bson.D{
+		{"payment_amount", bson.D{{"$gt", 0}}},
+		{"payment_currency", bson.D{{"$nin", bson.A{"", nil}}}},
+	}
+	if metaverse != "" {
+		filter = append(filter, bson.E{"metaverse", metaverse})
+	}
+	if source != "" {
+		filter = append(filter, bson.E{"downloaded_from", source})
+	}
+	cursor, err := dbCollection.Find(context.Background(), filter, options.Find().SetBatchSize(1000))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	enrichment := &PricesEnrichment{Qualities: make(map[string]int)}
+	dbRequests := make([]mongo.WriteModel, 0)
+	for cursor.Next(context.Background()) {
+		operation := &SecondMarketOperation{}
+		if err = cursor.Decode(operation); err != nil {
+			return nil, err
+		}
+		enrichment.Operations++
+		setPayload := bson.D{}
+		for _, numeraire := range numeraires {
+			value, ok := operationNumeraireAmount(operation, numeraire)
+			if !ok {
+				continue
+			}
+			if stored, exists := operation.PaymentAmounts[numeraire]; !exists || stored != value {
+				setPayload = append(setPayload, bson.E{"payment_amounts." + numeraire, value})
+			}
+		}
+		if len(setPayload) == 0 {
+			continue
+		}
+		// updated_at is set so that incremental exports emit the operation again
+		setPayload = append(setPayload, bson.E{"updated_at", time.Now().UTC()})
+		dbRequests = append(dbRequests, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": operation.ID}).SetUpdate(bson.D{{"$set", setPayload}}))
+		enrichment.Updated++
+		if len(dbRequests) == 1000 {
+			if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+				return nil, err
+			}
+			dbRequests = make([]mongo.WriteModel, 0)
+			helpers.Logging(loggingPrefix, fmt.Sprintf("%d operations read, %d updated...", enrichment.Operations, enrichment.Updated))
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	if len(dbRequests) > 0 {
+		if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+			return nil, err
+		}
+	}
+	return enrichment, nil
+}
+
+func EnrichNumeraires(metaverse, source, method string, numeraires []string) {
+	loggingPrefix := fmt.Sprintf("NUMERAIRES ENRICHMENT { %s | %s | %s }", metaverse, source, strings.Join(numeraires, ","))
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read currency prices...")
+	err = helpers.ReadCurrencyPrices(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.SetCurrencyPriceMethod(method)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.ValidateNumeraires(numeraires)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Currency prices read !!!")
+
+	helpers.Logging(loggingPrefix, "Convert operations amounts...")
+	enrichment, err := EnrichOperationsNumeraires(metaverse, source, numeraires, dbInstance, loggingPrefix)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Operations amounts converted [Operations = %d | Updated = %d] !!!", enrichment.Operations, enrichment.Updated))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
@@ -102,7 +102,7 @@ func getRaribleNftActivities(blockchain, contractId, cursor string, eventTypes [
 	return activitiesList, err
 }
 
-func parseRaribleNftActivity(rrbActivity *RaribleTActivity, metaverse, blockchain string, parcelList map[string]*helpers.DecentralandParcel, currencies map[string]string) *SecondMarketOperation {
+func parseRaribleNftActivity(rrbActivity *RaribleTActivity, metaverse, blockchain string) *SecondMarketOperation {
 	opDate, _ := time.Parse(time.RFC3339, rrbActivity.Date)
 	opLastUpdatedAt, _ := time.Parse(time.RFC3339Nano, rrbActivity.LastUpdatedAt)
 	maker, taker, buyer, seller := "", "", "", ""
@@ -136,7 +136,7 @@ func parseRaribleNftActivity(rrbActivity *RaribleTActivity, metaverse, blockchai
 		assetContract = strings.Split(assetInfo.Contract, ":")[1]
 		assetType = GetAssetType(metaverse, assetContract)
 		assetId = assetInfo.TokenId
-		parcel, ok := parcelList[assetId]
+		parcel, ok := helpers.GetDclParcelAt(assetId, opDate)
 		if ok {
 			assetLocation = parcel.Id
 			assetLocX = &parcel.X
@@ -172,10 +172,16 @@ func parseRaribleNftActivity(rrbActivity *RaribleTActivity, metaverse, blockchai
 	} else {
 		paymentAmountUsd, _ = strconv.ParseFloat(rrbActivity.PriceUsd, 64)
 	}
+	paymentPriceQuality, paymentPriceMethod := "", ""
 	if paymentAmount != 0 {
 		paymentCurrencyPrice = paymentAmountUsd / paymentAmount
 	}
+	if paymentAmountUsd != 0 {
+		paymentPriceQuality = helpers.CurrencyPriceExact
+		paymentPriceMethod = helpers.CurrencyPriceMethodSource
+	}
 	paymentBlockchain, paymentType, paymentCurrency, paymentToken := "", "", "", ""
+	paymentTokenUnknown := false
 	if paymentInfo != nil {
 		paymentType = paymentInfo.Type
 		if paymentInfo.Blockchain != "" {
@@ -184,7 +190,14 @@ func parseRaribleNftActivity(rrbActivity *RaribleTActivity, metaverse, blockchai
 		} else if paymentInfo.Contract != "" {
 			paymentBlockchain = strings.Split(paymentInfo.Contract, ":")[0]
 			paymentToken = strings.Split(paymentInfo.Contract, ":")[1]
-			paymentCurrency, _ = currencies[strings.ToLower(paymentInfo.Contract)]
+			// Rarible amounts are already in token units: only the symbol is needed
+			token, ok := helpers.ResolveToken(paymentBlockchain, paymentToken)
+			if ok {
+				paymentCurrency = token.Symbols
+			} else {
+				paymentTokenUnknown = true
+				helpers.FlagUnknownToken(paymentBlockchain, paymentToken, "", 0, "rarible", opDate)
+			}
 		}
 	}
 	blockHash, blockNumber, logIndex := "", int64(0), int64(0)
@@ -194,44 +207,48 @@ func parseRaribleNftActivity(rrbActivity *RaribleTActivity, metaverse, blockchai
 		logIndex = rrbActivity.BlockchainInfo.LogIndex
 	}
 	operation := &SecondMarketOperation{
-		OperationId:       rrbActivity.Id,
-		DownloadedFrom:    "rarible",
-		Type:              rrbActivity.Type,
-		Source:            rrbActivity.Source,
-		Date:              &opDate,
-		LastUpdatedAt:     &opLastUpdatedAt,
-		Cursor:            rrbActivity.Cursor,
-		Reverted:          rrbActivity.Reverted,
-		OrderId:           rrbActivity.OrderId,
-		OrderHash:         rrbActivity.Hash,
-		TransactionHash:   rrbActivity.TransactionHash,
-		TransactionType:   rrbActivity.TransactionType,
-		Maker:             maker,
-		Taker:             taker,
-		Buyer:             buyer,
-		Seller:            seller,
-		Metaverse:         metaverse,
-		Blockchain:        blockchain,
-		AssetContract:     assetContract,
-		AssetType:         assetType,
-		AssetId:           assetId,
-		AssetLocation:     assetLocation,
-		AssetLocX:         assetLocX,
-		AssetLocY:         assetLocY,
-		AssetValue:        assetValue,
-		PaymentBlockchain: paymentBlockchain,
-		PaymentType:       paymentType,
-		PaymentToken:      paymentToken,
-		PaymentCurrency:   paymentCurrency,
-		PaymentAmount:     paymentAmount,
-		PaymentAmountUsd:  paymentAmountUsd,
-		PaymentCcyPrice:   paymentCurrencyPrice,
-		BuyerOrderHash:    rrbActivity.BuyerOrderHash,
-		SellerOrderHash:   rrbActivity.SellerOrderHash,
-		BlockHash:         blockHash,
-		BlockNumber:       blockNumber,
-		LogIndex:          logIndex,
-		Data:              rrbActivity,
+		OperationId:              rrbActivity.Id,
+		DownloadedFrom:           "rarible",
+		Type:                     rrbActivity.Type,
+		Source:                   rrbActivity.Source,
+		Date:                     &opDate,
+		LastUpdatedAt:            &opLastUpdatedAt,
+		Cursor:                   rrbActivity.Cursor,
+		Reverted:                 rrbActivity.Reverted,
+		OrderId:                  rrbActivity.OrderId,
+		OrderHash:                rrbActivity.Hash,
+		TransactionHash:          rrbActivity.TransactionHash,
+		TransactionType:          rrbActivity.TransactionType,
+		Maker:                    maker,
+		Taker:                    taker,
+		Buyer:                    buyer,
+		Seller:                   seller,
+		Metaverse:                metaverse,
+		Blockchain:               blockchain,
+		AssetContract:            assetContract,
+		AssetType:                assetType,
+		AssetId:                  assetId,
+		AssetLocation:            assetLocation,
+		AssetLocX:                assetLocX,
+		AssetLocY:                assetLocY,
+		AssetValue:               assetValue,
+		PaymentBlockchain:        paymentBlockchain,
+		PaymentType:              paymentType,
+		PaymentToken:             paymentToken,
+		PaymentCurrency:          paymentCurrency,
+		PaymentCanonicalCurrency: helpers.CanonicalCurrency(paymentBlockchain, paymentToken, paymentCurrency),
+		PaymentAmount:            paymentAmount,
+		PaymentTokenUnknown:      paymentTokenUnknown,
+		PaymentAmountUsd:         paymentAmountUsd,
+		PaymentCcyPrice:          paymentCurrencyPrice,
+		PaymentPriceQuality:      paymentPriceQuality,
+		PaymentPriceMethod:       paymentPriceMethod,
+		BuyerOrderHash:           rrbActivity.BuyerOrderHash,
+		SellerOrderHash:          rrbActivity.SellerOrderHash,
+		BlockHash:                blockHash,
+		BlockNumber:              blockNumber,
+		LogIndex:                 logIndex,
+		Data:                     rrbActivity,
 	}
 	return operation
 }
@@ -249,8 +266,15 @@ func RaribleLaunch(blockchain, metaverse, assetContract string, eventTypes []str
 	helpers.Logging(loggingPrefix, "Connected to database !!!")
 
 	helpers.Logging(loggingPrefix, "Read currencies & parcels data...")
-	parcelsList := helpers.ReadDecentralandParcels()
-	currencies, err := helpers.GetCurrencies(blockchain, dbInstance)
+	err = helpers.LoadDecentralandParcels(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.LoadCurrencyAliases(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.LoadTokenRegistry(dbInstance)
 	if err != nil {
 		panic(err)
 	}
@@ -282,9 +306,12 @@ func RaribleLaunch(blockchain, metaverse, assetContract string, eventTypes []str
 		} else {
 			operations := make([]*SecondMarketOperation, len(activityList.Activities))
 			for i, activity := range activityList.Activities {
-				operations[i] = parseRaribleNftActivity(activity, metaverse, blockchain, parcelsList, currencies)
+				operations[i] = parseRaribleNftActivity(activity, metaverse, blockchain)
 			}
 			err = Save2ndMarketOperations(operations, dbInstance)
+			if err == nil {
+				err = helpers.SaveTokenRegistrations(dbInstance)
+			}
 			if err != nil {
 				loopErr = err
 				helpers.Logging(loggingPrefix, fmt.Sprintf("Error occurred when saving data for request #%d ...", requestCount))
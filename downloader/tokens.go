@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"OpenSeaDataDownloader/helpers"
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TokensResolution counts the operations flagged with an unknown payment
+// token, and the ones resolved from the token registry.
+type TokensResolution struct {
+	Operations int
+	Resolved   int
+	Rescaled   int
+}
+
+// ResolveOperationsTokens resolves the payment token of the flagged
+// operations from the token registry: their currency is set, and their amount
+// is scaled again from the raw quantity with the registered decimals, then
+// priced again. Operations whose token is still unknown stay flagged.
+func ResolveOperationsTokens(metaverse, source string, dbInstance *mongo.Database, loggingPrefix string) (*TokensResolution, error) {
+	dbCollection := helpers.CollectionInstance(dbInstance, &SecondMarketOperation{})
+	filter := bson.D{{"payment_token_unknown", true}}
+	if metaverse != "" {
+		filter = append(filter, bson.E{"metaverse", metaverse})
+	}
+	if source != "" {
+		filter = append(filter, bson.E{"downloaded_from", source})
+	}
+	cursor, err := dbCollection.Find(context.Background(), filter, options.Find().SetBatchSize(1000))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	resolution := &TokensResolution{}
+	dbRequests := make([]mongo.WriteModel, 0)
+	for cursor.Next(context.Background()) {
+		operation := &SecondMarketOperation{}
+		if err = cursor.Decode(operation); err != nil {
+			return nil, err
+		}
+		resolution.Operations++
+		token, ok := helpers.ResolveToken(operation.PaymentBlockchain, operation.PaymentToken)
+		if !ok || (operation.PaymentQuantity != "" && token.Decimals == 0) {
+			continue
+		}
+		operation.PaymentCurrency = token.Symbols
+		operation.PaymentCanonicalCurrency = helpers.CanonicalCurrency(operation.PaymentBlockchain, operation.PaymentToken, token.Symbols)
+		setPayload := bson.D{
+			{"payment_currency", operation.PaymentCurrency},
+			{"payment_canonical_currency", operation.PaymentCanonicalCurrency},
+			{"updated_at", time.Now().UTC()},
+		}
+		if operation.PaymentQuantity != "" {
+			amount, scaled := helpers.ScaleTokenAmount(operation.PaymentQuantity, token.Decimals)
+			if scaled && amount != operation.PaymentAmount {
+				operation.PaymentAmount = amount
+				setPayload = append(setPayload, bson.E{"payment_amount", amount})
+				resolution.Rescaled++
+				// USD amounts given by the marketplace do not depend on the decimals
+				if operation.PaymentPriceMethod != helpers.CurrencyPriceMethodSource && priceOperation(operation) {
+					setPayload = append(setPayload,
+						bson.E{"payment_amount_usd", operation.PaymentAmountUsd},
+						bson.E{"payment_ccy_price", operation.PaymentCcyPrice},
+						bson.E{"payment_price_quality", operation.PaymentPriceQuality},
+						bson.E{"payment_price_method", operation.PaymentPriceMethod},
+						bson.E{"payment_price_date", operation.PaymentPriceDate},
+					)
+				}
+			}
+		}
+		dbRequests = append(dbRequests, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": operation.ID}).SetUpdate(bson.D{
+			{"$set", setPayload},
+			{"$unset", bson.D{{"payment_token_unknown", ""}}},
+		}))
+		resolution.Resolved++
+		if len(dbRequests) == 1000 {
+			if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+				return nil, err
+			}
+			dbRequests = make([]mongo.WriteModel, 0)
+			helpers.Logging(loggingPrefix, fmt.Sprintf("%d operations read, %d resolved...", resolution.Operations, resolution.Resolved))
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	if len(dbRequests) > 0 {
+		if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+			return nil, err
+		}
+	}
+	return resolution, nil
+}
+
+func ListTokens() {
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+
+	registrations, err := helpers.GetTokenRegistrations(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "BLOCKCHAIN\tCONTRACT\tSYMBOL\tDECIMALS\tSOURCE\tOCCURRENCES\tFIRST SEEN\tLAST SEEN")
+	for _, registration := range registrations {
+		_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\t%d\t%s\t%s\n", registration.Blockchain, registration.Contract, registration.Symbol, registration.Decimals, registration.Source, registration.Occurrences, registration.FirstSeen.Format(time.DateOnly), registration.LastSeen.Format(time.DateOnly))
+	}
+	_ = writer.Flush()
+}
+
+func RegisterToken(blockchain, contract, symbol string, decimals int64) {
+	loggingPrefix := fmt.Sprintf("TOKEN REGISTRATION { %s | %s }", blockchain, contract)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+
+	currency, err := helpers.RegisterToken(blockchain, contract, symbol, decimals, dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Token registered [Symbol = %s | Decimals = %d] !!!", currency.Symbols, currency.Decimals))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
+
+func ResolveTokens(metaverse, source string) {
+	loggingPrefix := fmt.Sprintf("TOKENS RESOLUTION { %s | %s }", metaverse, source)
+	helpers.Logging(loggingPrefix, "Start...")
+
+	helpers.Logging(loggingPrefix, "Connection to database...")
+	dbInstance, err := helpers.NewDatabaseConnection()
+	if err != nil {
+		panic(err)
+	}
+	defer helpers.CloseDatabaseConnection(dbInstance)
+	helpers.Logging(loggingPrefix, "Connected to database !!!")
+
+	helpers.Logging(loggingPrefix, "Read tokens & currency prices...")
+	err = helpers.LoadTokenRegistry(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	err = helpers.ReadCurrencyPrices(dbInstance)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, "Tokens & currency prices read !!!")
+
+	helpers.Logging(loggingPrefix, "Resolve operations tokens...")
+	resolution, err := ResolveOperationsTokens(metaverse, source, dbInstance, loggingPrefix)
+	if err != nil {
+		panic(err)
+	}
+	helpers.Logging(loggingPrefix, fmt.Sprintf("Operations tokens resolved [Operations = %d | Resolved = %d | Rescaled = %d] !!!", resolution.Operations, resolution.Resolved, resolution.Rescaled))
+
+	helpers.Logging(loggingPrefix, "END...")
+}
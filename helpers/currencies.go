@@ -2,9 +2,10 @@ package helpers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/big"
-	"strings"
+	"slices"
 	"time"
 
 	"github.com/kamva/mgm/v3"
@@ -39,25 +40,40 @@ type CurrencyPrice struct {
 	MarketCap        float64   `bson:"market_cap,omitempty"`
 }
 
-var (
-	currencyPrices = make(map[string][]*CurrencyPrice)
+// CurrencyPriceQuote is the USD price of a currency at a date. Currency is
+// the symbol of the candles used, possibly an alias of the priced one. Date
+// is the time the price was observed at: a candle boundary, or the priced
+// date itself for an interpolated price.
+type CurrencyPriceQuote struct {
+	Currency string
+	Price    float64
+	Date     time.Time
+	Method   string
+	Quality  string
+}
+
+const (
+	CurrencyPriceMethodClose       = "close"
+	CurrencyPriceMethodOpen        = "open"
+	CurrencyPriceMethodTypical     = "typical"
+	CurrencyPriceMethodVwap        = "vwap"
+	CurrencyPriceMethodInterpolate = "interpolate"
+	// CurrencyPriceMethodSource marks USD amounts given by the marketplace
+	CurrencyPriceMethodSource = "source"
+
+	CurrencyPriceExact        = "exact"
+	CurrencyPriceInterpolated = "interpolated"
+	CurrencyPriceExtrapolated = "extrapolated"
+
+	currencyPriceVwapWindow = 24 * time.Hour
 )
 
-func GetCurrencies(blockchain string, dbInstance *mongo.Database) (map[string]string, error) {
-	dbCollection := CollectionInstance(dbInstance, &Currency{})
-	cursor, err := dbCollection.Find(context.Background(), bson.M{"blockchain": blockchain})
-	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close(context.Background())
-	results := make([]*Currency, 0)
-	err = cursor.All(context.Background(), &results)
-	currencies := make(map[string]string)
-	for _, result := range results {
-		currencies[fmt.Sprintf("%s:%s", strings.ToLower(result.Blockchain), strings.ToLower(result.Contract))] = result.Symbols
-	}
-	return currencies, nil
-}
+var (
+	CurrencyPriceMethods   = []string{CurrencyPriceMethodClose, CurrencyPriceMethodOpen, CurrencyPriceMethodTypical, CurrencyPriceMethodVwap, CurrencyPriceMethodInterpolate}
+	CurrencyPriceQualities = []string{CurrencyPriceExact, CurrencyPriceInterpolated, CurrencyPriceExtrapolated}
+	currencyPrices         = make(map[string][]*CurrencyPrice)
+	currencyPriceMethod    = CurrencyPriceMethodTypical
+)
 
 func ReadCurrencyPrices(dbInstance *mongo.Database) error {
 	curCollection := CollectionInstance(dbInstance, &Currency{})
@@ -65,9 +81,19 @@ func ReadCurrencyPrices(dbInstance *mongo.Database) error {
 	if err != nil {
 		return err
 	}
+	err = LoadCurrencyAliases(dbInstance)
+	if err != nil {
+		return err
+	}
+
+	// Candles are stored under the canonical symbols, possibly not registered
 	currencies := make([]string, 0)
-	for _, currency := range rawCurrencies {
-		currencies = append(currencies, currency.(string))
+	for _, rawCurrency := range rawCurrencies {
+		for _, currency := range []string{rawCurrency.(string), CanonicalCurrency("", "", rawCurrency.(string))} {
+			if !slices.Contains(currencies, currency) {
+				currencies = append(currencies, currency)
+			}
+		}
 	}
 
 	pricesCollection := CollectionInstance(dbInstance, &CurrencyPrice{})
@@ -89,74 +115,174 @@ func ReadCurrencyPrices(dbInstance *mongo.Database) error {
 	return nil
 }
 
-func GetCurrencyPrice(currency string, date time.Time) (price float64, exists bool) {
-	price = 0.0
-	exists = false
-	filteredPrices, hasCp := currencyPrices[currency]
-	if hasCp && filteredPrices != nil && len(filteredPrices) > 0 {
-		if date.UnixMilli() < filteredPrices[0].Start.UnixMilli() {
-			price = filteredPrices[0].Open
-			exists = true
-		} else if date.UnixMilli() >= filteredPrices[len(filteredPrices)-1].End.UnixMilli() {
-			price = filteredPrices[len(filteredPrices)-1].Close
-			exists = true
+// currencyPriceIndex returns the index of the candle covering the date, or
+// else the index of the first candle starting after it (len if none).
+func currencyPriceIndex(prices []*CurrencyPrice, date time.Time) (index int, covered bool) {
+	index, _ = slices.BinarySearchFunc(prices, date, func(p *CurrencyPrice, t time.Time) int {
+		if p.Start.After(t) {
+			return 1
+		}
+		return -1
+	})
+	// index is the first candle starting after the date: the one before may cover it
+	if index > 0 && date.Before(prices[index-1].End) {
+		return index - 1, true
+	}
+	return index, false
+}
+
+func typicalCurrencyPrice(price *CurrencyPrice) float64 {
+	openP := new(big.Float).SetFloat64(price.Open)
+	closeP := new(big.Float).SetFloat64(price.Close)
+	highP := new(big.Float).SetFloat64(price.High)
+	lowP := new(big.Float).SetFloat64(price.Low)
+	temp := new(big.Float).Add(openP, closeP)
+	temp = temp.Add(temp, highP)
+	temp = temp.Add(temp, lowP)
+	temp = temp.Quo(temp, new(big.Float).SetFloat64(4.0))
+	typical, _ := temp.Float64()
+	return typical
+}
+
+// vwapCurrencyPrice returns the typical prices of the candles ending within
+// the VWAP window before the end of the candle at index, weighted by their
+// volumes. Without volumes, the typical price of the candle is returned.
+func vwapCurrencyPrice(prices []*CurrencyPrice, index int) float64 {
+	windowStart := prices[index].End.Add(-currencyPriceVwapWindow)
+	volumes, weightedPrices := 0.0, 0.0
+	for i := index; i >= 0 && prices[i].End.After(windowStart); i-- {
+		volumes += prices[i].Volume
+		weightedPrices += prices[i].Volume * typicalCurrencyPrice(prices[i])
+	}
+	if volumes == 0 {
+		return typicalCurrencyPrice(prices[index])
+	}
+	return weightedPrices / volumes
+}
+
+func interpolatePrice(fromDate time.Time, fromPrice float64, toDate time.Time, toPrice float64, date time.Time) float64 {
+	if !toDate.After(fromDate) {
+		return fromPrice
+	}
+	ratio := float64(date.Sub(fromDate)) / float64(toDate.Sub(fromDate))
+	return fromPrice + (toPrice-fromPrice)*ratio
+}
+
+// SetCurrencyPriceMethod sets how the USD price of a currency is taken from
+// the candle covering a date: close, open, typical ((O+H+L+C)/4, default),
+// vwap (over the last 24 hours) or interpolate (linearly from the open at
+// the candle start to the close at its end).
+func SetCurrencyPriceMethod(method string) error {
+	if method == "" {
+		method = CurrencyPriceMethodTypical
+	}
+	if !slices.Contains(CurrencyPriceMethods, method) {
+		return errors.New(fmt.Sprintf("invalid price method %s", method))
+	}
+	currencyPriceMethod = method
+	return nil
+}
+
+func GetCurrencyPriceMethod() string {
+	return currencyPriceMethod
+}
+
+// LookupCurrencyPrice returns the USD price of a currency at a date with the
+// current price method, using the candles of the currency or of its aliases
+// (e.g. ETH candles for WETH), the first ones covering the date being
+// preferred. A date between two candles gets a price interpolated between the
+// close of the previous one and the open of the next one, and a date out of
+// the candles range the first open or the last close, flagged as
+// extrapolated.
+func LookupCurrencyPrice(currency string, date time.Time) (*CurrencyPriceQuote, bool) {
+	var extrapolated *CurrencyPriceQuote
+	for _, equivalent := range currencyEquivalents(currency) {
+		quote, ok := lookupCurrencyPriceOf(equivalent, date)
+		if !ok {
+			continue
+		}
+		if quote.Quality != CurrencyPriceExtrapolated {
+			return quote, true
+		}
+		if extrapolated == nil {
+			extrapolated = quote
+		}
+	}
+	return extrapolated, extrapolated != nil
+}
+
+func lookupCurrencyPriceOf(currency string, date time.Time) (*CurrencyPriceQuote, bool) {
+	prices, hasCp := currencyPrices[currency]
+	if !hasCp || len(prices) == 0 {
+		return nil, false
+	}
+	quote := &CurrencyPriceQuote{Currency: currency, Method: currencyPriceMethod}
+	index, covered := currencyPriceIndex(prices, date)
+	if !covered {
+		if index == 0 {
+			quote.Price, quote.Date, quote.Quality = prices[0].Open, prices[0].Start, CurrencyPriceExtrapolated
+		} else if index == len(prices) {
+			last := prices[len(prices)-1]
+			quote.Price, quote.Date, quote.Quality = last.Close, last.End, CurrencyPriceExtrapolated
 		} else {
-			bestPriceInstance := new(CurrencyPrice)
-			for _, priceItem := range filteredPrices {
-				if priceItem.Start.UnixMilli() <= date.UnixMilli() && date.UnixMilli() < priceItem.End.UnixMilli() {
-					bestPriceInstance = priceItem
-					break
-				}
-			}
-			if bestPriceInstance != nil {
-				openP := new(big.Float).SetFloat64(bestPriceInstance.Open)
-				closeP := new(big.Float).SetFloat64(bestPriceInstance.Close)
-				highP := new(big.Float).SetFloat64(bestPriceInstance.High)
-				lowP := new(big.Float).SetFloat64(bestPriceInstance.Low)
-				temp := new(big.Float).Add(openP, closeP)
-				temp = temp.Add(temp, highP)
-				temp = temp.Add(temp, lowP)
-				temp = temp.Quo(temp, new(big.Float).SetFloat64(4.0))
-				price, _ = temp.Float64()
-				exists = true
-			}
+			previous, next := prices[index-1], prices[index]
+			quote.Price = interpolatePrice(previous.End, previous.Close, next.Start, next.Open, date)
+			quote.Date, quote.Quality, quote.Method = date, CurrencyPriceInterpolated, CurrencyPriceMethodInterpolate
 		}
+		return quote, true
+	}
+	price := prices[index]
+	quote.Date, quote.Quality = price.Start, CurrencyPriceExact
+	switch currencyPriceMethod {
+	case CurrencyPriceMethodClose:
+		quote.Price, quote.Date = price.Close, price.End
+	case CurrencyPriceMethodOpen:
+		quote.Price = price.Open
+	case CurrencyPriceMethodVwap:
+		quote.Price = vwapCurrencyPrice(prices, index)
+	case CurrencyPriceMethodInterpolate:
+		quote.Price = interpolatePrice(price.Start, price.Open, price.End, price.Close, date)
+		quote.Date, quote.Quality = date, CurrencyPriceInterpolated
+	default:
+		quote.Price = typicalCurrencyPrice(price)
+	}
+	return quote, true
+}
+
+func GetCurrencyPrice(currency string, date time.Time) (price float64, exists bool) {
+	quote, exists := LookupCurrencyPrice(currency, date)
+	if !exists {
+		return 0.0, false
 	}
-	return price, exists
+	return quote.Price, true
 }
 
 func GetCurrencyMarketCap(currency string, date time.Time) (marketCap float64, exists bool) {
-	marketCap = 0.0
-	exists = false
-	filteredPrices, hasCp := currencyPrices[currency]
-	if hasCp && filteredPrices != nil && len(filteredPrices) > 0 {
-		if date.UnixMilli() < filteredPrices[0].Start.UnixMilli() {
-			marketCap = filteredPrices[0].MarketCap
-			exists = true
-		} else if date.UnixMilli() >= filteredPrices[len(filteredPrices)-1].End.UnixMilli() {
-			marketCap = filteredPrices[len(filteredPrices)-1].MarketCap
-			exists = true
-		} else {
-			bestPriceInstance := new(CurrencyPrice)
-			for _, priceItem := range filteredPrices {
-				if priceItem.Start.UnixMilli() <= date.UnixMilli() && date.UnixMilli() < priceItem.End.UnixMilli() {
-					bestPriceInstance = priceItem
-					break
-				}
-			}
-			if bestPriceInstance != nil {
-				marketCap = bestPriceInstance.MarketCap
-				exists = true
-			}
+	prices, hasCp := currencyPrices[currency]
+	if !hasCp || len(prices) == 0 {
+		return 0.0, false
+	}
+	index, covered := currencyPriceIndex(prices, date)
+	if !covered {
+		if index == len(prices) {
+			return prices[len(prices)-1].MarketCap, true
+		} else if index > 0 {
+			return prices[index-1].MarketCap, true
 		}
+		return prices[0].MarketCap, true
 	}
-	return marketCap, exists
+	return prices[index].MarketCap, true
 }
 
+// GetCurrenciesTimeData returns the USD price and the market cap of every
+// currency at a date.
 func GetCurrenciesTimeData(currencies []string, date time.Time) (data map[string]float64) {
 	data = make(map[string]float64)
 	for _, currency := range currencies {
-		price, _ := GetCurrencyPrice(currency, date)
+		price := 0.0
+		if rate, ok := GetCurrencyCrossRate(currency, UsdNumeraire, date); ok {
+			price = rate.Rate
+		}
 		marketCap, _ := GetCurrencyMarketCap(currency, date)
 		data[fmt.Sprintf("%s_PRICE", currency)] = price
 		data[fmt.Sprintf("%s_MARKET_CAP", currency)] = marketCap
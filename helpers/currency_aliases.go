@@ -0,0 +1,136 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultCurrencyAliases maps currency symbols to the canonical symbol of the
+// same economic asset: wrapped tokens to their native currency, and MATIC to
+// POL which replaced it.
+var defaultCurrencyAliases = map[string]string{
+	"WETH":   "ETH",
+	"MATIC":  "POL",
+	"WMATIC": "POL",
+	"WPOL":   "POL",
+}
+
+// defaultCurrencyTokenAliases maps token contracts, keyed by blockchain, to
+// the canonical symbol of their currency, for the tokens bridged or wrapped
+// under another symbol.
+var defaultCurrencyTokenAliases = map[string]string{
+	"ethereum:0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2": "ETH",
+	"polygon:0x7ceb23fd6bc0add59e62ac25578270cff1b9f619":  "ETH",
+	"ethereum:0x0f5d2fb29fb7d3cfee444a200298f468908cc942": "MANA",
+	"polygon:0xa1c57f48f0deb89f569dfbe6e2b7f46d33606fd4":  "MANA",
+	"ethereum:0x7d1afa7b718fb893db30a3abc0cfc608aacfebb0": "POL",
+	"ethereum:0x455e53cbb86018ac2b8092fdcd39d8444affc3f6": "POL",
+	"polygon:0x0d500b1d8e8ef31e21c99d1db9a6444d3adf1270":  "POL",
+}
+
+var (
+	currencyAliases      = copyCurrencyAliases(defaultCurrencyAliases)
+	currencyTokenAliases = copyCurrencyAliases(defaultCurrencyTokenAliases)
+)
+
+func copyCurrencyAliases(aliases map[string]string) map[string]string {
+	aliasesCopy := make(map[string]string)
+	for key, canonical := range aliases {
+		aliasesCopy[key] = canonical
+	}
+	return aliasesCopy
+}
+
+// normalizeCurrencyBlockchain gives the same name to a blockchain named by
+// OpenSea (matic) or by Rarible (POLYGON).
+func normalizeCurrencyBlockchain(blockchain string) string {
+	blockchain = strings.ToLower(blockchain)
+	if blockchain == "matic" {
+		return "polygon"
+	}
+	return blockchain
+}
+
+func currencyTokenKey(blockchain, token string) string {
+	return fmt.Sprintf("%s:%s", normalizeCurrencyBlockchain(blockchain), strings.ToLower(token))
+}
+
+// LoadCurrencyAliases resets the alias registry to the default aliases, then
+// adds the registered currencies: a currency whose price map is another
+// registered symbol is an alias of it, and its contract is mapped to its
+// canonical symbol.
+func LoadCurrencyAliases(dbInstance *mongo.Database) error {
+	dbCollection := CollectionInstance(dbInstance, &Currency{})
+	cursor, err := dbCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	results := make([]*Currency, 0)
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return err
+	}
+	currencyAliases = copyCurrencyAliases(defaultCurrencyAliases)
+	currencyTokenAliases = copyCurrencyAliases(defaultCurrencyTokenAliases)
+	symbols := make([]string, 0)
+	for _, result := range results {
+		symbols = append(symbols, strings.ToUpper(result.Symbols))
+	}
+	for _, result := range results {
+		symbol, priceMap := strings.ToUpper(result.Symbols), strings.ToUpper(result.PriceMap)
+		if symbol == "" {
+			continue
+		}
+		if priceMap != "" && priceMap != symbol && slices.Contains(symbols, priceMap) {
+			if _, exists := currencyAliases[symbol]; !exists {
+				currencyAliases[symbol] = priceMap
+			}
+		}
+		if result.Contract != "" {
+			tokenKey := currencyTokenKey(result.Blockchain, result.Contract)
+			if _, exists := currencyTokenAliases[tokenKey]; !exists {
+				currencyTokenAliases[tokenKey] = CanonicalCurrency("", "", symbol)
+			}
+		}
+	}
+	return nil
+}
+
+// CanonicalCurrency returns the canonical symbol of a payment currency, found
+// from its token contract first, then from its symbol. A currency without
+// alias is its own canonical currency.
+func CanonicalCurrency(blockchain, token, symbol string) string {
+	if token != "" {
+		if canonical, ok := currencyTokenAliases[currencyTokenKey(blockchain, token)]; ok {
+			return canonical
+		}
+	}
+	if canonical, ok := currencyAliases[strings.ToUpper(symbol)]; ok {
+		return canonical
+	}
+	return symbol
+}
+
+// currencyEquivalents returns the symbols priced like the given one: itself,
+// its canonical symbol and the other aliases of it.
+func currencyEquivalents(symbol string) []string {
+	canonical := CanonicalCurrency("", "", symbol)
+	equivalents := []string{symbol}
+	if !slices.Contains(equivalents, canonical) {
+		equivalents = append(equivalents, canonical)
+	}
+	aliases := make([]string, 0)
+	for alias, aliasCanonical := range currencyAliases {
+		if aliasCanonical == canonical && !slices.Contains(equivalents, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return append(equivalents, aliases...)
+}
@@ -0,0 +1,107 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// UsdNumeraire is the currency every candle is priced in.
+const UsdNumeraire = "USD"
+
+// CurrencyCrossRate is the value of one unit of a currency in another one at
+// a date. Its quality is the worst of the qualities of both USD prices.
+type CurrencyCrossRate struct {
+	From    string
+	To      string
+	Rate    float64
+	Quality string
+}
+
+// worstCurrencyPriceQuality returns the least reliable of two price qualities.
+func worstCurrencyPriceQuality(quality1, quality2 string) string {
+	if slices.Index(CurrencyPriceQualities, quality2) > slices.Index(CurrencyPriceQualities, quality1) {
+		return quality2
+	}
+	return quality1
+}
+
+func usdCurrencyPrice(currency string, date time.Time) (*CurrencyPriceQuote, bool) {
+	if strings.EqualFold(currency, UsdNumeraire) {
+		return &CurrencyPriceQuote{Currency: UsdNumeraire, Price: 1, Date: date, Method: currencyPriceMethod, Quality: CurrencyPriceExact}, true
+	}
+	return LookupCurrencyPrice(currency, date)
+}
+
+// GetCurrencyCrossRate returns the rate between two currencies at a date,
+// crossed through their USD prices. Currencies sharing a canonical symbol
+// have a rate of 1.
+func GetCurrencyCrossRate(from, to string, date time.Time) (*CurrencyCrossRate, bool) {
+	if strings.EqualFold(from, to) || CanonicalCurrency("", "", from) == CanonicalCurrency("", "", to) {
+		return &CurrencyCrossRate{From: from, To: to, Rate: 1, Quality: CurrencyPriceExact}, true
+	}
+	fromQuote, ok := usdCurrencyPrice(from, date)
+	if !ok {
+		return nil, false
+	}
+	toQuote, ok := usdCurrencyPrice(to, date)
+	if !ok || toQuote.Price == 0 {
+		return nil, false
+	}
+	return &CurrencyCrossRate{
+		From:    from,
+		To:      to,
+		Rate:    fromQuote.Price / toQuote.Price,
+		Quality: worstCurrencyPriceQuality(fromQuote.Quality, toQuote.Quality),
+	}, true
+}
+
+// ConvertCurrencyAmount converts an amount of a currency into a numeraire
+// (USD or any currency with prices) at a date.
+func ConvertCurrencyAmount(amount float64, from, to string, date time.Time) (value float64, quality string, ok bool) {
+	rate, ok := GetCurrencyCrossRate(from, to, date)
+	if !ok {
+		return 0, "", false
+	}
+	return amount * rate.Rate, rate.Quality, true
+}
+
+// NumeraireHeaderPrefix starts the columns holding an amount converted into a
+// numeraire, distinct from payment_amount_usd even for case-insensitive
+// readers.
+const NumeraireHeaderPrefix = "payment_amount_in_"
+
+// ValidateNumeraires checks that every numeraire is USD or a currency with
+// prices, itself or through its aliases. Currency prices must be read first.
+func ValidateNumeraires(numeraires []string) error {
+	for _, numeraire := range numeraires {
+		if strings.EqualFold(numeraire, UsdNumeraire) {
+			continue
+		}
+		priced := false
+		for _, equivalent := range currencyEquivalents(numeraire) {
+			if len(currencyPrices[equivalent]) > 0 {
+				priced = true
+				break
+			}
+		}
+		if !priced {
+			return errors.New(fmt.Sprintf("unknown numeraire %s: no prices for it nor for its aliases", numeraire))
+		}
+	}
+	return nil
+}
+
+// GetNumerairesHeaders returns the columns holding an amount converted into
+// every numeraire, e.g. payment_amount_in_eth.
+func GetNumerairesHeaders(numeraires []string) (h []string, t []string) {
+	h = make([]string, 0)
+	t = make([]string, 0)
+	for _, numeraire := range numeraires {
+		h = append(h, NumeraireHeaderPrefix+strings.ToLower(numeraire))
+		t = append(t, "float64")
+	}
+	return h, t
+}
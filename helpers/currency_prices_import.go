@@ -0,0 +1,614 @@
+package helpers
+
+import (
+	"OpenSeaDataDownloader/utils"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var CurrencyPricesFormats = []string{"coingecko", "coinmarketcap", "ohlcv"}
+
+// currencyPriceColumns lists, for every candle field, the generic OHLCV csv
+// headers holding it (lowercased, without separators), by priority.
+var currencyPriceColumns = map[string][]string{
+	"start":      {"start", "timeopen", "opentime", "date", "time", "timestamp"},
+	"end":        {"end", "timeclose", "closetime"},
+	"open":       {"open"},
+	"high":       {"high"},
+	"low":        {"low"},
+	"close":      {"close", "price"},
+	"volume":     {"volume", "vol", "totalvolume"},
+	"market_cap": {"marketcap"},
+}
+
+type coinGeckoMarketChart struct {
+	Prices       [][]float64 `json:"prices"`
+	MarketCaps   [][]float64 `json:"market_caps"`
+	TotalVolumes [][]float64 `json:"total_volumes"`
+}
+
+type coinMarketCapUsdQuote struct {
+	Open      float64 `json:"open"`
+	High      float64 `json:"high"`
+	Low       float64 `json:"low"`
+	Close     float64 `json:"close"`
+	Price     float64 `json:"price"`
+	Volume    float64 `json:"volume"`
+	MarketCap float64 `json:"market_cap"`
+	Timestamp string  `json:"timestamp"`
+}
+
+type coinMarketCapQuote struct {
+	TimeOpen  string                            `json:"time_open"`
+	TimeClose string                            `json:"time_close"`
+	Timestamp string                            `json:"timestamp"`
+	Quote     map[string]*coinMarketCapUsdQuote `json:"quote"`
+}
+
+type coinMarketCapHistorical struct {
+	Symbol string                `json:"symbol"`
+	Slug   string                `json:"slug"`
+	Quotes []*coinMarketCapQuote `json:"quotes"`
+}
+
+// CurrencyPriceGap is a period without candle between two covered periods.
+type CurrencyPriceGap struct {
+	Start time.Time
+	End   time.Time
+}
+
+// CurrencyPriceCoverage describes the candles stored for a currency after an import.
+type CurrencyPriceCoverage struct {
+	Currency   string
+	Imported   int
+	Duplicates int
+	Candles    int
+	From       time.Time
+	To         time.Time
+	Gaps       []*CurrencyPriceGap
+}
+
+// ParseCurrencyPriceInterval parses a candle interval, either a Go duration
+// or a number of days (e.g. 1d).
+func ParseCurrencyPriceInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return 24 * time.Hour, nil
+	}
+	if days, found := strings.CutSuffix(value, "d"); found {
+		count, err := strconv.Atoi(days)
+		if err != nil || count <= 0 {
+			return 0, errors.New(fmt.Sprintf("invalid interval %s", value))
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid interval %s", value))
+	}
+	return interval, nil
+}
+
+func parsePriceTimestamp(value string) (time.Time, error) {
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		if number > 1e12 {
+			return time.UnixMilli(int64(number)).UTC(), nil
+		}
+		return time.Unix(int64(number), 0).UTC(), nil
+	}
+	date, err := utils.ParseDate(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return date.UTC(), nil
+}
+
+func normalizePriceHeader(header string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, strings.ToLower(strings.TrimPrefix(header, "\ufeff")))
+}
+
+// priceCloseTime turns an inclusive close time (23:59:59.999) into the
+// exclusive end of a candle.
+func priceCloseTime(date time.Time) time.Time {
+	if date.Nanosecond() != 0 || date.Second() == 59 {
+		return date.Truncate(time.Second).Add(time.Second)
+	}
+	return date
+}
+
+func newCurrencyPrice(start, end time.Time, open, high, low, close, volume, marketCap float64) *CurrencyPrice {
+	if open == 0 {
+		open = close
+	}
+	if high == 0 {
+		high = math.Max(open, close)
+	}
+	if low == 0 {
+		low = math.Min(open, close)
+	}
+	return &CurrencyPrice{
+		Start:     start,
+		End:       end,
+		Open:      open,
+		High:      high,
+		Low:       low,
+		Close:     close,
+		Avg:       (open + high + low + close) / 4,
+		Volume:    volume,
+		MarketCap: marketCap,
+	}
+}
+
+// fillCurrencyPricesEnd gives an end to the candles read without one: the
+// start of the next candle, or the shortest interval between two candles for
+// the last one.
+func fillCurrencyPricesEnd(candles []*CurrencyPrice) {
+	sort.SliceStable(candles, func(i, j int) bool {
+		return candles[i].Start.Before(candles[j].Start)
+	})
+	interval := time.Duration(0)
+	for i := 1; i < len(candles); i++ {
+		step := candles[i].Start.Sub(candles[i-1].Start)
+		if step > 0 && (interval == 0 || step < interval) {
+			interval = step
+		}
+	}
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+	for i, candle := range candles {
+		if !candle.End.IsZero() {
+			continue
+		}
+		candle.End = candle.Start.Add(interval)
+		if i+1 < len(candles) && candles[i+1].Start.After(candle.Start) && candles[i+1].Start.Before(candle.End) {
+			candle.End = candles[i+1].Start
+		}
+	}
+}
+
+// readCoinGeckoMarketChart groups the prices of a CoinGecko market_chart
+// response in candles of the given interval. Volumes and market caps are the
+// last ones of every candle.
+func readCoinGeckoMarketChart(content []byte, interval time.Duration) ([]*CurrencyPrice, error) {
+	chart := &coinGeckoMarketChart{}
+	if err := json.Unmarshal(content, chart); err != nil {
+		return nil, err
+	}
+	pointValues := func(points [][]float64) map[int64]float64 {
+		values := make(map[int64]float64)
+		for _, point := range points {
+			if len(point) == 2 {
+				values[int64(point[0])] = point[1]
+			}
+		}
+		return values
+	}
+	marketCaps := pointValues(chart.MarketCaps)
+	volumes := pointValues(chart.TotalVolumes)
+
+	candles := make([]*CurrencyPrice, 0)
+	var candle *CurrencyPrice
+	pointsCount, pointsSum := 0, 0.0
+	for _, point := range chart.Prices {
+		if len(point) != 2 || point[1] <= 0 {
+			continue
+		}
+		date := time.UnixMilli(int64(point[0])).UTC()
+		start := date.Truncate(interval)
+		if candle == nil || !candle.Start.Equal(start) {
+			if candle != nil {
+				candle.Avg = pointsSum / float64(pointsCount)
+			}
+			candle = &CurrencyPrice{Start: start, End: start.Add(interval), Open: point[1], High: point[1], Low: point[1]}
+			candles = append(candles, candle)
+			pointsCount, pointsSum = 0, 0.0
+		}
+		candle.High = math.Max(candle.High, point[1])
+		candle.Low = math.Min(candle.Low, point[1])
+		candle.Close = point[1]
+		candle.Volume = volumes[int64(point[0])]
+		candle.MarketCap = marketCaps[int64(point[0])]
+		pointsCount++
+		pointsSum += point[1]
+	}
+	if candle != nil {
+		candle.Avg = pointsSum / float64(pointsCount)
+	}
+	return candles, nil
+}
+
+// readCoinGeckoOhlc reads a CoinGecko ohlc response: [time, open, high, low,
+// close] lists, the time being the end of the candle.
+func readCoinGeckoOhlc(content []byte) ([]*CurrencyPrice, error) {
+	points := make([][]float64, 0)
+	if err := json.Unmarshal(content, &points); err != nil {
+		return nil, err
+	}
+	candles := make([]*CurrencyPrice, 0)
+	for _, point := range points {
+		if len(point) != 5 {
+			return nil, errors.New("ohlc entries must hold 5 values")
+		}
+		candle := newCurrencyPrice(time.Time{}, time.UnixMilli(int64(point[0])).UTC(), point[1], point[2], point[3], point[4], 0, 0)
+		candles = append(candles, candle)
+	}
+	for i, candle := range candles {
+		if i > 0 {
+			candle.Start = candles[i-1].End
+		}
+	}
+	if len(candles) > 1 {
+		candles[0].Start = candles[0].End.Add(-candles[1].End.Sub(candles[1].Start))
+	} else if len(candles) == 1 {
+		candles[0].Start = candles[0].End.Add(-24 * time.Hour)
+	}
+	return candles, nil
+}
+
+// readCoinMarketCapHistorical reads a CoinMarketCap historical response, the
+// data being either one currency or currencies keyed by symbol. The symbol
+// of the file is returned with the candles.
+func readCoinMarketCapHistorical(content []byte) ([]*CurrencyPrice, string, error) {
+	response := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &response); err != nil {
+		return nil, "", err
+	}
+	histories := make([]*coinMarketCapHistorical, 0)
+	history := &coinMarketCapHistorical{}
+	if err := json.Unmarshal(response["data"], history); err == nil && history.Quotes != nil {
+		histories = append(histories, history)
+	} else {
+		bySymbol := make(map[string]json.RawMessage)
+		if err = json.Unmarshal(response["data"], &bySymbol); err != nil {
+			return nil, "", errors.New("unknown CoinMarketCap data layout")
+		}
+		for symbol, rawHistory := range bySymbol {
+			_histories := make([]*coinMarketCapHistorical, 0)
+			if json.Unmarshal(rawHistory, &_histories) != nil {
+				_history := &coinMarketCapHistorical{}
+				if e0 := json.Unmarshal(rawHistory, _history); e0 != nil {
+					return nil, "", e0
+				}
+				_histories = append(_histories, _history)
+			}
+			for _, _history := range _histories {
+				if _history.Symbol == "" {
+					_history.Symbol = symbol
+				}
+				histories = append(histories, _history)
+			}
+		}
+	}
+	if len(histories) != 1 {
+		return nil, "", errors.New(fmt.Sprintf("CoinMarketCap data must hold one currency, %d found", len(histories)))
+	}
+
+	candles := make([]*CurrencyPrice, 0)
+	for _, quote := range histories[0].Quotes {
+		usdQuote, ok := quote.Quote["USD"]
+		if !ok {
+			return nil, "", errors.New("CoinMarketCap quote without USD value")
+		}
+		startValue := quote.TimeOpen
+		if startValue == "" {
+			startValue = quote.Timestamp
+		}
+		if startValue == "" {
+			startValue = usdQuote.Timestamp
+		}
+		start, err := parsePriceTimestamp(startValue)
+		if err != nil {
+			return nil, "", err
+		}
+		end := time.Time{}
+		if quote.TimeClose != "" {
+			if end, err = parsePriceTimestamp(quote.TimeClose); err != nil {
+				return nil, "", err
+			}
+			end = priceCloseTime(end)
+		}
+		closePrice := usdQuote.Close
+		if closePrice == 0 {
+			closePrice = usdQuote.Price
+		}
+		candles = append(candles, newCurrencyPrice(start, end, usdQuote.Open, usdQuote.High, usdQuote.Low, closePrice, usdQuote.Volume, usdQuote.MarketCap))
+	}
+	fillCurrencyPricesEnd(candles)
+	symbol := histories[0].Symbol
+	if symbol == "" {
+		symbol = histories[0].Slug
+	}
+	return candles, symbol, nil
+}
+
+// readOhlcvCsv reads a csv file of candles with a header line, delimited by
+// commas, semicolons or tabs. CoinMarketCap csv downloads use this layout.
+func readOhlcvCsv(content []byte) ([]*CurrencyPrice, error) {
+	firstLine, _, _ := strings.Cut(string(content), "\n")
+	reader := csv.NewReader(strings.NewReader(string(content)))
+	reader.LazyQuotes = true
+	reader.Comma = ','
+	for _, delimiter := range []rune{';', '\t'} {
+		if strings.Count(firstLine, string(delimiter)) > strings.Count(firstLine, string(reader.Comma)) {
+			reader.Comma = delimiter
+		}
+	}
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(map[string]int)
+	for field, aliases := range currencyPriceColumns {
+		for _, alias := range aliases {
+			index := slices.IndexFunc(headers, func(header string) bool {
+				return normalizePriceHeader(header) == alias
+			})
+			if index >= 0 {
+				indexes[field] = index
+				break
+			}
+		}
+	}
+	if _, ok := indexes["start"]; !ok {
+		return nil, errors.New("no date column found")
+	}
+	if _, ok := indexes["close"]; !ok {
+		return nil, errors.New("no close column found")
+	}
+
+	candles := make([]*CurrencyPrice, 0)
+	line := 1
+	for {
+		record, e0 := reader.Read()
+		if errors.Is(e0, io.EOF) {
+			break
+		} else if e0 != nil {
+			return nil, e0
+		}
+		line++
+		values := make(map[string]float64)
+		for _, field := range []string{"open", "high", "low", "close", "volume", "market_cap"} {
+			index, ok := indexes[field]
+			if !ok || index >= len(record) || strings.TrimSpace(record[index]) == "" {
+				continue
+			}
+			value, e1 := strconv.ParseFloat(strings.TrimSpace(record[index]), 64)
+			if e1 != nil {
+				return nil, errors.New(fmt.Sprintf("line %d: invalid %s %s", line, field, record[index]))
+			}
+			values[field] = value
+		}
+		if values["close"] <= 0 {
+			continue
+		}
+		start, e0 := parsePriceTimestamp(record[indexes["start"]])
+		if e0 != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", line, e0.Error()))
+		}
+		end := time.Time{}
+		if index, ok := indexes["end"]; ok && index < len(record) && strings.TrimSpace(record[index]) != "" {
+			if end, e0 = parsePriceTimestamp(record[index]); e0 != nil {
+				return nil, errors.New(fmt.Sprintf("line %d: %s", line, e0.Error()))
+			}
+			end = priceCloseTime(end)
+		}
+		candles = append(candles, newCurrencyPrice(start, end, values["open"], values["high"], values["low"], values["close"], values["volume"], values["market_cap"]))
+	}
+	fillCurrencyPricesEnd(candles)
+	return candles, nil
+}
+
+// ReadCurrencyPricesFile reads candles from a CoinGecko market_chart or ohlc
+// response, a CoinMarketCap historical response or a generic OHLCV csv file.
+// The format is guessed from the file when empty. The symbol found in the
+// file, if any, is returned with the candles.
+func ReadCurrencyPricesFile(filePath, format string, interval time.Duration) ([]*CurrencyPrice, string, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, "", err
+	}
+	if format == "" {
+		if strings.EqualFold(filepath.Ext(filePath), ".csv") {
+			format = "ohlcv"
+		} else {
+			header := make(map[string]json.RawMessage)
+			if json.Unmarshal(content, &header) != nil {
+				format = "coingecko"
+			} else if _, ok := header["prices"]; ok {
+				format = "coingecko"
+			} else if _, ok = header["data"]; ok {
+				format = "coinmarketcap"
+			} else {
+				return nil, "", errors.New("unknown prices file layout")
+			}
+		}
+	}
+	switch format {
+	case "coingecko":
+		if strings.HasPrefix(strings.TrimSpace(string(content)), "[") {
+			candles, e0 := readCoinGeckoOhlc(content)
+			return candles, "", e0
+		}
+		candles, e0 := readCoinGeckoMarketChart(content, interval)
+		return candles, "", e0
+	case "coinmarketcap":
+		if strings.EqualFold(filepath.Ext(filePath), ".csv") {
+			candles, e0 := readOhlcvCsv(content)
+			return candles, "", e0
+		}
+		return readCoinMarketCapHistorical(content)
+	case "ohlcv":
+		candles, e0 := readOhlcvCsv(content)
+		return candles, "", e0
+	}
+	return nil, "", errors.New(fmt.Sprintf("invalid prices format %s", format))
+}
+
+// dedupCurrencyPrices sorts the candles and drops the ones overlapping an
+// earlier candle of the file. It returns the kept candles and the number of
+// dropped ones.
+func dedupCurrencyPrices(candles []*CurrencyPrice) ([]*CurrencyPrice, int) {
+	sort.SliceStable(candles, func(i, j int) bool {
+		return candles[i].Start.Before(candles[j].Start)
+	})
+	kept := make([]*CurrencyPrice, 0)
+	for _, candle := range candles {
+		if !candle.End.After(candle.Start) {
+			continue
+		}
+		if len(kept) > 0 && candle.Start.Before(kept[len(kept)-1].End) {
+			continue
+		}
+		kept = append(kept, candle)
+	}
+	return kept, len(candles) - len(kept)
+}
+
+// resolvePricedCurrency returns the canonical symbol of the registered
+// currencies priced by the given symbol or slug: the ones having it as symbol,
+// price map or price slug. Their aliases (e.g. WETH for ETH) are priced with
+// the candles of the canonical symbol.
+func resolvePricedCurrency(symbol string, dbInstance *mongo.Database) (string, error) {
+	err := LoadCurrencyAliases(dbInstance)
+	if err != nil {
+		return "", err
+	}
+	dbCollection := CollectionInstance(dbInstance, &Currency{})
+	cursor, err := dbCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close(context.Background())
+	results := make([]*Currency, 0)
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return "", err
+	}
+	canonicals := make([]string, 0)
+	for _, result := range results {
+		if strings.EqualFold(result.Symbols, symbol) || strings.EqualFold(result.PriceMap, symbol) || strings.EqualFold(result.PriceSlug, symbol) {
+			if result.Symbols == "" {
+				continue
+			}
+			canonical := CanonicalCurrency("", "", result.Symbols)
+			if !slices.Contains(canonicals, canonical) {
+				canonicals = append(canonicals, canonical)
+			}
+		}
+	}
+	if len(canonicals) == 0 {
+		return "", errors.New(fmt.Sprintf("currency %s is not registered", symbol))
+	}
+	if len(canonicals) > 1 {
+		sort.Strings(canonicals)
+		return "", errors.New(fmt.Sprintf("currency %s prices several currencies (%s)", symbol, strings.Join(canonicals, ", ")))
+	}
+	return canonicals[0], nil
+}
+
+// GetCurrencyPriceCoverage returns the period covered by the stored candles
+// of a currency and the gaps in it.
+func GetCurrencyPriceCoverage(currency string, dbInstance *mongo.Database) (*CurrencyPriceCoverage, error) {
+	pricesCollection := CollectionInstance(dbInstance, &CurrencyPrice{})
+	cursor, err := pricesCollection.Find(context.Background(), bson.M{"currency": currency}, options.Find().SetSort(bson.M{"start": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	coverage := &CurrencyPriceCoverage{Currency: currency, Gaps: make([]*CurrencyPriceGap, 0)}
+	for cursor.Next(context.Background()) {
+		candle := &CurrencyPrice{}
+		if err = cursor.Decode(candle); err != nil {
+			return nil, err
+		}
+		if coverage.Candles == 0 {
+			coverage.From = candle.Start
+		} else if candle.Start.After(coverage.To) {
+			coverage.Gaps = append(coverage.Gaps, &CurrencyPriceGap{Start: coverage.To, End: candle.Start})
+		}
+		if candle.End.After(coverage.To) {
+			coverage.To = candle.End
+		}
+		coverage.Candles++
+	}
+	return coverage, cursor.Err()
+}
+
+// ImportCurrencyPrices stores the candles of a prices file once, under the
+// canonical symbol of the currency priced by the given symbol (or by the
+// symbol found in the file). Stored candles overlapping an imported one are
+// replaced by it, keeping their creation date when starting at the same
+// time. The coverage of the currency is returned to report the gaps left.
+func ImportCurrencyPrices(filePath, format, symbol string, interval time.Duration, dbInstance *mongo.Database) (*CurrencyPriceCoverage, error) {
+	candles, fileSymbol, err := ReadCurrencyPricesFile(filePath, format, interval)
+	if err != nil {
+		return nil, err
+	}
+	if symbol == "" {
+		symbol = fileSymbol
+	}
+	if symbol == "" {
+		return nil, errors.New("no currency given nor found in the prices file")
+	}
+	currency, err := resolvePricedCurrency(symbol, dbInstance)
+	if err != nil {
+		return nil, err
+	}
+	candles, duplicates := dedupCurrencyPrices(candles)
+
+	dbCollection := CollectionInstance(dbInstance, &CurrencyPrice{})
+	dbRequests := make([]mongo.WriteModel, 0)
+	updatedAt := time.Now().UTC()
+	for _, candle := range candles {
+		overlapPayload := bson.M{"currency": currency, "start": bson.M{"$lt": candle.End, "$ne": candle.Start}, "end": bson.M{"$gt": candle.Start}}
+		dbRequests = append(dbRequests, mongo.NewDeleteManyModel().SetFilter(overlapPayload))
+		// Updates skip mgm hooks: updated_at tells which candles came since a USD enrichment
+		filterPayload := bson.M{"currency": currency, "start": candle.Start}
+		dbRequests = append(dbRequests, mongo.NewUpdateOneModel().SetFilter(filterPayload).SetUpdate(bson.D{
+			{"$set", bson.D{
+				{"end", candle.End}, {"open", candle.Open}, {"high", candle.High}, {"low", candle.Low}, {"close", candle.Close},
+				{"avg", candle.Avg}, {"volume", candle.Volume}, {"market_cap", candle.MarketCap}, {"updated_at", updatedAt},
+			}},
+			{"$setOnInsert", bson.D{{"created_at", updatedAt}}},
+		}).SetUpsert(true))
+		if len(dbRequests) == 1000 {
+			if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+				return nil, err
+			}
+			dbRequests = make([]mongo.WriteModel, 0)
+		}
+	}
+	if len(dbRequests) > 0 {
+		if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+			return nil, err
+		}
+	}
+	coverage, err := GetCurrencyPriceCoverage(currency, dbInstance)
+	if err != nil {
+		return nil, err
+	}
+	coverage.Imported = len(candles)
+	coverage.Duplicates = duplicates
+	return coverage, nil
+}
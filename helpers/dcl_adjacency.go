@@ -0,0 +1,103 @@
+package helpers
+
+import (
+	"OpenSeaDataDownloader/utils"
+	"math"
+	"strings"
+)
+
+var (
+	dclRoadParcels     = make(map[utils.GridPoint]bool)
+	dclPlazaParcels    = make(map[utils.GridPoint]*DecentralandFocalPoint)
+	dclDistrictParcels = make(map[utils.GridPoint]*DecentralandFocalPoint)
+	dclGenesisIndex    = utils.NewZoneIndex([]utils.GridPoint{{X: 0, Y: 0}})
+	dclFeaturesCache   = make(map[utils.GridPoint]map[string]any)
+)
+
+// buildDclParcelsOccupation registers which focal point every parcel belongs to.
+func buildDclParcelsOccupation() {
+	dclRoadParcels = make(map[utils.GridPoint]bool)
+	dclPlazaParcels = make(map[utils.GridPoint]*DecentralandFocalPoint)
+	dclDistrictParcels = make(map[utils.GridPoint]*DecentralandFocalPoint)
+	dclFeaturesCache = make(map[utils.GridPoint]map[string]any)
+	for _, road := range dclRoads {
+		for _, point := range utils.ParseGridPoints(road.ParcelsLoc) {
+			dclRoadParcels[point] = true
+		}
+	}
+	for _, plaza := range dclPlazas {
+		for _, point := range dclZoneIndexes[plaza].Points() {
+			dclPlazaParcels[point] = plaza
+		}
+	}
+	for _, district := range dclDistricts {
+		for _, point := range dclZoneIndexes[district].Points() {
+			dclDistrictParcels[point] = district
+		}
+	}
+
+	// Genesis Plaza is found by its name, or else as the plaza holding the map center
+	dclGenesisIndex = utils.NewZoneIndex([]utils.GridPoint{{X: 0, Y: 0}})
+	centerPlaza := dclPlazaParcels[utils.GridPoint{X: 0, Y: 0}]
+	for _, plaza := range dclPlazas {
+		if strings.Contains(strings.ToLower(plaza.Name), "genesis") {
+			centerPlaza = plaza
+			break
+		}
+	}
+	if centerPlaza != nil && len(dclZoneIndexes[centerPlaza].Points()) > 0 {
+		dclGenesisIndex = dclZoneIndexes[centerPlaza]
+	}
+}
+
+// GetDclParcelFeatures returns the containment and adjacency features of a
+// parcel: its district, the roads and plazas it touches, whether it is a
+// corner lot or on the map border, and its ring around Genesis Plaza.
+// Results are cached per parcel and must not be modified.
+func GetDclParcelFeatures(parcelX, parcelY int) map[string]any {
+	parcel := utils.GridPoint{X: parcelX, Y: parcelY}
+	if features, ok := dclFeaturesCache[parcel]; ok {
+		return features
+	}
+
+	district := ""
+	if districtFp, ok := dclDistrictParcels[parcel]; ok {
+		district = strings.ToUpper(districtFp.DclId)
+	}
+	north := dclRoadParcels[utils.GridPoint{X: parcelX, Y: parcelY + 1}]
+	south := dclRoadParcels[utils.GridPoint{X: parcelX, Y: parcelY - 1}]
+	east := dclRoadParcels[utils.GridPoint{X: parcelX + 1, Y: parcelY}]
+	west := dclRoadParcels[utils.GridPoint{X: parcelX - 1, Y: parcelY}]
+	roadSides := 0
+	for _, side := range []bool{north, south, east, west} {
+		if side {
+			roadSides++
+		}
+	}
+	plazaAdjacent := false
+	for _, move := range []utils.GridPoint{{X: 0, Y: 1}, {X: 0, Y: -1}, {X: 1, Y: 0}, {X: -1, Y: 0}} {
+		if _, ok := dclPlazaParcels[utils.GridPoint{X: parcelX + move.X, Y: parcelY + move.Y}]; ok {
+			plazaAdjacent = true
+		}
+	}
+	isCorner := (north || south) && (east || west)
+	onBorder := math.Abs(float64(parcelX)) == DecentralandMapMaxCoord || math.Abs(float64(parcelY)) == DecentralandMapMaxCoord
+
+	features := map[string]any{
+		"LOC__DISTRICT":     district,
+		"LOC__ROAD_ADJ":     roadSides > 0,
+		"LOC__PLAZA_ADJ":    plazaAdjacent,
+		"LOC__ROAD_SIDES":   roadSides,
+		"LOC__CORNER":       isCorner,
+		"LOC__BORDER":       onBorder,
+		"LOC__GENESIS_RING": int(dclGenesisIndex.Distance(parcelX, parcelY, "chebyshev")),
+	}
+	dclFeaturesCache[parcel] = features
+	return features
+}
+
+func GetDclParcelFeaturesHT() (h []string, t []string) {
+	h = []string{"LOC__DISTRICT", "LOC__ROAD_ADJ", "LOC__PLAZA_ADJ", "LOC__ROAD_SIDES", "LOC__CORNER", "LOC__BORDER", "LOC__GENESIS_RING"}
+	t = []string{"string", "bool", "bool", "int", "bool", "bool", "int"}
+	return h, t
+}
@@ -11,11 +11,12 @@ import (
 	"github.com/kamva/mgm/v3"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type DecentralandFPParcelInfo struct {
-	X       int8   `bson:"x"`
-	Y       int8   `bson:"y"`
+	X       int    `bson:"x"`
+	Y       int    `bson:"y"`
 	NftId   string `bson:"nftId"`
 	TokenId string `bson:"tokenId"`
 }
@@ -40,11 +41,18 @@ var (
 	dclDistricts            = make([]*DecentralandFocalPoint, 0)
 	dclDisCategories        = make([]string, 0)
 	dclSmallDistrictMaxSize = 100
+	dclZoneIndexes          = make(map[*DecentralandFocalPoint]*utils.ZoneIndex)
+	dclRoadsIndex           = utils.NewZoneIndex(nil)
+	dclDistancesCache       = make(map[string]map[string]float64)
+	dclWalkingFields        = make(map[*DecentralandFocalPoint]*utils.WalkingField)
+	dclFocalPointsVersion   = ""
 )
 
 func getDclFocalPointsOfType(fpType string, dbInstance *mongo.Database) ([]*DecentralandFocalPoint, error) {
 	dbCollection := CollectionInstance(dbInstance, &DecentralandFocalPoint{})
-	cursor, err := dbCollection.Find(context.Background(), bson.M{"focal_point_type": fpType})
+	// Sorted for the distance columns to keep their order between exports
+	opts := options.Find().SetSort(bson.D{{"dcl_id", 1}})
+	cursor, err := dbCollection.Find(context.Background(), bson.M{"focal_point_type": fpType}, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -71,20 +79,91 @@ func GetDclFocalPoints(dbInstance *mongo.Database) error {
 	if err != nil {
 		return err
 	}
+	dclDisCategories = make([]string, 0)
 	for _, district := range dclDistricts {
 		if !slices.Contains(dclDisCategories, strings.Split(district.Category, " ")[0]) {
 			dclDisCategories = append(dclDisCategories, strings.Split(district.Category, " ")[0])
 		}
 	}
+	buildDclFocalPointsIndexes()
 	return nil
 }
 
+// buildDclFocalPointsIndexes parses the parcels locations of every focal point
+// once. All roads share a single index as only the closest road matters.
+func buildDclFocalPointsIndexes() {
+	dclZoneIndexes = make(map[*DecentralandFocalPoint]*utils.ZoneIndex)
+	dclDistancesCache = make(map[string]map[string]float64)
+	for _, plaza := range dclPlazas {
+		dclZoneIndexes[plaza] = utils.NewZoneIndexFromLoc(plaza.ParcelsLoc)
+	}
+	for _, district := range dclDistricts {
+		dclZoneIndexes[district] = utils.NewZoneIndexFromLoc(district.ParcelsLoc)
+	}
+	roadsPoints := make([]utils.GridPoint, 0)
+	for _, road := range dclRoads {
+		roadsPoints = append(roadsPoints, utils.ParseGridPoints(road.ParcelsLoc)...)
+	}
+	dclRoadsIndex = utils.NewZoneIndex(roadsPoints)
+	dclWalkingFields = make(map[*DecentralandFocalPoint]*utils.WalkingField)
+	utils.SetWalkingGraph(utils.NewRoadGraph(roadsPoints))
+	buildDclParcelsOccupation()
+	dclFocalPointsVersion = computeDclFocalPointsVersion()
+}
+
+// computeDclFocalPointsVersion hashes the identifiers and parcels of all the
+// focal points, so that exports computed with the same set share a version.
+func computeDclFocalPointsVersion() string {
+	keys := make([]string, 0)
+	for _, focalPoints := range [][]*DecentralandFocalPoint{dclPlazas, dclRoads, dclDistricts} {
+		for _, focalPoint := range focalPoints {
+			parcelsLoc := slices.Clone(focalPoint.ParcelsLoc)
+			slices.Sort(parcelsLoc)
+			keys = append(keys, fmt.Sprintf("%s:%s:%s", focalPoint.FocalPointType, focalPoint.DclId, strings.Join(parcelsLoc, ";")))
+		}
+	}
+	slices.Sort(keys)
+	return utils.CreateHash(strings.Join(keys, "|"))
+}
+
+// GetDclFocalPointsVersion returns the version of the loaded focal points set.
+func GetDclFocalPointsVersion() string {
+	return dclFocalPointsVersion
+}
+
+// dclDistanceToZone computes the distance from a parcel to a plaza or a
+// district. With the walking metric, the distances through roads to the zone
+// are computed once and then shared by every parcel.
+func dclDistanceToZone(parcelX, parcelY int, focalPoint *DecentralandFocalPoint, metric string) float64 {
+	if metric == "walking" {
+		field, ok := dclWalkingFields[focalPoint]
+		if !ok {
+			field = utils.NewRoadGraphField(dclZoneIndexes[focalPoint].Points())
+			dclWalkingFields[focalPoint] = field
+		}
+		return field.Distance(parcelX, parcelY)
+	}
+	return dclZoneIndexes[focalPoint].Distance(parcelX, parcelY, metric)
+}
+
+// GetDclDistanceToFocalPoints returns the distances from a parcel to the focal
+// points. Results are cached per parcel and metric, and must not be modified.
 func GetDclDistanceToFocalPoints(parcelX, parcelY int, metric string) map[string]float64 {
+	cacheKey := fmt.Sprintf("%s:%d,%d", metric, parcelX, parcelY)
+	if distances, ok := dclDistancesCache[cacheKey]; ok {
+		return distances
+	}
+	distances := computeDclDistanceToFocalPoints(parcelX, parcelY, metric)
+	dclDistancesCache[cacheKey] = distances
+	return distances
+}
+
+func computeDclDistanceToFocalPoints(parcelX, parcelY int, metric string) map[string]float64 {
 	distances := make(map[string]float64)
 
 	distanceMin := math.MaxFloat64
 	for _, plaza := range dclPlazas {
-		plazaDis := utils.Distance1Point1ZoneLoc(parcelX, parcelY, plaza.ParcelsLoc, metric)
+		plazaDis := dclDistanceToZone(parcelX, parcelY, plaza, metric)
 		key := fmt.Sprintf("DIS__PLAZA__%s", strings.ToUpper(plaza.DclId))
 		distances[key] = plazaDis
 		if plazaDis < distanceMin {
@@ -93,14 +172,12 @@ func GetDclDistanceToFocalPoints(parcelX, parcelY int, metric string) map[string
 	}
 	distances["DIS__PLAZA"] = distanceMin
 
-	distanceMin = math.MaxFloat64
-	for _, road := range dclRoads {
-		roadDis := utils.Distance1Point1ZoneLoc(parcelX, parcelY, road.ParcelsLoc, metric)
-		if roadDis < distanceMin {
-			distanceMin = roadDis
-		}
+	if metric == "walking" {
+		// Reaching the closest road is done off-road, parcel by parcel
+		distances["DIS__ROAD"] = dclRoadsIndex.Distance(parcelX, parcelY, "manhattan")
+	} else {
+		distances["DIS__ROAD"] = dclRoadsIndex.Distance(parcelX, parcelY, metric)
 	}
-	distances["DIS__ROAD"] = distanceMin
 
 	distCatDistancesMap := map[string]float64{}
 	for _, category := range dclDisCategories {
@@ -108,7 +185,7 @@ func GetDclDistanceToFocalPoints(parcelX, parcelY int, metric string) map[string
 	}
 	distanceMin = math.MaxFloat64
 	for _, district := range dclDistricts {
-		districtDis := utils.Distance1Point1ZoneLoc(parcelX, parcelY, district.ParcelsLoc, metric)
+		districtDis := dclDistanceToZone(parcelX, parcelY, district, metric)
 		key := fmt.Sprintf("DIS__DISTRICT__%s", strings.ToUpper(district.DclId))
 		distances[key] = districtDis
 		if district.ParcelsCount > dclSmallDistrictMaxSize {
@@ -130,6 +207,32 @@ func GetDclDistanceToFocalPoints(parcelX, parcelY int, metric string) map[string
 	return distances
 }
 
+// DescribeDclDistanceColumn returns the description of a distance column.
+func DescribeDclDistanceColumn(header string) string {
+	switch header {
+	case "DIS__PLAZA":
+		return "Distance to the closest plaza"
+	case "DIS__ROAD":
+		return "Distance to the closest road"
+	case "DIS__DISTRICT":
+		return "Distance to the closest district"
+	}
+	for _, plaza := range dclPlazas {
+		if header == fmt.Sprintf("DIS__PLAZA__%s", strings.ToUpper(plaza.DclId)) {
+			return fmt.Sprintf("Distance to the plaza %s (%s)", plaza.Name, plaza.DclId)
+		}
+	}
+	for _, district := range dclDistricts {
+		if header == fmt.Sprintf("DIS__DISTRICT__%s", strings.ToUpper(district.DclId)) {
+			return fmt.Sprintf("Distance to the district %s (%s)", district.Name, district.DclId)
+		}
+	}
+	if category, ok := strings.CutPrefix(header, "DIS__DISTCAT__"); ok {
+		return fmt.Sprintf("Distance to the closest district of category %s with more than %d parcels", category, dclSmallDistrictMaxSize)
+	}
+	return ""
+}
+
 func GetDclDistanceToFocalPointsHT() (h []string, t []string) {
 	h = make([]string, 0)
 	t = make([]string, 0)
@@ -145,19 +248,17 @@ func GetDclDistanceToFocalPointsHT() (h []string, t []string) {
 	h = append(h, "DIS__ROAD")
 	t = append(t, "float64")
 
-	distCatDistancesMap := map[string]float64{}
-	for _, category := range dclDisCategories {
-		distCatDistancesMap[strings.ToUpper(category)] = math.MaxFloat64
-	}
 	for _, district := range dclDistricts {
 		key := fmt.Sprintf("DIS__DISTRICT__%s", strings.ToUpper(district.DclId))
 		h = append(h, key)
 		t = append(t, "float64")
 	}
-	for category, _ := range distCatDistancesMap {
-		key := fmt.Sprintf("DIS__DISTCAT__%s", category)
-		h = append(h, key)
-		t = append(t, "float64")
+	for _, category := range dclDisCategories {
+		key := fmt.Sprintf("DIS__DISTCAT__%s", strings.ToUpper(category))
+		if !slices.Contains(h, key) {
+			h = append(h, key)
+			t = append(t, "float64")
+		}
 	}
 	h = append(h, "DIS__DISTRICT")
 	t = append(t, "float64")
@@ -0,0 +1,427 @@
+package helpers
+
+import (
+	"OpenSeaDataDownloader/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	DecentralandLandContract = "0xf87e31492faf9a91b02ee0deaad50d51d56d5d4d"
+	DecentralandMapMinCoord  = -150
+	DecentralandMapMaxCoord  = 150
+)
+
+var (
+	DclFocalPointTypes       = []string{"plaza", "road", "district"}
+	dclFocalPointCategoryExp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9&\-]*( .*)?$`)
+)
+
+type DecentralandFocalPointInput struct {
+	Id          string   `mapstructure:"id"`
+	Type        string   `mapstructure:"type"`
+	EstateId    string   `mapstructure:"estate_id"`
+	Name        string   `mapstructure:"name"`
+	Description string   `mapstructure:"description"`
+	Category    string   `mapstructure:"category"`
+	Parcels     []string `mapstructure:"parcels"`
+}
+
+type DecentralandFocalPointInputList struct {
+	Data []*DecentralandFocalPointInput `mapstructure:"data"`
+}
+
+type geoJsonGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type geoJsonFeature struct {
+	Type       string           `json:"type"`
+	Properties map[string]any   `json:"properties"`
+	Geometry   *geoJsonGeometry `json:"geometry"`
+}
+
+type geoJsonFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*geoJsonFeature `json:"features"`
+}
+
+type DecentralandFocalPointIssue struct {
+	FocalPointId   string
+	FocalPointType string
+	Message        string
+}
+
+func ParseDclParcelLoc(loc string) (x, y int, err error) {
+	coords := strings.Split(strings.TrimSpace(loc), ",")
+	if len(coords) != 2 {
+		return 0, 0, errors.New(fmt.Sprintf("invalid parcel location %s", loc))
+	}
+	x, err = strconv.Atoi(strings.TrimSpace(coords[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err = strconv.Atoi(strings.TrimSpace(coords[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	if x < DecentralandMapMinCoord || x > DecentralandMapMaxCoord || y < DecentralandMapMinCoord || y > DecentralandMapMaxCoord {
+		return 0, 0, errors.New(fmt.Sprintf("parcel location %s out of map", loc))
+	}
+	return x, y, nil
+}
+
+func geoJsonPropertyString(properties map[string]any, keys ...string) string {
+	for _, key := range keys {
+		value, ok := properties[key]
+		if ok && value != nil {
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
+// geoJsonRingContains tells whether the point is inside the ring (ray casting).
+func geoJsonRingContains(ring [][]float64, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi, xj, yj := ring[i][0], ring[i][1], ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// geoJsonPolygonParcels returns the parcels covered by a polygon drawn in parcel
+// coordinates. Parcel (x, y) is the square [x, x+1] x [y, y+1] and is covered
+// when its center lies inside the outer ring and outside every hole.
+func geoJsonPolygonParcels(polygon [][][]float64) []string {
+	if len(polygon) == 0 {
+		return nil
+	}
+	minX, minY, maxX, maxY := math.MaxFloat64, math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64
+	for _, point := range polygon[0] {
+		minX, maxX = math.Min(minX, point[0]), math.Max(maxX, point[0])
+		minY, maxY = math.Min(minY, point[1]), math.Max(maxY, point[1])
+	}
+	parcels := make([]string, 0)
+	for x := int(math.Floor(minX)); x <= int(math.Ceil(maxX)); x++ {
+		for y := int(math.Floor(minY)); y <= int(math.Ceil(maxY)); y++ {
+			cx, cy := float64(x)+0.5, float64(y)+0.5
+			if !geoJsonRingContains(polygon[0], cx, cy) {
+				continue
+			}
+			inHole := false
+			for _, hole := range polygon[1:] {
+				if geoJsonRingContains(hole, cx, cy) {
+					inHole = true
+					break
+				}
+			}
+			if !inHole {
+				parcels = append(parcels, fmt.Sprintf("%d,%d", x, y))
+			}
+		}
+	}
+	return parcels
+}
+
+// geoJsonPointParcel returns the parcel containing a point drawn in parcel
+// coordinates, parcel (x, y) being the square [x, x+1] x [y, y+1].
+func geoJsonPointParcel(point []float64) (string, error) {
+	if len(point) < 2 {
+		return "", errors.New(fmt.Sprintf("invalid point coordinates %v", point))
+	}
+	return fmt.Sprintf("%d,%d", int(math.Floor(point[0])), int(math.Floor(point[1]))), nil
+}
+
+// geoJsonCheckPolygon checks that a polygon has an outer ring and that every
+// position of its rings has two coordinates.
+func geoJsonCheckPolygon(polygon [][][]float64) error {
+	if len(polygon) == 0 || len(polygon[0]) == 0 {
+		return errors.New("polygon without outer ring")
+	}
+	for _, ring := range polygon {
+		for _, point := range ring {
+			if len(point) < 2 {
+				return errors.New(fmt.Sprintf("invalid polygon coordinates %v", point))
+			}
+		}
+	}
+	return nil
+}
+
+func geoJsonGeometryParcels(geometry *geoJsonGeometry) ([]string, error) {
+	if geometry == nil {
+		return nil, errors.New("feature without geometry")
+	}
+	parcels := make([]string, 0)
+	switch geometry.Type {
+	case "Point":
+		var point []float64
+		if err := json.Unmarshal(geometry.Coordinates, &point); err != nil {
+			return nil, err
+		}
+		parcel, err := geoJsonPointParcel(point)
+		if err != nil {
+			return nil, err
+		}
+		parcels = append(parcels, parcel)
+	case "MultiPoint":
+		var points [][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &points); err != nil {
+			return nil, err
+		}
+		if len(points) == 0 {
+			return nil, errors.New("multipoint without coordinates")
+		}
+		for _, point := range points {
+			parcel, err := geoJsonPointParcel(point)
+			if err != nil {
+				return nil, err
+			}
+			parcels = append(parcels, parcel)
+		}
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &polygon); err != nil {
+			return nil, err
+		}
+		if err := geoJsonCheckPolygon(polygon); err != nil {
+			return nil, err
+		}
+		parcels = append(parcels, geoJsonPolygonParcels(polygon)...)
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+		for _, polygon := range polygons {
+			if err := geoJsonCheckPolygon(polygon); err != nil {
+				return nil, err
+			}
+			parcels = append(parcels, geoJsonPolygonParcels(polygon)...)
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported geometry type %s", geometry.Type))
+	}
+	return parcels, nil
+}
+
+func readDclFocalPointsGeoJson(content []byte) ([]*DecentralandFocalPointInput, error) {
+	collection := &geoJsonFeatureCollection{}
+	err := json.Unmarshal(content, collection)
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([]*DecentralandFocalPointInput, 0)
+	for i, feature := range collection.Features {
+		parcels, e0 := geoJsonGeometryParcels(feature.Geometry)
+		if e0 != nil {
+			return nil, errors.New(fmt.Sprintf("feature #%d: %s", i, e0.Error()))
+		}
+		if feature.Properties == nil {
+			feature.Properties = make(map[string]any)
+		}
+		inputs = append(inputs, &DecentralandFocalPointInput{
+			Id:          geoJsonPropertyString(feature.Properties, "id", "dcl_id"),
+			Type:        geoJsonPropertyString(feature.Properties, "type", "focal_point_type"),
+			EstateId:    geoJsonPropertyString(feature.Properties, "estate_id", "estateId"),
+			Name:        geoJsonPropertyString(feature.Properties, "name"),
+			Description: geoJsonPropertyString(feature.Properties, "description"),
+			Category:    geoJsonPropertyString(feature.Properties, "category"),
+			Parcels:     parcels,
+		})
+	}
+	return inputs, nil
+}
+
+// ReadDclFocalPointsFile reads focal points either from a GeoJSON feature
+// collection or from the Decentraland district/plaza JSON format (a list, or
+// an object with a `data` list, of items holding `parcels` as "x,y" strings).
+func ReadDclFocalPointsFile(filePath string) ([]*DecentralandFocalPointInput, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	header := make(map[string]any)
+	if json.Unmarshal(content, &header) == nil && header["type"] == "FeatureCollection" {
+		return readDclFocalPointsGeoJson(content)
+	}
+	resp := &DecentralandFocalPointInputList{}
+	err = utils.ReadJsonFile(filePath, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func newDclFocalPoint(input *DecentralandFocalPointInput, fpType string, date time.Time) (*DecentralandFocalPoint, error) {
+	if input.Type != "" {
+		fpType = strings.ToLower(input.Type)
+	}
+	if !slices.Contains(DclFocalPointTypes, fpType) {
+		return nil, errors.New(fmt.Sprintf("focal point %s: invalid type %s", input.Id, fpType))
+	}
+	if input.Id == "" {
+		return nil, errors.New(fmt.Sprintf("%s focal point without id", fpType))
+	}
+	parcelsLoc := make([]string, 0)
+	parcels := make([]*DecentralandFPParcelInfo, 0)
+	for _, loc := range input.Parcels {
+		x, y, err := ParseDclParcelLoc(loc)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("focal point %s: %s", input.Id, err.Error()))
+		}
+		normalizedLoc := fmt.Sprintf("%d,%d", x, y)
+		if slices.Contains(parcelsLoc, normalizedLoc) {
+			continue
+		}
+		parcelsLoc = append(parcelsLoc, normalizedLoc)
+		parcelInfo := &DecentralandFPParcelInfo{X: x, Y: y}
+		parcel, ok := GetDclParcelAtLoc(x, y, date)
+		if ok && parcel.TokenId != "" {
+			parcelInfo.TokenId = parcel.TokenId
+			parcelInfo.NftId = fmt.Sprintf("%s-%s", DecentralandLandContract, parcel.TokenId)
+		}
+		parcels = append(parcels, parcelInfo)
+	}
+	return &DecentralandFocalPoint{
+		FocalPointId:   utils.CreateHash(fmt.Sprintf("%s:%s", fpType, input.Id)),
+		FocalPointType: fpType,
+		EstateId:       input.EstateId,
+		DclId:          input.Id,
+		Name:           input.Name,
+		Description:    input.Description,
+		ParcelsLoc:     parcelsLoc,
+		ParcelsCount:   len(parcelsLoc),
+		Parcels:        parcels,
+		Category:       input.Category,
+	}, nil
+}
+
+// ImportDclFocalPoints upserts focal points read from a file. fpType is used
+// for items which do not carry their own type.
+func ImportDclFocalPoints(filePath, fpType string, dbInstance *mongo.Database) (int, error) {
+	inputs, err := ReadDclFocalPointsFile(filePath)
+	if err != nil {
+		return 0, err
+	}
+	focalPoints := make([]*DecentralandFocalPoint, 0)
+	for _, input := range inputs {
+		focalPoint, e0 := newDclFocalPoint(input, fpType, time.Now())
+		if e0 != nil {
+			return 0, e0
+		}
+		focalPoints = append(focalPoints, focalPoint)
+	}
+	if len(focalPoints) == 0 {
+		return 0, nil
+	}
+	dbCollection := CollectionInstance(dbInstance, &DecentralandFocalPoint{})
+	dbRequests := make([]mongo.WriteModel, len(focalPoints))
+	for i, focalPoint := range focalPoints {
+		filterPayload := bson.M{"focal_point_type": focalPoint.FocalPointType, "dcl_id": focalPoint.DclId}
+		dbRequests[i] = mongo.NewReplaceOneModel().SetFilter(filterPayload).SetReplacement(focalPoint).SetUpsert(true)
+	}
+	_, err = dbCollection.BulkWrite(context.Background(), dbRequests)
+	if err != nil {
+		return 0, err
+	}
+	return len(focalPoints), nil
+}
+
+// ListDclFocalPoints returns the stored focal points of the given type, or of every type if empty.
+func ListDclFocalPoints(fpType string, dbInstance *mongo.Database) ([]*DecentralandFocalPoint, error) {
+	focalPoints := make([]*DecentralandFocalPoint, 0)
+	for _, _fpType := range DclFocalPointTypes {
+		if fpType != "" && fpType != _fpType {
+			continue
+		}
+		_focalPoints, err := getDclFocalPointsOfType(_fpType, dbInstance)
+		if err != nil {
+			return nil, err
+		}
+		focalPoints = append(focalPoints, _focalPoints...)
+	}
+	return focalPoints, nil
+}
+
+// ValidateDclFocalPoints checks the consistency of the focal points: parcels
+// locations and parcels info must agree, parcels counts must be right,
+// district categories must parse and no parcel may belong to two districts.
+func ValidateDclFocalPoints(focalPoints []*DecentralandFocalPoint) []*DecentralandFocalPointIssue {
+	issues := make([]*DecentralandFocalPointIssue, 0)
+	addIssue := func(focalPoint *DecentralandFocalPoint, message string) {
+		issues = append(issues, &DecentralandFocalPointIssue{
+			FocalPointId:   focalPoint.DclId,
+			FocalPointType: focalPoint.FocalPointType,
+			Message:        message,
+		})
+	}
+	districtsPerParcel := make(map[string]string)
+	for _, focalPoint := range focalPoints {
+		if !slices.Contains(DclFocalPointTypes, focalPoint.FocalPointType) {
+			addIssue(focalPoint, fmt.Sprintf("unknown focal point type %s", focalPoint.FocalPointType))
+		}
+		if focalPoint.ParcelsCount != len(focalPoint.ParcelsLoc) {
+			addIssue(focalPoint, fmt.Sprintf("parcels count is %d but %d parcels locations are listed", focalPoint.ParcelsCount, len(focalPoint.ParcelsLoc)))
+		}
+
+		locations := make(map[string]bool)
+		for _, loc := range focalPoint.ParcelsLoc {
+			x, y, err := ParseDclParcelLoc(loc)
+			if err != nil {
+				addIssue(focalPoint, err.Error())
+				continue
+			}
+			normalizedLoc := fmt.Sprintf("%d,%d", x, y)
+			if locations[normalizedLoc] {
+				addIssue(focalPoint, fmt.Sprintf("parcel %s listed twice", normalizedLoc))
+			}
+			locations[normalizedLoc] = true
+
+			if focalPoint.FocalPointType == "district" {
+				otherDistrict, claimed := districtsPerParcel[normalizedLoc]
+				if claimed && otherDistrict != focalPoint.DclId {
+					addIssue(focalPoint, fmt.Sprintf("parcel %s also claimed by district %s", normalizedLoc, otherDistrict))
+				} else {
+					districtsPerParcel[normalizedLoc] = focalPoint.DclId
+				}
+			}
+		}
+
+		infoLocations := make(map[string]bool)
+		for _, parcel := range focalPoint.Parcels {
+			infoLoc := fmt.Sprintf("%d,%d", parcel.X, parcel.Y)
+			infoLocations[infoLoc] = true
+			if !locations[infoLoc] {
+				addIssue(focalPoint, fmt.Sprintf("parcel %s in parcels info but not in parcels locations", infoLoc))
+			}
+		}
+		for loc := range locations {
+			if !infoLocations[loc] {
+				addIssue(focalPoint, fmt.Sprintf("parcel %s in parcels locations but not in parcels info", loc))
+			}
+		}
+
+		if focalPoint.FocalPointType == "district" && !dclFocalPointCategoryExp.MatchString(focalPoint.Category) {
+			addIssue(focalPoint, fmt.Sprintf("category `%s` cannot be parsed", focalPoint.Category))
+		}
+	}
+	return issues
+}
@@ -2,14 +2,33 @@ package helpers
 
 import (
 	"OpenSeaDataDownloader/utils"
+	"context"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const DecentralandTilesApiUrl = "https://api.decentraland.org/v2/tiles"
+
 type DecentralandParcel struct {
-	Id      string `mapstructure:"id"`
-	X       int    `mapstructure:"x"`
-	Y       int    `mapstructure:"y"`
-	TokenId string `mapstructure:"tokenId"`
+	Id        string `mapstructure:"id"`
+	X         int    `mapstructure:"x"`
+	Y         int    `mapstructure:"y"`
+	TokenId   string `mapstructure:"tokenId"`
+	Type      string `mapstructure:"type"`
+	Name      string `mapstructure:"name"`
+	Owner     string `mapstructure:"owner"`
+	EstateId  string `mapstructure:"estateId"`
+	UpdatedAt int64  `mapstructure:"updatedAt"`
 }
 
 type DecentralandParcelList struct {
@@ -17,6 +36,39 @@ type DecentralandParcelList struct {
 	Data map[string]*DecentralandParcel `mapstructure:"data"`
 }
 
+// DecentralandParcelVersion is one state of a parcel, valid from SnapshotDate
+// until the next version of the same parcel.
+type DecentralandParcelVersion struct {
+	mgm.DefaultModel `bson:",inline"`
+	ParcelId         string    `bson:"parcel_id"`
+	X                int       `bson:"x"`
+	Y                int       `bson:"y"`
+	TokenId          string    `bson:"token_id"`
+	Type             string    `bson:"type,omitempty"`
+	Name             string    `bson:"name,omitempty"`
+	Owner            string    `bson:"owner,omitempty"`
+	EstateId         string    `bson:"estate_id,omitempty"`
+	SnapshotDate     time.Time `bson:"snapshot_date"`
+	Hash             string    `bson:"hash"`
+}
+
+type DecentralandParcelsSnapshot struct {
+	mgm.DefaultModel `bson:",inline"`
+	SnapshotDate     time.Time `bson:"snapshot_date"`
+	Source           string    `bson:"source"`
+	ParcelsCount     int       `bson:"parcels_count"`
+	ChangedCount     int       `bson:"changed_count"`
+}
+
+func (v DecentralandParcelVersion) CollectionName() string {
+	return "decentraland_parcels"
+}
+
+var (
+	dclParcelVersions      = make(map[string][]*DecentralandParcelVersion)
+	dclParcelVersionsByLoc = make(map[string][]*DecentralandParcelVersion)
+)
+
 func ReadDecentralandParcels() map[string]*DecentralandParcel {
 	filePath := filepath.Join("data", "decentraland_parcels.json")
 	resp := &DecentralandParcelList{}
@@ -30,3 +82,210 @@ func ReadDecentralandParcels() map[string]*DecentralandParcel {
 	}
 	return parcelsList
 }
+
+func readDecentralandTiles(source string) (*DecentralandParcelList, error) {
+	resp := &DecentralandParcelList{}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		rawResp := make(map[string]any)
+		err := utils.SendHttpRequest(source, "GET", nil, nil, &rawResp)
+		if err != nil {
+			return nil, err
+		}
+		err = utils.ConvertMapToStruct(rawResp, resp)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := utils.ReadJsonFile(source, resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.Data == nil || len(resp.Data) == 0 {
+		return nil, errors.New("no parcel found in tiles data")
+	}
+	return resp, nil
+}
+
+func newDclParcelVersion(parcel *DecentralandParcel, snapshotDate time.Time) *DecentralandParcelVersion {
+	parcelId := parcel.Id
+	if parcelId == "" {
+		parcelId = fmt.Sprintf("%d,%d", parcel.X, parcel.Y)
+	}
+	hashPayload := fmt.Sprintf("%s:%s:%s:%s:%s:%s", parcelId, parcel.TokenId, parcel.Type, parcel.Name, parcel.Owner, parcel.EstateId)
+	return &DecentralandParcelVersion{
+		ParcelId:     parcelId,
+		X:            parcel.X,
+		Y:            parcel.Y,
+		TokenId:      parcel.TokenId,
+		Type:         parcel.Type,
+		Name:         parcel.Name,
+		Owner:        parcel.Owner,
+		EstateId:     parcel.EstateId,
+		SnapshotDate: snapshotDate,
+		Hash:         utils.CreateHash(hashPayload),
+	}
+}
+
+func (v *DecentralandParcelVersion) toParcel() *DecentralandParcel {
+	return &DecentralandParcel{
+		Id:       v.ParcelId,
+		X:        v.X,
+		Y:        v.Y,
+		TokenId:  v.TokenId,
+		Type:     v.Type,
+		Name:     v.Name,
+		Owner:    v.Owner,
+		EstateId: v.EstateId,
+	}
+}
+
+func getDclParcelLatestVersions(snapshotDate time.Time, dbInstance *mongo.Database) (map[string]*DecentralandParcelVersion, error) {
+	dbCollection := CollectionInstance(dbInstance, &DecentralandParcelVersion{})
+	opts := options.Find().SetSort(bson.M{"snapshot_date": 1})
+	cursor, err := dbCollection.Find(context.Background(), bson.M{"snapshot_date": bson.M{"$lte": snapshotDate}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	latestVersions := make(map[string]*DecentralandParcelVersion)
+	for cursor.Next(context.Background()) {
+		version := &DecentralandParcelVersion{}
+		if err = cursor.Decode(version); err != nil {
+			return nil, err
+		}
+		latestVersions[version.ParcelId] = version
+	}
+	return latestVersions, cursor.Err()
+}
+
+// ImportDecentralandParcels stores a snapshot of the Decentraland tiles API
+// (read from an url or a saved copy). Only parcels which changed since the
+// previous snapshot get a new version.
+func ImportDecentralandParcels(source string, snapshotDate time.Time, dbInstance *mongo.Database) (*DecentralandParcelsSnapshot, error) {
+	tiles, err := readDecentralandTiles(source)
+	if err != nil {
+		return nil, err
+	}
+	latestVersions, err := getDclParcelLatestVersions(snapshotDate, dbInstance)
+	if err != nil {
+		return nil, err
+	}
+
+	dbCollection := CollectionInstance(dbInstance, &DecentralandParcelVersion{})
+	dbRequests := make([]mongo.WriteModel, 0)
+	changedCount := 0
+	for _, parcel := range tiles.Data {
+		version := newDclParcelVersion(parcel, snapshotDate)
+		latestVersion, exists := latestVersions[version.ParcelId]
+		if exists && latestVersion.Hash == version.Hash {
+			continue
+		}
+		changedCount++
+		filterPayload := bson.M{"parcel_id": version.ParcelId, "snapshot_date": version.SnapshotDate}
+		dbRequests = append(dbRequests, mongo.NewReplaceOneModel().SetFilter(filterPayload).SetReplacement(version).SetUpsert(true))
+		if len(dbRequests) == 1000 {
+			if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+				return nil, err
+			}
+			dbRequests = make([]mongo.WriteModel, 0)
+		}
+	}
+	if len(dbRequests) > 0 {
+		if _, err = dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshot := &DecentralandParcelsSnapshot{
+		SnapshotDate: snapshotDate,
+		Source:       source,
+		ParcelsCount: len(tiles.Data),
+		ChangedCount: changedCount,
+	}
+	err = CollectionInstance(dbInstance, snapshot).Create(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// LoadDecentralandParcels loads every parcel version in memory. When no
+// snapshot has been imported yet, the static ./data file is used instead, and
+// it fails when there is none.
+func LoadDecentralandParcels(dbInstance *mongo.Database) error {
+	dclParcelVersions = make(map[string][]*DecentralandParcelVersion)
+	dclParcelVersionsByLoc = make(map[string][]*DecentralandParcelVersion)
+
+	dbCollection := CollectionInstance(dbInstance, &DecentralandParcelVersion{})
+	opts := options.Find().SetSort(bson.M{"snapshot_date": 1})
+	cursor, err := dbCollection.Find(context.Background(), bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	versionsCount := 0
+	for cursor.Next(context.Background()) {
+		version := &DecentralandParcelVersion{}
+		if err = cursor.Decode(version); err != nil {
+			return err
+		}
+		addDclParcelVersion(version)
+		versionsCount++
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+
+	if versionsCount == 0 {
+		if _, e0 := os.Stat(filepath.Join("data", "decentraland_parcels.json")); e0 != nil {
+			return errors.New("no decentraland parcels snapshot nor data/decentraland_parcels.json file, run -p parcels -a import first")
+		}
+		for _, parcel := range ReadDecentralandParcels() {
+			addDclParcelVersion(newDclParcelVersion(parcel, time.Time{}))
+		}
+	}
+	return nil
+}
+
+func addDclParcelVersion(version *DecentralandParcelVersion) {
+	if version.TokenId != "" {
+		dclParcelVersions[version.TokenId] = append(dclParcelVersions[version.TokenId], version)
+	}
+	dclParcelVersionsByLoc[version.ParcelId] = append(dclParcelVersionsByLoc[version.ParcelId], version)
+}
+
+func findDclParcelVersionAt(versions []*DecentralandParcelVersion, date time.Time) *DecentralandParcelVersion {
+	if len(versions) == 0 {
+		return nil
+	}
+	index, _ := slices.BinarySearchFunc(versions, date, func(v *DecentralandParcelVersion, t time.Time) int {
+		if v.SnapshotDate.After(t) {
+			return 1
+		}
+		return -1
+	})
+	if index == 0 {
+		// Operation older than the first snapshot: the oldest known state is the best guess
+		return versions[0]
+	}
+	return versions[index-1]
+}
+
+// GetDclParcelAt returns the parcel identified by its token id, as it was at the given date.
+func GetDclParcelAt(tokenId string, date time.Time) (*DecentralandParcel, bool) {
+	version := findDclParcelVersionAt(dclParcelVersions[tokenId], date)
+	if version == nil {
+		return nil, false
+	}
+	return version.toParcel(), true
+}
+
+// GetDclParcelAtLoc returns the parcel located at (x, y), as it was at the given date.
+func GetDclParcelAtLoc(x, y int, date time.Time) (*DecentralandParcel, bool) {
+	version := findDclParcelVersionAt(dclParcelVersionsByLoc[fmt.Sprintf("%d,%d", x, y)], date)
+	if version == nil {
+		return nil, false
+	}
+	return version.toParcel(), true
+}
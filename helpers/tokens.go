@@ -0,0 +1,236 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NativeTokenContract is the address marketplaces give to the native currency
+// of a blockchain.
+const NativeTokenContract = "0x0000000000000000000000000000000000000000"
+
+// TokenRegistration is a payment token met in the operations but missing from
+// the Currency collection (or registered without decimals), waiting to be
+// registered. Symbol and Decimals are the hints given by the marketplace.
+type TokenRegistration struct {
+	mgm.DefaultModel `bson:",inline"`
+	Blockchain       string    `bson:"blockchain"`
+	Contract         string    `bson:"contract"`
+	Symbol           string    `bson:"symbol,omitempty"`
+	Decimals         int64     `bson:"decimals,omitempty"`
+	Source           string    `bson:"source,omitempty"`
+	Occurrences      int64     `bson:"occurrences"`
+	FirstSeen        time.Time `bson:"first_seen"`
+	LastSeen         time.Time `bson:"last_seen"`
+	Registered       bool      `bson:"registered"`
+}
+
+// defaultNativeTokens are the native currencies, registered even when the
+// Currency collection has no entry for them.
+var defaultNativeTokens = []*Currency{
+	{Blockchain: "ethereum", Contract: NativeTokenContract, Decimals: 18, Name: "Ether", Symbols: "ETH", PriceMap: "ETH", MainCurrency: true},
+	{Blockchain: "polygon", Contract: NativeTokenContract, Decimals: 18, Name: "Polygon Ecosystem Token", Symbols: "POL", PriceMap: "POL", MainCurrency: true},
+}
+
+var (
+	tokenRegistry             = defaultTokenRegistry()
+	pendingTokenRegistrations = make(map[string]*TokenRegistration)
+)
+
+func defaultTokenRegistry() map[string]*Currency {
+	registry := make(map[string]*Currency)
+	for _, token := range defaultNativeTokens {
+		registry[tokenRegistryKey(token.Blockchain, token.Contract)] = token
+	}
+	return registry
+}
+
+func tokenRegistryKey(blockchain, contract string) string {
+	if contract == "" {
+		contract = NativeTokenContract
+	}
+	return currencyTokenKey(blockchain, contract)
+}
+
+// LoadTokenRegistry reads the currencies with a contract into the token
+// registry, the default native currencies included, and clears the pending
+// registrations.
+func LoadTokenRegistry(dbInstance *mongo.Database) error {
+	dbCollection := CollectionInstance(dbInstance, &Currency{})
+	cursor, err := dbCollection.Find(context.Background(), bson.M{"contract": bson.M{"$nin": bson.A{"", nil}}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	results := make([]*Currency, 0)
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return err
+	}
+	tokenRegistry = defaultTokenRegistry()
+	pendingTokenRegistrations = make(map[string]*TokenRegistration)
+	for _, result := range results {
+		tokenRegistry[tokenRegistryKey(result.Blockchain, result.Contract)] = result
+	}
+	return nil
+}
+
+// ResolveToken returns the registered currency of a token, an empty contract
+// being the native currency of the blockchain.
+func ResolveToken(blockchain, contract string) (*Currency, bool) {
+	token, ok := tokenRegistry[tokenRegistryKey(blockchain, contract)]
+	return token, ok
+}
+
+// FlagUnknownToken queues a token for registration, with the symbol and the
+// decimals given by the marketplace as hints.
+func FlagUnknownToken(blockchain, contract, symbol string, decimals int64, source string, date time.Time) {
+	key := tokenRegistryKey(blockchain, contract)
+	registration, exists := pendingTokenRegistrations[key]
+	if !exists {
+		blockchain, contract, _ = strings.Cut(key, ":")
+		registration = &TokenRegistration{Blockchain: blockchain, Contract: contract, Source: source, FirstSeen: date, LastSeen: date}
+		pendingTokenRegistrations[key] = registration
+	}
+	if symbol != "" {
+		registration.Symbol = symbol
+	}
+	if decimals > 0 {
+		registration.Decimals = decimals
+	}
+	if date.Before(registration.FirstSeen) {
+		registration.FirstSeen = date
+	}
+	if date.After(registration.LastSeen) {
+		registration.LastSeen = date
+	}
+	registration.Occurrences++
+}
+
+// SaveTokenRegistrations upserts the queued tokens into the registration
+// queue, adding their occurrences to the stored ones, and clears them.
+func SaveTokenRegistrations(dbInstance *mongo.Database) error {
+	if len(pendingTokenRegistrations) == 0 {
+		return nil
+	}
+	dbCollection := CollectionInstance(dbInstance, &TokenRegistration{})
+	dbRequests := make([]mongo.WriteModel, 0)
+	now := time.Now().UTC()
+	for _, registration := range pendingTokenRegistrations {
+		setPayload := bson.D{{"updated_at", now}}
+		if registration.Symbol != "" {
+			setPayload = append(setPayload, bson.E{"symbol", registration.Symbol})
+		}
+		if registration.Decimals > 0 {
+			setPayload = append(setPayload, bson.E{"decimals", registration.Decimals})
+		}
+		if registration.Source != "" {
+			setPayload = append(setPayload, bson.E{"source", registration.Source})
+		}
+		dbRequests = append(dbRequests, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"blockchain": registration.Blockchain, "contract": registration.Contract}).
+			SetUpdate(bson.D{
+				{"$set", setPayload},
+				{"$setOnInsert", bson.D{{"created_at", now}, {"registered", false}}},
+				{"$inc", bson.D{{"occurrences", registration.Occurrences}}},
+				{"$min", bson.D{{"first_seen", registration.FirstSeen}}},
+				{"$max", bson.D{{"last_seen", registration.LastSeen}}},
+			}).
+			SetUpsert(true))
+	}
+	if _, err := dbCollection.BulkWrite(context.Background(), dbRequests); err != nil {
+		return err
+	}
+	pendingTokenRegistrations = make(map[string]*TokenRegistration)
+	return nil
+}
+
+// GetTokenRegistrations returns the tokens waiting to be registered, the most
+// used first.
+func GetTokenRegistrations(dbInstance *mongo.Database) ([]*TokenRegistration, error) {
+	dbCollection := CollectionInstance(dbInstance, &TokenRegistration{})
+	cursor, err := dbCollection.Find(context.Background(), bson.M{"registered": false})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	results := make([]*TokenRegistration, 0)
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Occurrences > results[j].Occurrences
+	})
+	return results, nil
+}
+
+// RegisterToken adds a token to the Currency collection, or completes its
+// symbol and decimals, taking the missing values from its registration hints,
+// and marks its registration as done.
+func RegisterToken(blockchain, contract, symbol string, decimals int64, dbInstance *mongo.Database) (*Currency, error) {
+	blockchain, contract, _ = strings.Cut(tokenRegistryKey(blockchain, contract), ":")
+	registrationsCollection := CollectionInstance(dbInstance, &TokenRegistration{})
+	registration := &TokenRegistration{}
+	err := registrationsCollection.First(bson.M{"blockchain": blockchain, "contract": contract}, registration)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	if symbol == "" {
+		symbol = registration.Symbol
+	}
+	if decimals <= 0 {
+		decimals = registration.Decimals
+	}
+	if symbol == "" || decimals <= 0 {
+		return nil, errors.New(fmt.Sprintf("token %s:%s needs a symbol and decimals to be registered", blockchain, contract))
+	}
+
+	currenciesCollection := CollectionInstance(dbInstance, &Currency{})
+	currency := &Currency{}
+	err = currenciesCollection.First(bson.M{"blockchain": bson.M{"$regex": "^" + regexp.QuoteMeta(blockchain) + "$", "$options": "i"}, "contract": bson.M{"$regex": "^" + regexp.QuoteMeta(contract) + "$", "$options": "i"}}, currency)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		currency = &Currency{Blockchain: blockchain, Contract: contract, Name: symbol, Symbols: strings.ToUpper(symbol), PriceMap: strings.ToUpper(symbol)}
+	}
+	if currency.Symbols == "" {
+		currency.Symbols = strings.ToUpper(symbol)
+	}
+	currency.Decimals = decimals
+	if currency.ID.IsZero() {
+		err = currenciesCollection.Create(currency)
+	} else {
+		err = currenciesCollection.Update(currency)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = registrationsCollection.UpdateOne(context.Background(), bson.M{"blockchain": blockchain, "contract": contract}, bson.D{{"$set", bson.D{{"registered", true}, {"updated_at", time.Now().UTC()}}}})
+	if err != nil {
+		return nil, err
+	}
+	tokenRegistry[tokenRegistryKey(blockchain, contract)] = currency
+	return currency, nil
+}
+
+// ScaleTokenAmount converts an amount of token base units into token units.
+func ScaleTokenAmount(quantity string, decimals int64) (float64, bool) {
+	bigQuantity, ok := new(big.Float).SetString(quantity)
+	if !ok || decimals < 0 {
+		return 0, false
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(decimals), nil)
+	amount, _ := new(big.Float).Quo(bigQuantity, new(big.Float).SetInt(scale)).Float64()
+	return amount, true
+}
@@ -0,0 +1,184 @@
+package helpers
+
+import (
+	"OpenSeaDataDownloader/utils"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"strings"
+)
+
+const (
+	// erc20TransferTopic is keccak256("Transfer(address,address,uint256)"),
+	// also used by ERC721 transfers which index their token id
+	erc20TransferTopic = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	// seaportOrderFulfilledTopic is keccak256 of the Seaport event
+	// OrderFulfilled(bytes32,address,address,address,(uint8,address,uint256,uint256)[],(uint8,address,uint256,uint256,address)[])
+	seaportOrderFulfilledTopic = "0x9d9af8e38d66c62e2c12f0225249fd9d721c54b83f48d9352c97c6cacdcb6f31"
+
+	seaportItemNative = 0
+	seaportItemErc20  = 1
+)
+
+type TransactionReceiptLog struct {
+	Address  string   `json:"address"`
+	Topics   []string `json:"topics"`
+	Data     string   `json:"data"`
+	LogIndex string   `json:"logIndex"`
+}
+
+type TransactionReceipt struct {
+	TransactionHash   string                   `json:"transactionHash"`
+	BlockNumber       string                   `json:"blockNumber"`
+	From              string                   `json:"from"`
+	To                string                   `json:"to"`
+	GasUsed           string                   `json:"gasUsed"`
+	EffectiveGasPrice string                   `json:"effectiveGasPrice"`
+	Status            string                   `json:"status"`
+	Logs              []*TransactionReceiptLog `json:"logs"`
+}
+
+// TokenTransfer is a payment decoded from a receipt. Token is the contract
+// of the ERC20 paid, or NativeTokenContract for the native currency. From is
+// empty for Seaport consideration items, paid by the fulfiller of the order.
+type TokenTransfer struct {
+	Token     string
+	From      string
+	To        string
+	Amount    *big.Int
+	OrderHash string
+}
+
+// GetTransactionReceipts fetches the receipts of transactions by batches,
+// keyed by lower-cased hash. Transactions without receipt are missing from
+// the result.
+func GetTransactionReceipts(client *utils.JsonRpcClient, hashes []string) (map[string]*TransactionReceipt, error) {
+	params := make([][]any, len(hashes))
+	for i, hash := range hashes {
+		params[i] = []any{hash}
+	}
+	results, err := client.CallBatch("eth_getTransactionReceipt", params, hashes)
+	if err != nil {
+		return nil, err
+	}
+	receipts := make(map[string]*TransactionReceipt)
+	for i, result := range results {
+		if len(result) == 0 || string(result) == "null" {
+			continue
+		}
+		receipt := &TransactionReceipt{}
+		if err = json.Unmarshal(result, receipt); err != nil {
+			return nil, err
+		}
+		receipts[strings.ToLower(hashes[i])] = receipt
+	}
+	return receipts, nil
+}
+
+func hexToBigInt(value string) *big.Int {
+	number, ok := new(big.Int).SetString(strings.TrimPrefix(value, "0x"), 16)
+	if !ok {
+		return new(big.Int)
+	}
+	return number
+}
+
+// wordAddress returns the address held by the last 20 bytes of a 32 bytes
+// word.
+func wordAddress(word []byte) string {
+	return "0x" + hex.EncodeToString(word[12:])
+}
+
+func topicAddress(topic string) string {
+	topic = strings.TrimPrefix(topic, "0x")
+	if len(topic) < 40 {
+		return ""
+	}
+	return "0x" + strings.ToLower(topic[len(topic)-40:])
+}
+
+// GasCost returns the gas used by the transaction, its effective gas price
+// and its cost, both in wei.
+func (r *TransactionReceipt) GasCost() (gasUsed int64, gasPrice *big.Int, cost *big.Int) {
+	gas := hexToBigInt(r.GasUsed)
+	gasPrice = hexToBigInt(r.EffectiveGasPrice)
+	cost = new(big.Int).Mul(gas, gasPrice)
+	return gas.Int64(), gasPrice, cost
+}
+
+// Erc20Transfers returns the ERC20 Transfer logs of the receipt; the ERC721
+// transfers, with an indexed token id, are left out.
+func (r *TransactionReceipt) Erc20Transfers() []*TokenTransfer {
+	transfers := make([]*TokenTransfer, 0)
+	for _, log := range r.Logs {
+		if len(log.Topics) != 3 || strings.ToLower(log.Topics[0]) != erc20TransferTopic {
+			continue
+		}
+		transfers = append(transfers, &TokenTransfer{
+			Token:  strings.ToLower(log.Address),
+			From:   topicAddress(log.Topics[1]),
+			To:     topicAddress(log.Topics[2]),
+			Amount: hexToBigInt(log.Data),
+		})
+	}
+	return transfers
+}
+
+// SeaportPayments returns the native and ERC20 consideration items of the
+// Seaport OrderFulfilled events of the receipt, the native payments being
+// only visible there.
+func (r *TransactionReceipt) SeaportPayments() []*TokenTransfer {
+	transfers := make([]*TokenTransfer, 0)
+	for _, log := range r.Logs {
+		if len(log.Topics) == 0 || strings.ToLower(log.Topics[0]) != seaportOrderFulfilledTopic {
+			continue
+		}
+		data, err := hex.DecodeString(strings.TrimPrefix(log.Data, "0x"))
+		if err != nil || len(data) < 4*32 {
+			continue
+		}
+		word := func(offset int) []byte {
+			if offset < 0 || offset+32 > len(data) {
+				return nil
+			}
+			return data[offset : offset+32]
+		}
+		orderHash := "0x" + hex.EncodeToString(word(0))
+		// Data: orderHash, recipient, offer offset, consideration offset
+		considerationOffset := int(new(big.Int).SetBytes(word(3 * 32)).Int64())
+		lengthWord := word(considerationOffset)
+		if lengthWord == nil {
+			continue
+		}
+		count := int(new(big.Int).SetBytes(lengthWord).Int64())
+		for i := 0; i < count; i++ {
+			// ReceivedItem: itemType, token, identifier, amount, recipient
+			itemOffset := considerationOffset + 32 + i*5*32
+			if word(itemOffset+4*32) == nil {
+				break
+			}
+			itemType := new(big.Int).SetBytes(word(itemOffset)).Int64()
+			if itemType != seaportItemNative && itemType != seaportItemErc20 {
+				continue
+			}
+			token := NativeTokenContract
+			if itemType == seaportItemErc20 {
+				token = wordAddress(word(itemOffset + 32))
+			}
+			transfers = append(transfers, &TokenTransfer{
+				Token:     token,
+				To:        wordAddress(word(itemOffset + 4*32)),
+				Amount:    new(big.Int).SetBytes(word(itemOffset + 3*32)),
+				OrderHash: orderHash,
+			})
+		}
+	}
+	return transfers
+}
+
+// ScaleTokenBigAmount converts an amount of token base units into token
+// units.
+func ScaleTokenBigAmount(quantity *big.Int, decimals int64) float64 {
+	amount, _ := ScaleTokenAmount(quantity.String(), decimals)
+	return amount
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"OpenSeaDataDownloader/downloader"
+	"OpenSeaDataDownloader/helpers"
+	"OpenSeaDataDownloader/utils"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -19,12 +23,43 @@ type AppInput struct {
 	AssetContract string
 	EventTypes    []string
 	Metric        string
+	Action        string
+	InputPath     string
+	Date          time.Time
+	FpType        string
+	ExportSpec    *downloader.ExportSpec
+	Currency      string
+	PriceFormat   string
+	PriceInterval time.Duration
+	PriceMethod   string
+	Numeraires    []string
+	Decimals      int64
+	Tolerance     float64
+	Output        string
+	At            time.Time
+	MaxOrderAge   time.Duration
 }
 
 func usage() {
-	log.Println("Usage: metav2dmarket [-p purpose] [-s source] [-x metaverse] [-b blockchain] [-c asset_contract] [-e events (comma-separated)] [-m metric]\n" +
+	log.Println("Usage: metav2dmarket [-p purpose] [-s source] [-x metaverse] [-b blockchain] [-c asset_contract] [-e events (comma-separated)] [-m metric] [-a action] [-i input] [-d date] [-t focal_point_type]\n" +
 		"\tmetav2dmarket -p download [-s source] [-x metaverse] [-b blockchain] [-c asset_contract] [-e events (comma-separated)]\n" +
-		"\tmetav2dmarket -p export [-s source] [-x metaverse] [-m metric]")
+		"\tmetav2dmarket -p export [-s source] [-x metaverse] [-m metric] [-spec export_spec_file] [-o output] [-format csv|parquet|jsonl] [-gzip] [-incremental] [-partition-by keys (comma-separated)] [-numeraires currencies (comma-separated)]\n" +
+		"\tmetav2dmarket -p parcels -a import [-i tiles_file_or_url] [-d snapshot_date]\n" +
+		"\tmetav2dmarket -p focalpoints -a import [-i geojson_or_json_file] [-t focal_point_type]\n" +
+		"\tmetav2dmarket -p focalpoints -a list [-t focal_point_type]\n" +
+		"\tmetav2dmarket -p focalpoints -a validate\n" +
+		"\tmetav2dmarket -p prices -a import -i prices_file [-currency symbol] [-price-format coingecko|coinmarketcap|ohlcv] [-interval candle_interval]\n" +
+		"\tmetav2dmarket -p enrich -a prices [-s source] [-x metaverse] [-price-method close|open|typical|vwap|interpolate]\n" +
+		"\tmetav2dmarket -p enrich -a numeraires -numeraires currencies (comma-separated) [-s source] [-x metaverse] [-price-method close|open|typical|vwap|interpolate]\n" +
+		"\tmetav2dmarket -p enrich -a fees [-s source] [-x metaverse] (native payments outside Seaport, e.g. Wyvern or Rarible, only get the gas cost)\n" +
+		"\tmetav2dmarket -p tokens -a list\n" +
+		"\tmetav2dmarket -p tokens -a register -b blockchain -c token_contract [-currency symbol] [-decimals decimals]\n" +
+		"\tmetav2dmarket -p tokens -a resolve [-s source] [-x metaverse]\n" +
+		"\tmetav2dmarket -p matching -a report [-s source] [-x metaverse] [-tolerance relative_amount_difference] [-o output]\n" +
+		"\tmetav2dmarket -p listings -a build [-s source] [-x metaverse] [-d as_of_date] [-tolerance relative_amount_difference]\n" +
+		"\tmetav2dmarket -p listings -a export [-s source] [-x metaverse] [-o output] [-format csv|parquet|jsonl] [-gzip]\n" +
+		"\tmetav2dmarket -p orderbook [-a snapshot] [-at date] [-s source] [-x metaverse] [-numeraires currency] [-price-method close|open|typical|vwap|interpolate] [-tolerance relative_amount_difference] [-max-order-age days] [-o output_prefix] [-format csv|parquet|jsonl] [-gzip]\n" +
+		"\tmetav2dmarket -p orderbook -a series [-at to_date] [-s source] [-x metaverse] [-numeraires currency] [-price-method close|open|typical|vwap|interpolate] [-tolerance relative_amount_difference] [-max-order-age days] [-o output] [-format csv|parquet|jsonl] [-gzip]")
 	flag.PrintDefaults()
 }
 
@@ -34,30 +69,256 @@ func showUsageAndExit(exitCode int) {
 }
 
 func readFlags() (*AppInput, bool) {
-	var purpose = flag.String("p", "", "Purpose (download | export)")
+	var purpose = flag.String("p", "", "Purpose (download | export | parcels | focalpoints | prices | enrich | tokens | matching | listings | orderbook)")
 	var source = flag.String("s", "", "Source (opensea | rarible)")
 	var metaverse = flag.String("x", "", "Metaverse (decentraland | thesandbox)")
 	var blockchain = flag.String("b", "", "Blockchain (ethereum | polygon)")
 	var assetContract = flag.String("c", "", "Asset Contract")
 	var eventsListStr = flag.String("e", "", "events (comma-separated)")
-	var metric = flag.String("m", "", "metric (euclidean | manhattan)")
+	var metric = flag.String("m", "", "metric (euclidean | manhattan | walking)")
+	var action = flag.String("a", "", "Action (import | list | validate | prices | numeraires | fees | register | resolve | report | build | export | snapshot | series)")
+	var inputPath = flag.String("i", "", "Input file or url")
+	var dateStr = flag.String("d", "", "Date (YYYY-MM-DD or RFC3339)")
+	var atStr = flag.String("at", "", "Order book date (YYYY-MM-DD or RFC3339), now if empty")
+	var fpType = flag.String("t", "", "Focal point type (plaza | road | district)")
+	var specPath = flag.String("spec", "", "Export spec file (JSON)")
+	var output = flag.String("o", "", "Output file")
+	var format = flag.String("format", "", "Export format (csv | parquet | jsonl)")
+	var gzipped = flag.Bool("gzip", false, "Gzip the jsonl export")
+	var incremental = flag.Bool("incremental", false, "Only export operations added or changed since the last export")
+	var currency = flag.String("currency", "", "Currency symbol or price slug of the prices file")
+	var priceFormat = flag.String("price-format", "", "Prices file format (coingecko | coinmarketcap | ohlcv), guessed if empty")
+	var priceInterval = flag.String("interval", "", "Candle interval of CoinGecko market charts (e.g. 1h | 1d)")
+	var priceMethod = flag.String("price-method", "", "USD price method (close | open | typical | vwap | interpolate)")
+	var numeraires = flag.String("numeraires", "", "Numeraires of the payment amounts (comma-separated, e.g. USD,ETH,MANA)")
+	var decimals = flag.Int64("decimals", 0, "Decimals of the registered token, taken from its registration if 0")
+	var tolerance = flag.Float64("tolerance", downloader.DefaultMatchTolerance, "Relative amount difference allowed when matching sales to listings & bids")
+	var maxOrderAge = flag.Int("max-order-age", int(downloader.DefaultMaxOrderAge.Hours()/24), "Days an order without expiration date stays in the order book")
+	var partitionBy = flag.String("partition-by", "", "Export partition keys (comma-separated: year | month | day | asset_type | type | source | district)")
 	log.SetFlags(0)
 	flag.Usage = usage
 	flag.Parse()
 
-	if *purpose == "" || !slices.Contains([]string{"export", "download"}, *purpose) {
+	if *purpose == "" || !slices.Contains([]string{"export", "download", "parcels", "focalpoints", "prices", "enrich", "tokens", "matching", "listings", "orderbook"}, *purpose) {
 		showUsageAndExit(0)
 		return nil, false
 	}
-	if *source == "" || !slices.Contains([]string{"opensea", "rarible"}, *source) {
-		showUsageAndExit(0)
-		return nil, false
+	eventsListArr := make([]string, 0)
+	interval := time.Duration(0)
+	numerairesArr := make([]string, 0)
+	for _, numeraire := range strings.Split(*numeraires, ",") {
+		if numeraire = strings.ToUpper(strings.TrimSpace(numeraire)); numeraire != "" {
+			numerairesArr = append(numerairesArr, numeraire)
+		}
 	}
-	if *metaverse == "" || !slices.Contains([]string{"decentraland"}, *metaverse) {
-		showUsageAndExit(0)
-		return nil, false
+	exportSpec := downloader.NewExportSpec()
+	date := time.Now().UTC()
+	if *dateStr != "" {
+		parsedDate, err := utils.ParseDate(*dateStr)
+		if err != nil {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		date = parsedDate
+	}
+	at := time.Now().UTC()
+	if *atStr != "" {
+		parsedAt, err := utils.ParseDate(*atStr)
+		if err != nil {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		at = parsedAt
+	}
+	if *purpose == "parcels" {
+		if *action == "" || !slices.Contains([]string{"import"}, *action) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+	} else if *purpose == "focalpoints" {
+		if *action == "" || !slices.Contains([]string{"import", "list", "validate"}, *action) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *action == "import" && *inputPath == "" {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *fpType != "" && !slices.Contains([]string{"plaza", "road", "district"}, *fpType) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+	} else if *purpose == "prices" {
+		if *action == "" || !slices.Contains([]string{"import"}, *action) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *inputPath == "" {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *priceFormat != "" && !slices.Contains(helpers.CurrencyPricesFormats, *priceFormat) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		parsedInterval, err := helpers.ParseCurrencyPriceInterval(*priceInterval)
+		if err != nil {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		interval = parsedInterval
+	} else if *purpose == "enrich" {
+		if *action == "" || !slices.Contains([]string{"prices", "numeraires", "fees"}, *action) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *action == "numeraires" && len(numerairesArr) == 0 {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *source != "" && !slices.Contains([]string{"opensea", "rarible"}, *source) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *metaverse != "" && !slices.Contains([]string{"decentraland"}, *metaverse) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *priceMethod != "" && !slices.Contains(helpers.CurrencyPriceMethods, *priceMethod) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+	} else if *purpose == "matching" {
+		if *action == "" || !slices.Contains([]string{"report"}, *action) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *tolerance < 0 {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *source != "" && !slices.Contains([]string{"opensea", "rarible"}, *source) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *metaverse != "" && !slices.Contains([]string{"decentraland"}, *metaverse) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *output == "" {
+			*output = fmt.Sprintf("./files/unmatched_sales_%s_%s.csv", *metaverse, *source)
+		}
+	} else if *purpose == "listings" {
+		if *action == "" || !slices.Contains([]string{"build", "export"}, *action) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *tolerance < 0 {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *source != "" && !slices.Contains([]string{"opensea", "rarible"}, *source) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *metaverse != "" && !slices.Contains([]string{"decentraland"}, *metaverse) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *action == "export" {
+			if *format != "" {
+				exportSpec.Format = *format
+			}
+			if *gzipped {
+				exportSpec.Compression = "gzip"
+			}
+			if err := exportSpec.Validate(); err != nil {
+				log.Fatalf("Invalid export options: %s", err.Error())
+				return nil, false
+			}
+			exportSpec.OperationTypes = []string{"LIST"}
+			exportSpec.Output = *output
+			if exportSpec.Output == "" {
+				exportSpec.Output = exportSpec.DefaultListingsOutput(*metaverse, *source)
+			}
+		}
+	} else if *purpose == "orderbook" {
+		if *action == "" {
+			*action = "snapshot"
+		}
+		if !slices.Contains([]string{"snapshot", "series"}, *action) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *tolerance < 0 || *maxOrderAge <= 0 || len(numerairesArr) > 1 {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *source != "" && !slices.Contains([]string{"opensea", "rarible"}, *source) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *metaverse != "" && !slices.Contains([]string{"decentraland"}, *metaverse) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *priceMethod != "" && !slices.Contains(helpers.CurrencyPriceMethods, *priceMethod) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if len(numerairesArr) == 0 {
+			numerairesArr = []string{helpers.UsdNumeraire}
+		}
+		if *format != "" {
+			exportSpec.Format = *format
+		}
+		if *gzipped {
+			exportSpec.Compression = "gzip"
+		}
+		if err := exportSpec.Validate(); err != nil {
+			log.Fatalf("Invalid export options: %s", err.Error())
+			return nil, false
+		}
+		// The data packages describe the operations the book is rebuilt from
+		exportSpec.OperationTypes = []string{"LIST", "BID", "SELL", "TRANSFER"}
+		exportSpec.DateTo = at.Format(time.RFC3339)
+		exportSpec.PriceMethod = *priceMethod
+		exportSpec.MatchTolerance = tolerance
+		if *action == "snapshot" && *output == "" {
+			*output = exportSpec.DefaultOrderBookPrefix(*metaverse, *source, at)
+		} else if *action == "series" {
+			exportSpec.Output = *output
+			if exportSpec.Output == "" {
+				exportSpec.Output = exportSpec.DefaultOrderBookSeriesOutput(*metaverse, *source)
+			}
+		}
+	} else if *purpose == "tokens" {
+		if *action == "" || !slices.Contains([]string{"list", "register", "resolve"}, *action) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *action == "register" && (*blockchain == "" || *assetContract == "" || *decimals < 0) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *source != "" && !slices.Contains([]string{"opensea", "rarible"}, *source) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *metaverse != "" && !slices.Contains([]string{"decentraland"}, *metaverse) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+	} else {
+		if *source == "" || !slices.Contains([]string{"opensea", "rarible"}, *source) {
+			showUsageAndExit(0)
+			return nil, false
+		}
+		if *metaverse == "" || !slices.Contains([]string{"decentraland"}, *metaverse) {
+			showUsageAndExit(0)
+			return nil, false
+		}
 	}
-	eventsListArr := make([]string, 0)
 	if *purpose == "download" {
 		if *blockchain == "" || !slices.Contains([]string{"ethereum", "polygon"}, *blockchain) {
 			showUsageAndExit(0)
@@ -72,11 +333,46 @@ func readFlags() (*AppInput, bool) {
 			return nil, false
 		}
 		eventsListArr = strings.Split(*eventsListStr, ",")
-	} else {
-		if *metric == "" || !slices.Contains([]string{"euclidean", "manhattan"}, *metric) {
+	} else if *purpose == "export" {
+		if *metric == "" || !slices.Contains([]string{"euclidean", "manhattan", "walking"}, *metric) {
 			showUsageAndExit(0)
 			return nil, false
 		}
+		if *specPath != "" {
+			spec, err := downloader.LoadExportSpec(*specPath)
+			if err != nil {
+				log.Fatalf("Fail to load export spec %s: %s", *specPath, err.Error())
+				return nil, false
+			}
+			exportSpec = spec
+		}
+		if *format != "" || *gzipped || *incremental || *partitionBy != "" || len(numerairesArr) > 0 {
+			if *format != "" {
+				exportSpec.Format = *format
+			}
+			if *gzipped {
+				exportSpec.Compression = "gzip"
+			}
+			if *incremental {
+				exportSpec.Incremental = true
+			}
+			if *partitionBy != "" {
+				exportSpec.PartitionBy = strings.Split(*partitionBy, ",")
+			}
+			if len(numerairesArr) > 0 {
+				exportSpec.Numeraires = numerairesArr
+			}
+			if err := exportSpec.Validate(); err != nil {
+				log.Fatalf("Invalid export options: %s", err.Error())
+				return nil, false
+			}
+		}
+		if *output != "" {
+			exportSpec.Output = *output
+		}
+		if exportSpec.Output == "" {
+			exportSpec.Output = exportSpec.DefaultOutput(*metaverse, *source)
+		}
 	}
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -92,6 +388,21 @@ func readFlags() (*AppInput, bool) {
 		AssetContract: *assetContract,
 		EventTypes:    eventsListArr,
 		Metric:        *metric,
+		Action:        *action,
+		InputPath:     *inputPath,
+		Date:          date,
+		FpType:        *fpType,
+		ExportSpec:    exportSpec,
+		Currency:      *currency,
+		PriceFormat:   *priceFormat,
+		PriceInterval: interval,
+		PriceMethod:   *priceMethod,
+		Numeraires:    numerairesArr,
+		Decimals:      *decimals,
+		Tolerance:     *tolerance,
+		Output:        *output,
+		At:            at,
+		MaxOrderAge:   time.Duration(*maxOrderAge) * 24 * time.Hour,
 	}
 
 	return input, true
@@ -109,6 +420,54 @@ func main() {
 			downloader.RaribleLaunch(appInput.Blockchain, appInput.Metaverse, appInput.AssetContract, appInput.EventTypes)
 		}
 	} else if appInput.Purpose == "export" {
-		downloader.ExportOperations(appInput.Metaverse, appInput.Source, appInput.Metric)
+		downloader.ExportOperations(appInput.Metaverse, appInput.Source, appInput.Metric, appInput.ExportSpec)
+	} else if appInput.Purpose == "parcels" {
+		if appInput.Action == "import" {
+			downloader.ImportParcels(appInput.InputPath, appInput.Date)
+		}
+	} else if appInput.Purpose == "focalpoints" {
+		if appInput.Action == "import" {
+			downloader.ImportFocalPoints(appInput.InputPath, appInput.FpType)
+		} else if appInput.Action == "list" {
+			downloader.ListFocalPoints(appInput.FpType)
+		} else if appInput.Action == "validate" {
+			downloader.ValidateFocalPoints()
+		}
+	} else if appInput.Purpose == "prices" {
+		if appInput.Action == "import" {
+			downloader.ImportPrices(appInput.InputPath, appInput.PriceFormat, appInput.Currency, appInput.PriceInterval)
+		}
+	} else if appInput.Purpose == "enrich" {
+		if appInput.Action == "prices" {
+			downloader.EnrichPrices(appInput.Metaverse, appInput.Source, appInput.PriceMethod)
+		} else if appInput.Action == "numeraires" {
+			downloader.EnrichNumeraires(appInput.Metaverse, appInput.Source, appInput.PriceMethod, appInput.Numeraires)
+		} else if appInput.Action == "fees" {
+			downloader.EnrichFees(appInput.Metaverse, appInput.Source)
+		}
+	} else if appInput.Purpose == "tokens" {
+		if appInput.Action == "list" {
+			downloader.ListTokens()
+		} else if appInput.Action == "register" {
+			downloader.RegisterToken(appInput.Blockchain, appInput.AssetContract, appInput.Currency, appInput.Decimals)
+		} else if appInput.Action == "resolve" {
+			downloader.ResolveTokens(appInput.Metaverse, appInput.Source)
+		}
+	} else if appInput.Purpose == "matching" {
+		if appInput.Action == "report" {
+			downloader.ReportMatching(appInput.Metaverse, appInput.Source, appInput.Tolerance, appInput.Output)
+		}
+	} else if appInput.Purpose == "listings" {
+		if appInput.Action == "build" {
+			downloader.BuildListings(appInput.Metaverse, appInput.Source, appInput.Tolerance, appInput.Date)
+		} else if appInput.Action == "export" {
+			downloader.ExportListings(appInput.Metaverse, appInput.Source, appInput.ExportSpec)
+		}
+	} else if appInput.Purpose == "orderbook" {
+		if appInput.Action == "snapshot" {
+			downloader.SnapshotOrderBook(appInput.Metaverse, appInput.Source, appInput.At, appInput.Numeraires[0], appInput.PriceMethod, appInput.Tolerance, appInput.MaxOrderAge, appInput.ExportSpec, appInput.Output)
+		} else if appInput.Action == "series" {
+			downloader.OrderBookSeriesReport(appInput.Metaverse, appInput.Source, appInput.At, appInput.Numeraires[0], appInput.PriceMethod, appInput.Tolerance, appInput.MaxOrderAge, appInput.ExportSpec)
+		}
 	}
 }
@@ -7,7 +7,9 @@ import (
 	"io"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -15,18 +17,53 @@ import (
 )
 
 type Writer struct {
-	Delimiter rune
-	Quote     rune
-	UseCRLF   bool
-	w         *bufio.Writer
+	Delimiter   rune
+	Quote       rune
+	QuotePolicy string
+	UseCRLF     bool
+	w           *bufio.Writer
 }
 
-func newCsvWriter(w io.Writer) *Writer {
+// CsvDialect describes how csv files are written. QuotePolicy is "strings"
+// (quote every non numeric or boolean field), "minimal" (quote only fields
+// which need it) or "all".
+type CsvDialect struct {
+	Delimiter   rune
+	Quote       rune
+	QuotePolicy string
+	UseCRLF     bool
+	Bom         bool
+}
+
+// CsvFormat describes how values are rendered in csv files. DateFormat is
+// "rfc3339", "epoch" (seconds) or "epoch_ms"; a negative FloatPrecision keeps
+// the shortest representation; BoolFormat is "true_false" or "1_0".
+type CsvFormat struct {
+	DateFormat     string
+	FloatPrecision int
+	NullValue      string
+	BoolFormat     string
+}
+
+var CsvQuotePolicies = []string{"strings", "minimal", "all"}
+var CsvDateFormats = []string{"rfc3339", "epoch", "epoch_ms"}
+var CsvBoolFormats = []string{"true_false", "1_0"}
+
+func DefaultCsvDialect() CsvDialect {
+	return CsvDialect{Delimiter: ';', Quote: '"', QuotePolicy: "strings"}
+}
+
+func DefaultCsvFormat() CsvFormat {
+	return CsvFormat{DateFormat: "rfc3339", FloatPrecision: -1, BoolFormat: "true_false"}
+}
+
+func newCsvWriter(w io.Writer, dialect CsvDialect) *Writer {
 	return &Writer{
-		Delimiter: ';',
-		Quote:     '"',
-		UseCRLF:   false,
-		w:         bufio.NewWriter(w),
+		Delimiter:   dialect.Delimiter,
+		Quote:       dialect.Quote,
+		QuotePolicy: dialect.QuotePolicy,
+		UseCRLF:     dialect.UseCRLF,
+		w:           bufio.NewWriter(w),
 	}
 }
 
@@ -34,10 +71,66 @@ func csvValidDelim(r rune) bool {
 	return r != 0 && r != '"' && r != '\r' && r != '\n' && utf8.ValidRune(r) && r != utf8.RuneError
 }
 
+// isNullValue tells whether a value is nil or a nil pointer.
+func isNullValue(value any) bool {
+	if value == nil {
+		return true
+	}
+	rv := reflect.ValueOf(value)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
+
+// FormatValue renders a value, dereferencing pointers.
+func (f CsvFormat) FormatValue(value any) string {
+	if isNullValue(value) {
+		return f.NullValue
+	}
+	if rv := reflect.ValueOf(value); rv.Kind() == reflect.Ptr {
+		value = rv.Elem().Interface()
+	}
+	switch v := value.(type) {
+	case time.Time:
+		switch f.DateFormat {
+		case "epoch":
+			return strconv.FormatInt(v.Unix(), 10)
+		case "epoch_ms":
+			return strconv.FormatInt(v.UnixMilli(), 10)
+		}
+		return v.UTC().Format(time.RFC3339)
+	case bool:
+		if f.BoolFormat == "1_0" {
+			if v {
+				return "1"
+			}
+			return "0"
+		}
+		return strconv.FormatBool(v)
+	case float64:
+		if f.FloatPrecision >= 0 {
+			return strconv.FormatFloat(v, 'f', f.FloatPrecision, 64)
+		}
+	case float32:
+		if f.FloatPrecision >= 0 {
+			return strconv.FormatFloat(float64(v), 'f', f.FloatPrecision, 32)
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// csvNullType is the type of a null field of a row.
+const csvNullType = "null"
+
 var errCsvInvalidDelim = errors.New("csv: invalid field or comment delimiter")
 
 func (w *Writer) csvFieldNeedsQuotes(field string, fieldType string, quoteStringOnly bool) bool {
-	if quoteStringOnly {
+	// The null value is never quoted, to tell it apart from an empty string
+	if fieldType == csvNullType {
+		return false
+	}
+	if w.QuotePolicy == "all" {
+		return true
+	}
+	if quoteStringOnly && w.QuotePolicy != "minimal" {
 		if strings.Contains(fieldType, "int") || strings.Contains(fieldType, "float") || strings.Contains(fieldType, "bool") {
 			return false
 		}
@@ -55,12 +148,12 @@ func (w *Writer) csvFieldNeedsQuotes(field string, fieldType string, quoteString
 	if w.Delimiter < utf8.RuneSelf {
 		for i := 0; i < len(field); i++ {
 			c := field[i]
-			if c == '\n' || c == '\r' || c == '"' || c == byte(w.Delimiter) {
+			if c == '\n' || c == '\r' || rune(c) == w.Quote || c == byte(w.Delimiter) {
 				return true
 			}
 		}
 	} else {
-		if strings.ContainsRune(field, w.Delimiter) || strings.ContainsAny(field, "\"\r\n") {
+		if strings.ContainsRune(field, w.Delimiter) || strings.ContainsRune(field, w.Quote) || strings.ContainsAny(field, "\r\n") {
 			return true
 		}
 	}
@@ -70,7 +163,7 @@ func (w *Writer) csvFieldNeedsQuotes(field string, fieldType string, quoteString
 }
 
 func (w *Writer) csvWrite(record, types []string, quoteStringOnly bool) error {
-	if !csvValidDelim(w.Delimiter) {
+	if !csvValidDelim(w.Delimiter) || w.Delimiter == w.Quote {
 		return errCsvInvalidDelim
 	}
 
@@ -94,12 +187,13 @@ func (w *Writer) csvWrite(record, types []string, quoteStringOnly bool) error {
 			continue
 		}
 
-		if err := w.w.WriteByte('"'); err != nil {
+		if _, err := w.w.WriteRune(w.Quote); err != nil {
 			return err
 		}
+		specialChars := string(w.Quote) + "\r\n"
 		for len(field) > 0 {
 			// Search for special characters.
-			i := strings.IndexAny(field, "\"\r\n")
+			i := strings.IndexAny(field, specialChars)
 			if i < 0 {
 				i = len(field)
 			}
@@ -113,27 +207,29 @@ func (w *Writer) csvWrite(record, types []string, quoteStringOnly bool) error {
 			// Encode the special character.
 			if len(field) > 0 {
 				var err error
-				switch field[0] {
-				case '"':
-					_, err = w.w.WriteString(`""`)
-				case '\r':
+				quoteSize := 1
+				switch {
+				case strings.HasPrefix(field, string(w.Quote)):
+					quoteSize = utf8.RuneLen(w.Quote)
+					_, err = w.w.WriteString(string(w.Quote) + string(w.Quote))
+				case field[0] == '\r':
 					if !w.UseCRLF {
 						err = w.w.WriteByte('\r')
 					}
-				case '\n':
+				case field[0] == '\n':
 					if w.UseCRLF {
 						_, err = w.w.WriteString("\r\n")
 					} else {
 						err = w.w.WriteByte('\n')
 					}
 				}
-				field = field[1:]
+				field = field[quoteSize:]
 				if err != nil {
 					return err
 				}
 			}
 		}
-		if err := w.w.WriteByte('"'); err != nil {
+		if _, err := w.w.WriteRune(w.Quote); err != nil {
 			return err
 		}
 	}
@@ -168,55 +264,76 @@ func WriteInCsv1(filename string, data []any) error {
 	return nil
 }
 
-func WriteInCsv2(filename string, data []map[string]any, _headers, _types []string) error {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+// CsvFileWriter writes records one at a time in a csv file.
+type CsvFileWriter struct {
+	file    *os.File
+	writer  *Writer
+	format  CsvFormat
+	headers []string
+	types   []string
+}
+
+func NewCsvFileWriter(filename string, headers, types []string, dialect CsvDialect, format CsvFormat) (*CsvFileWriter, error) {
+	return openCsvFileWriter(filename, headers, types, dialect, format, os.O_TRUNC)
+}
 
-	writer := newCsvWriter(file)
-	defer writer.csvFlush()
+// AppendCsvFileWriter writes records at the end of a csv file, the headers
+// being only written if the file is empty.
+func AppendCsvFileWriter(filename string, headers, types []string, dialect CsvDialect, format CsvFormat) (*CsvFileWriter, error) {
+	return openCsvFileWriter(filename, headers, types, dialect, format, os.O_APPEND)
+}
 
-	var headers = make([]string, 0)
-	if _headers != nil {
-		for _, k := range _headers {
-			headers = append(headers, k)
+func openCsvFileWriter(filename string, headers, types []string, dialect CsvDialect, format CsvFormat, flag int) (*CsvFileWriter, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|flag, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	csvFileWriter := &CsvFileWriter{
+		file:    file,
+		writer:  newCsvWriter(file, dialect),
+		format:  format,
+		headers: headers,
+		types:   types,
+	}
+	fileInfo, err := file.Stat()
+	if err == nil && fileInfo.Size() == 0 {
+		if dialect.Bom {
+			_, err = csvFileWriter.writer.w.WriteString("\ufeff")
 		}
-	} else {
-		if len(data) > 0 {
-			for k := range data[0] {
-				headers = append(headers, k)
-			}
+		if err == nil {
+			err = csvFileWriter.writer.csvWrite(headers, nil, false)
 		}
 	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return csvFileWriter, nil
+}
 
-	var types = make([]string, 0)
-	if _types != nil {
-		types = _types
-	} else {
-		if len(data) > 0 {
-			for k := range data[0] {
-				types = append(types, reflect.TypeOf(k).Kind().String())
+func (w *CsvFileWriter) WriteRow(values []any) error {
+	row := make([]string, len(values))
+	types := make([]string, len(values))
+	for i, value := range values {
+		row[i] = w.format.FormatValue(value)
+		if isNullValue(value) {
+			types[i] = csvNullType
+		} else if i < len(w.types) {
+			types[i] = w.types[i]
+			// Dates written as epochs are numbers
+			if types[i] == "struct" && w.format.DateFormat != "rfc3339" {
+				types[i] = "int64"
 			}
 		}
 	}
+	return w.writer.csvWrite(row, types, true)
+}
 
-	err = writer.csvWrite(headers, nil, false)
-	if err != nil {
-		return err
-	}
-
-	for _, recordMap := range data {
-		var row []string
-		for _, header := range headers {
-			value := recordMap[header]
-			row = append(row, fmt.Sprint(value))
-		}
-		err = writer.csvWrite(row, types, true)
-		if err != nil {
-			return err
-		}
+func (w *CsvFileWriter) Close() error {
+	w.writer.csvFlush()
+	err := w.writer.csvError()
+	if e0 := w.file.Close(); err == nil {
+		err = e0
 	}
-	return nil
+	return err
 }
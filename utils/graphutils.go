@@ -0,0 +1,128 @@
+package utils
+
+import "math"
+
+var gridNeighbours = []GridPoint{{1, 0}, {-1, 0}, {0, 1}, {0, -1}}
+
+// RoadGraph links every road parcel to its 4 neighbours which are roads too.
+type RoadGraph struct {
+	roads       map[GridPoint]bool
+	roadsIndex  *ZoneIndex
+	pointFields map[GridPoint]*WalkingField
+}
+
+// WalkingField holds the walking distance through roads from every reachable
+// road parcel to a zone.
+type WalkingField struct {
+	graph     *RoadGraph
+	distances map[GridPoint]int
+}
+
+var walkingGraph = NewRoadGraph(nil)
+
+func NewRoadGraph(roads []GridPoint) *RoadGraph {
+	graph := &RoadGraph{
+		roads:       make(map[GridPoint]bool),
+		roadsIndex:  NewZoneIndex(roads),
+		pointFields: make(map[GridPoint]*WalkingField),
+	}
+	for _, road := range roads {
+		graph.roads[road] = true
+	}
+	return graph
+}
+
+// SetWalkingGraph sets the road graph used by the "walking" metric.
+func SetWalkingGraph(graph *RoadGraph) {
+	walkingGraph = graph
+}
+
+// Field computes the walking distances to a zone with a breadth-first search
+// starting from the zone parcels and spreading over roads only.
+func (g *RoadGraph) Field(zone []GridPoint) *WalkingField {
+	field := &WalkingField{graph: g, distances: make(map[GridPoint]int)}
+	queue := make([]GridPoint, 0, len(zone))
+	for _, point := range zone {
+		if _, seen := field.distances[point]; !seen {
+			field.distances[point] = 0
+			queue = append(queue, point)
+		}
+	}
+	for len(queue) > 0 {
+		point := queue[0]
+		queue = queue[1:]
+		for _, move := range gridNeighbours {
+			next := GridPoint{point.X + move.X, point.Y + move.Y}
+			if _, seen := field.distances[next]; seen || !g.roads[next] {
+				continue
+			}
+			field.distances[next] = field.distances[point] + 1
+			queue = append(queue, next)
+		}
+	}
+	return field
+}
+
+// Distance returns the walking distance from (x, y) to the zone. A parcel
+// reaches the road network through an adjacent road, or else through the
+// closest road parcel; math.MaxFloat64 is returned if the zone is unreachable.
+func (f *WalkingField) Distance(x, y int) float64 {
+	point := GridPoint{x, y}
+	if distance, ok := f.distances[point]; ok {
+		return float64(distance)
+	}
+	best := math.MaxInt
+	for _, move := range gridNeighbours {
+		distance, ok := f.distances[GridPoint{x + move.X, y + move.Y}]
+		if ok && distance+1 < best {
+			best = distance + 1
+		}
+	}
+	if best == math.MaxInt {
+		for _, road := range f.graph.closestRoads(x, y) {
+			distance, ok := f.distances[road]
+			access := abs(road.X-x) + abs(road.Y-y)
+			if ok && distance+access < best {
+				best = distance + access
+			}
+		}
+	}
+	if best == math.MaxInt {
+		return math.MaxFloat64
+	}
+	return float64(best)
+}
+
+func (g *RoadGraph) closestRoads(x, y int) []GridPoint {
+	accessDistance := g.roadsIndex.Distance(x, y, "manhattan")
+	if accessDistance == math.MaxFloat64 {
+		return nil
+	}
+	roads := make([]GridPoint, 0)
+	d := int(accessDistance)
+	for dx := -d; dx <= d; dx++ {
+		dy := d - abs(dx)
+		for _, candidate := range []GridPoint{{x + dx, y + dy}, {x + dx, y - dy}} {
+			if g.roads[candidate] {
+				roads = append(roads, candidate)
+			}
+		}
+	}
+	return roads
+}
+
+// NewRoadGraphField computes the walking distances to a zone on the road
+// graph set for the "walking" metric.
+func NewRoadGraphField(zone []GridPoint) *WalkingField {
+	return walkingGraph.Field(zone)
+}
+
+func walkingDistance(x1, y1, x2, y2 int) float64 {
+	target := GridPoint{x2, y2}
+	field, ok := walkingGraph.pointFields[target]
+	if !ok {
+		field = walkingGraph.Field([]GridPoint{target})
+		walkingGraph.pointFields[target] = field
+	}
+	return field.Distance(x1, y1)
+}
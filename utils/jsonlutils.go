@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"os"
+)
+
+// JsonLinesFileWriter writes records one at a time as JSON objects, one per
+// line, optionally gzip compressed. A column with a group is written in a
+// nested object named after its group, other columns at the top level.
+type JsonLinesFileWriter struct {
+	file    *os.File
+	gz      *gzip.Writer
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+	headers []string
+	groups  []string
+}
+
+func NewJsonLinesFileWriter(filename string, headers, groups []string, gzipped bool) (*JsonLinesFileWriter, error) {
+	return openJsonLinesFileWriter(filename, headers, groups, gzipped, os.O_TRUNC)
+}
+
+// AppendJsonLinesFileWriter writes records at the end of a JSON lines file. A
+// gzip compressed file gets a new gzip member, which readers concatenate.
+func AppendJsonLinesFileWriter(filename string, headers, groups []string, gzipped bool) (*JsonLinesFileWriter, error) {
+	return openJsonLinesFileWriter(filename, headers, groups, gzipped, os.O_APPEND)
+}
+
+func openJsonLinesFileWriter(filename string, headers, groups []string, gzipped bool, flag int) (*JsonLinesFileWriter, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|flag, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	jsonLinesWriter := &JsonLinesFileWriter{file: file, headers: headers, groups: groups}
+	if gzipped {
+		jsonLinesWriter.gz = gzip.NewWriter(file)
+		jsonLinesWriter.buffer = bufio.NewWriter(jsonLinesWriter.gz)
+	} else {
+		jsonLinesWriter.buffer = bufio.NewWriter(file)
+	}
+	jsonLinesWriter.encoder = json.NewEncoder(jsonLinesWriter.buffer)
+	jsonLinesWriter.encoder.SetEscapeHTML(false)
+	return jsonLinesWriter, nil
+}
+
+func (w *JsonLinesFileWriter) WriteRow(values []any) error {
+	record := make(map[string]any)
+	for i, value := range values {
+		if i >= len(w.headers) {
+			break
+		}
+		if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			value = nil
+		}
+		group := ""
+		if len(w.groups) > i {
+			group = w.groups[i]
+		}
+		if group == "" {
+			record[w.headers[i]] = value
+			continue
+		}
+		nested, ok := record[group].(map[string]any)
+		if !ok {
+			nested = make(map[string]any)
+			record[group] = nested
+		}
+		nested[w.headers[i]] = value
+	}
+	return w.encoder.Encode(record)
+}
+
+func (w *JsonLinesFileWriter) Close() error {
+	err := w.buffer.Flush()
+	if w.gz != nil {
+		if e0 := w.gz.Close(); err == nil {
+			err = e0
+		}
+	}
+	if e1 := w.file.Close(); err == nil {
+		err = e1
+	}
+	return err
+}
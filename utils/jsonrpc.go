@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type JsonRpcRequest struct {
+	Jsonrpc string `json:"jsonrpc"`
+	Id      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type JsonRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type JsonRpcResponse struct {
+	Id     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *JsonRpcError   `json:"error"`
+}
+
+// JsonRpcClient sends JSON-RPC calls by batches of BatchSize. With a
+// CacheDir, the non-null results are cached in <CacheDir>/<method>/<key>.json
+// and never requested again.
+type JsonRpcClient struct {
+	Url       string
+	BatchSize int
+	CacheDir  string
+}
+
+func NewJsonRpcClient(url string, batchSize int, cacheDir string) *JsonRpcClient {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	return &JsonRpcClient{Url: url, BatchSize: batchSize, CacheDir: cacheDir}
+}
+
+func (c *JsonRpcClient) cachePath(method, key string) string {
+	return filepath.Join(c.CacheDir, method, strings.ToLower(key)+".json")
+}
+
+func (c *JsonRpcClient) readCache(method, key string) (json.RawMessage, bool) {
+	if c.CacheDir == "" || key == "" {
+		return nil, false
+	}
+	content, err := os.ReadFile(c.cachePath(method, key))
+	if err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+func (c *JsonRpcClient) writeCache(method, key string, result json.RawMessage) error {
+	if c.CacheDir == "" || key == "" {
+		return nil
+	}
+	cachePath := c.cachePath(method, key)
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(cachePath, result, 0644)
+}
+
+// sendBatch sends a batch of calls and returns their results in the order of
+// the requests; a call failing makes the whole batch fail.
+func (c *JsonRpcClient) sendBatch(requests []*JsonRpcRequest) ([]json.RawMessage, error) {
+	payload, err := json.Marshal(requests)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(c.Url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("rpc request failed - return error status code %d", resp.StatusCode))
+	}
+	responses := make([]*JsonRpcResponse, 0)
+	if err = json.Unmarshal(respBody, &responses); err != nil {
+		return nil, err
+	}
+	resultsById := make(map[int]json.RawMessage)
+	for _, response := range responses {
+		if response.Error != nil {
+			return nil, errors.New(fmt.Sprintf("rpc call %d failed - %d %s", response.Id, response.Error.Code, response.Error.Message))
+		}
+		resultsById[response.Id] = response.Result
+	}
+	results := make([]json.RawMessage, len(requests))
+	for i, request := range requests {
+		results[i] = resultsById[request.Id]
+	}
+	return results, nil
+}
+
+// CallBatch calls a method once for each params, the cached results being
+// read from the cache. keys identify the calls in the cache (e.g. transaction
+// hashes); an empty key is never cached. Results are given in the order of
+// the params, null for the calls without result.
+func (c *JsonRpcClient) CallBatch(method string, params [][]any, keys []string) ([]json.RawMessage, error) {
+	results := make([]json.RawMessage, len(params))
+	requests := make([]*JsonRpcRequest, 0)
+	indexes := make([]int, 0)
+	for i, callParams := range params {
+		key := ""
+		if i < len(keys) {
+			key = keys[i]
+		}
+		if cached, ok := c.readCache(method, key); ok {
+			results[i] = cached
+			continue
+		}
+		requests = append(requests, &JsonRpcRequest{Jsonrpc: "2.0", Id: i + 1, Method: method, Params: callParams})
+		indexes = append(indexes, i)
+	}
+	for start := 0; start < len(requests); start += c.BatchSize {
+		end := min(start+c.BatchSize, len(requests))
+		batchResults, err := c.sendBatch(requests[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for j, result := range batchResults {
+			i := indexes[start+j]
+			results[i] = result
+			if len(result) == 0 || string(result) == "null" || i >= len(keys) {
+				continue
+			}
+			if err = c.writeCache(method, keys[i], result); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
@@ -16,6 +16,16 @@ func PrettyPrintObject(object interface{}) {
 }
 
 func ReadJsonFile(filePath string, target any) error {
+	return readJsonFile(filePath, target, false)
+}
+
+// ReadJsonFileStrict fails on the keys of the file matching no field of the
+// target.
+func ReadJsonFileStrict(filePath string, target any) error {
+	return readJsonFile(filePath, target, true)
+}
+
+func readJsonFile(filePath string, target any, errorUnused bool) error {
 	jsonResDistrictStr, err := os.ReadFile(filePath)
 	if err != nil {
 		return err
@@ -30,6 +40,6 @@ func ReadJsonFile(filePath string, target any) error {
 			"data": jsonFile,
 		}
 	}
-	err = ConvertMapToStruct(jsonFile.(map[string]any), target)
+	err = convertMapToStruct(jsonFile.(map[string]any), target, errorUnused)
 	return err
 }
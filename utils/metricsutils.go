@@ -15,11 +15,19 @@ func manhattanDistance(x1, y1, x2, y2 int) int {
 	return int(math.Abs(float64(x1-x2)) + math.Abs(float64(y1-y2)))
 }
 
+func chebyshevDistance(x1, y1, x2, y2 int) int {
+	return int(math.Max(math.Abs(float64(x1-x2)), math.Abs(float64(y1-y2))))
+}
+
 func Distance2Points(x1, y1, x2, y2 int, metric string) float64 {
 	if metric == "euclidean" {
 		return euclideanDistance(x1, y1, x2, y2)
 	} else if metric == "manhattan" {
 		return float64(manhattanDistance(x1, y1, x2, y2))
+	} else if metric == "chebyshev" {
+		return float64(chebyshevDistance(x1, y1, x2, y2))
+	} else if metric == "walking" {
+		return walkingDistance(x1, y1, x2, y2)
 	}
 	return 0.0
 }
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+var ParquetCompressions = map[string]parquet.CompressionCodec{
+	"uncompressed": parquet.CompressionCodec_UNCOMPRESSED,
+	"snappy":       parquet.CompressionCodec_SNAPPY,
+	"gzip":         parquet.CompressionCodec_GZIP,
+	"lz4":          parquet.CompressionCodec_LZ4,
+	"zstd":         parquet.CompressionCodec_ZSTD,
+}
+
+// ParquetFileWriter writes records one at a time in a parquet file. Columns
+// are typed from the types computed for csv headers: "struct" columns hold
+// dates and are written as timestamps, and every column is nullable.
+type ParquetFileWriter struct {
+	file         source.ParquetFile
+	writer       *writer.CSVWriter
+	types        []string
+	rowGroupRows int
+	rows         int
+}
+
+func parquetColumnMetadata(header, fieldType string) string {
+	switch fieldType {
+	case "bool":
+		return fmt.Sprintf("name=%s, type=BOOLEAN, repetitiontype=OPTIONAL", header)
+	case "int8", "int16", "int32", "uint8", "uint16":
+		return fmt.Sprintf("name=%s, type=INT32, repetitiontype=OPTIONAL", header)
+	case "int", "int64", "uint", "uint32", "uint64":
+		return fmt.Sprintf("name=%s, type=INT64, repetitiontype=OPTIONAL", header)
+	case "float32", "float64":
+		return fmt.Sprintf("name=%s, type=DOUBLE, repetitiontype=OPTIONAL", header)
+	case "struct":
+		return fmt.Sprintf("name=%s, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL", header)
+	default:
+		return fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL", header)
+	}
+}
+
+// NewParquetFileWriter creates a parquet file. A row group is written every
+// rowGroupRows records, or when the default row group size is reached if
+// rowGroupRows is 0.
+func NewParquetFileWriter(filename string, headers, types []string, compression string, rowGroupRows int) (*ParquetFileWriter, error) {
+	if compression == "" {
+		compression = "snappy"
+	}
+	codec, ok := ParquetCompressions[strings.ToLower(compression)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unsupported parquet compression %s", compression))
+	}
+	metadata := make([]string, len(headers))
+	for i, header := range headers {
+		fieldType := ""
+		if len(types) > i {
+			fieldType = types[i]
+		}
+		metadata[i] = parquetColumnMetadata(header, fieldType)
+	}
+	file, err := local.NewLocalFileWriter(filename)
+	if err != nil {
+		return nil, err
+	}
+	csvWriter, err := writer.NewCSVWriter(metadata, file, 1)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	csvWriter.CompressionType = codec
+	return &ParquetFileWriter{file: file, writer: csvWriter, types: types, rowGroupRows: rowGroupRows}, nil
+}
+
+func (w *ParquetFileWriter) WriteRow(values []any) error {
+	row := make([]any, len(values))
+	for i, value := range values {
+		fieldType := ""
+		if len(w.types) > i {
+			fieldType = w.types[i]
+		}
+		row[i] = toParquetValue(value, fieldType)
+	}
+	err := w.writer.Write(row)
+	if err != nil {
+		return err
+	}
+	w.rows++
+	if w.rowGroupRows > 0 && w.rows%w.rowGroupRows == 0 {
+		return w.writer.Flush(true)
+	}
+	return nil
+}
+
+func (w *ParquetFileWriter) Close() error {
+	err := w.writer.WriteStop()
+	if e0 := w.file.Close(); err == nil {
+		err = e0
+	}
+	return err
+}
+
+// toParquetValue converts a record value to the go type expected by the
+// parquet column, or nil if the value is missing or cannot be converted.
+func toParquetValue(value any, fieldType string) any {
+	if value == nil {
+		return nil
+	}
+	switch fieldType {
+	case "bool":
+		b, ok := value.(bool)
+		if !ok {
+			return nil
+		}
+		return b
+	case "int8", "int16", "int32", "uint8", "uint16":
+		i, ok := toInt64(value)
+		if !ok {
+			return nil
+		}
+		return int32(i)
+	case "int", "int64", "uint", "uint32", "uint64":
+		i, ok := toInt64(value)
+		if !ok {
+			return nil
+		}
+		return i
+	case "float32", "float64":
+		f, ok := toFloat64(value)
+		if !ok {
+			return nil
+		}
+		return f
+	case "struct":
+		switch v := value.(type) {
+		case time.Time:
+			return v.UnixMilli()
+		case string:
+			date, err := ParseDate(v)
+			if err != nil {
+				return nil
+			}
+			return date.UnixMilli()
+		}
+		return nil
+	default:
+		if date, ok := value.(time.Time); ok {
+			return date.Format(time.RFC3339)
+		}
+		return fmt.Sprint(value)
+	}
+}
+
+func toInt64(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func toFloat64(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	if i, ok := toInt64(value); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
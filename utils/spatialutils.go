@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const zoneIndexCellSize = 8
+
+type GridPoint struct {
+	X int
+	Y int
+}
+
+type gridCell struct {
+	cx int
+	cy int
+}
+
+// ZoneIndex stores the points of a zone in square buckets, so that the
+// distance from a point to the zone only visits the buckets around it.
+type ZoneIndex struct {
+	points  []GridPoint
+	buckets map[gridCell][]GridPoint
+	minCell gridCell
+	maxCell gridCell
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+func NewZoneIndex(points []GridPoint) *ZoneIndex {
+	index := &ZoneIndex{
+		points:  points,
+		buckets: make(map[gridCell][]GridPoint),
+	}
+	for i, point := range points {
+		cell := gridCell{floorDiv(point.X, zoneIndexCellSize), floorDiv(point.Y, zoneIndexCellSize)}
+		index.buckets[cell] = append(index.buckets[cell], point)
+		if i == 0 {
+			index.minCell, index.maxCell = cell, cell
+		} else {
+			index.minCell = gridCell{min(index.minCell.cx, cell.cx), min(index.minCell.cy, cell.cy)}
+			index.maxCell = gridCell{max(index.maxCell.cx, cell.cx), max(index.maxCell.cy, cell.cy)}
+		}
+	}
+	return index
+}
+
+func ParseGridPoints(zoneXYLoc []string) []GridPoint {
+	return ArrayMap(zoneXYLoc, func(p2Loc string) (bool, GridPoint) {
+		coords := strings.Split(p2Loc, ",")
+		if len(coords) != 2 {
+			return false, GridPoint{}
+		}
+		p2X, e1 := strconv.Atoi(strings.TrimSpace(coords[0]))
+		p2Y, e2 := strconv.Atoi(strings.TrimSpace(coords[1]))
+		return e1 == nil && e2 == nil, GridPoint{p2X, p2Y}
+	}, true, GridPoint{})
+}
+
+func NewZoneIndexFromLoc(zoneXYLoc []string) *ZoneIndex {
+	return NewZoneIndex(ParseGridPoints(zoneXYLoc))
+}
+
+func (z *ZoneIndex) Points() []GridPoint {
+	return z.points
+}
+
+func (z *ZoneIndex) Contains(x, y int) bool {
+	cell := gridCell{floorDiv(x, zoneIndexCellSize), floorDiv(y, zoneIndexCellSize)}
+	for _, point := range z.buckets[cell] {
+		if point.X == x && point.Y == y {
+			return true
+		}
+	}
+	return false
+}
+
+// Distance returns the distance from (x, y) to the closest point of the zone,
+// or math.MaxFloat64 if the zone is empty. Buckets are visited ring by ring
+// and the search stops once no farther ring can hold a closer point, which
+// holds for any metric bounded below by the largest axis difference.
+func (z *ZoneIndex) Distance(x, y int, metric string) float64 {
+	best := math.MaxFloat64
+	if len(z.points) == 0 {
+		return best
+	}
+	qCell := gridCell{floorDiv(x, zoneIndexCellSize), floorDiv(y, zoneIndexCellSize)}
+	maxRing := max(
+		abs(qCell.cx-z.minCell.cx), abs(qCell.cx-z.maxCell.cx),
+		abs(qCell.cy-z.minCell.cy), abs(qCell.cy-z.maxCell.cy),
+	)
+	for ring := 0; ring <= maxRing; ring++ {
+		for cx := qCell.cx - ring; cx <= qCell.cx+ring; cx++ {
+			for cy := qCell.cy - ring; cy <= qCell.cy+ring; cy++ {
+				if abs(cx-qCell.cx) != ring && abs(cy-qCell.cy) != ring {
+					continue
+				}
+				for _, point := range z.buckets[gridCell{cx, cy}] {
+					distance := Distance2Points(x, y, point.X, point.Y, metric)
+					if distance < best {
+						best = distance
+					}
+				}
+			}
+		}
+		if best <= float64(ring*zoneIndexCellSize) {
+			break
+		}
+	}
+	return best
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"errors"
 	"reflect"
 	"slices"
 	"strings"
@@ -10,8 +9,12 @@ import (
 )
 
 func ConvertMapToStruct(m map[string]any, target interface{}) error {
+	return convertMapToStruct(m, target, false)
+}
+
+func convertMapToStruct(m map[string]any, target interface{}, errorUnused bool) error {
 	config := &mapstructure.DecoderConfig{
-		ErrorUnused: false,
+		ErrorUnused: errorUnused,
 		Result:      target,
 	}
 	decoder, e1 := mapstructure.NewDecoder(config)
@@ -25,41 +28,6 @@ func ConvertMapToStruct(m map[string]any, target interface{}) error {
 	return nil
 }
 
-func ConvertStructToMap(o any, exclude []string, target *map[string]any) error {
-	if o == nil {
-		return errors.New("cannot convert to map")
-	}
-	sType := reflect.TypeOf(o)
-	sValue := reflect.ValueOf(o)
-	if sType.Kind() == reflect.Ptr {
-		sType = sType.Elem()
-		sValue = sValue.Elem()
-	}
-	if sType.Kind() != reflect.Struct {
-		return errors.New("object is not a struct")
-	}
-	for i := 0; i < sType.NumField(); i++ {
-		field := sType.Field(i)
-		tag := field.Tag.Get("json")
-		if tag == "-" || tag == "" {
-			tag = field.Tag.Get("bson")
-		}
-		mField := strings.Split(tag, ",")[0]
-		if mField != "" && !slices.Contains(exclude, mField) {
-			if field.Type.Kind() == reflect.Ptr {
-				if sValue.Field(i).Elem().IsZero() {
-					(*target)[mField] = reflect.Zero(field.Type.Elem()).Interface()
-				} else {
-					(*target)[mField] = sValue.Field(i).Elem().IsZero()
-				}
-			} else {
-				(*target)[mField] = sValue.Field(i).Interface()
-			}
-		}
-	}
-	return nil
-}
-
 func GetStructToMapHT(o any, exclude []string) (h []string, t []string) {
 	rt := reflect.TypeOf(o)
 	if rt.Kind() == reflect.Ptr {
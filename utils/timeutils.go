@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var dateLayouts = []string{time.RFC3339Nano, time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// ParseDate parses a date given either as RFC3339 or as a plain day (UTC).
+func ParseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, errors.New("empty date")
+	}
+	for _, layout := range dateLayouts {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("invalid date %s", value))
+}